@@ -6,12 +6,6 @@
 package flowext
 
 import (
-	"flag"
-	"fmt"
-	"sort"
-	"strings"
-
-	"github.com/jcw/flow"
 	_ "github.com/jcw/flow/gadgets"
 
 	_ "github.com/jcw/jeebus/gadgets/network"
@@ -0,0 +1,203 @@
+package conversions
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+)
+
+//Curve interpolation modes
+const (
+	CurveLinear = "linear" //straight lines between points
+	CurveSpline = "spline" //natural cubic spline through all points
+	CurveLog    = "log"    //output is linear against log(input), e.g. LDR lux
+	CurveExp    = "exp"    //log(output) is linear against input, e.g. NTC resistance
+)
+
+//CurveData is the JSON representation of a single named curve such as:
+//
+//	{ "mode": "spline", "points": [[0, -40], [512, 25], [1023, 125]] }
+type CurveData struct {
+	Mode   string       `json:"mode"`
+	Points [][2]float64 `json:"points"`
+}
+
+//Curve maps an input to an output using a table of calibration points, interpolating between them
+//using the curve mode. Inputs beyond the table are capped to the first/last point, as with RangeMapData.
+type Curve struct {
+	mode string
+	x    []float64
+	y    []float64
+	m    []float64 //spline second derivatives
+}
+
+//NewCurve creates a Curve from a mode and a set of [input, output] calibration points (in any order)
+func NewCurve(mode string, points [][2]float64) (*Curve, error) {
+
+	if mode == "" {
+		mode = CurveLinear
+	}
+
+	switch mode {
+	case CurveLinear, CurveSpline, CurveLog, CurveExp:
+	default:
+		return nil, fmt.Errorf("unknown curve mode:%s", mode)
+	}
+
+	if len(points) < 2 {
+		return nil, errors.New("a curve needs at least 2 points")
+	}
+
+	sorted := make([][2]float64, len(points))
+	copy(sorted, points)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i][0] < sorted[j][0] })
+
+	c := &Curve{mode: mode}
+	for i, p := range sorted {
+		if i > 0 && p[0] == sorted[i-1][0] {
+			return nil, fmt.Errorf("duplicate curve input:%v", p[0])
+		}
+		if mode == CurveLog && p[0] <= 0 {
+			return nil, fmt.Errorf("log curve inputs must be positive:%v", p[0])
+		}
+		if mode == CurveExp && p[1] <= 0 {
+			return nil, fmt.Errorf("exp curve outputs must be positive:%v", p[1])
+		}
+		c.x = append(c.x, p[0])
+		c.y = append(c.y, p[1])
+	}
+
+	if mode == CurveSpline {
+		c.m = splineSecondDerivatives(c.x, c.y)
+	}
+
+	return c, nil
+}
+
+//Map transforms the input using the calibration table, the bool is false if the result is not a number
+func (c *Curve) Map(v float64) (float64, bool) {
+
+	n := len(c.x)
+
+	switch {
+	case math.IsNaN(v):
+		return 0, false
+	case v <= c.x[0]:
+		return c.y[0], true
+	case v >= c.x[n-1]:
+		return c.y[n-1], true
+	}
+
+	//the interval [i, i+1] containing v
+	i := sort.Search(n, func(k int) bool { return c.x[k] > v }) - 1
+
+	x0, x1, y0, y1 := c.x[i], c.x[i+1], c.y[i], c.y[i+1]
+
+	var f float64
+	switch c.mode {
+	case CurveSpline:
+		h := x1 - x0
+		a := (x1 - v) / h
+		b := (v - x0) / h
+		f = a*y0 + b*y1 + ((a*a*a-a)*c.m[i]+(b*b*b-b)*c.m[i+1])*h*h/6
+	case CurveLog:
+		f = y0 + (math.Log(v)-math.Log(x0))/(math.Log(x1)-math.Log(x0))*(y1-y0)
+	case CurveExp:
+		f = math.Exp(math.Log(y0) + (v-x0)/(x1-x0)*(math.Log(y1)-math.Log(y0)))
+	default:
+		f = y0 + (v-x0)/(x1-x0)*(y1-y0)
+	}
+
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, false
+	}
+
+	return f, true
+}
+
+//splineSecondDerivatives solves the tridiagonal system for a natural cubic spline (zero curvature at both ends)
+func splineSecondDerivatives(x, y []float64) []float64 {
+	n := len(x)
+	m := make([]float64, n)
+	if n < 3 {
+		return m
+	}
+
+	//forward sweep of the Thomas algorithm over the interior points
+	c := make([]float64, n)
+	d := make([]float64, n)
+	for i := 1; i < n-1; i++ {
+		h0 := x[i] - x[i-1]
+		h1 := x[i+1] - x[i]
+		rhs := 6 * ((y[i+1]-y[i])/h1 - (y[i]-y[i-1])/h0)
+		diag := 2*(h0+h1) - h0*c[i-1]
+		c[i] = h1 / diag
+		d[i] = (rhs - h0*d[i-1]) / diag
+	}
+
+	for i := n - 2; i > 0; i-- {
+		m[i] = d[i] - c[i]*m[i+1]
+	}
+
+	return m
+}
+
+//LoadCurves reads a JSON file holding named curves such as:
+//
+//	{
+//	  "ntc": { "mode": "exp", "points": [[100, 337.0], [512, 10.0], [900, 2.1]] },
+//	  "ldr": { "mode": "log", "points": [[1, 0], [255, 1000]] }
+//	}
+func LoadCurves(file string) (map[string]*Curve, error) {
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := map[string]CurveData{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+
+	curves := make(map[string]*Curve)
+	for name, cd := range raw {
+		c, err := NewCurve(cd.Mode, cd.Points)
+		if err != nil {
+			return nil, fmt.Errorf("%s: curve %s: %s", file, name, err)
+		}
+		curves[name] = c
+	}
+
+	return curves, nil
+}
+
+//toFloat64 provides the numeric types RangeMapper accepts as a float64
+func toFloat64(m interface{}) (float64, bool) {
+	switch v := m.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	}
+	return 0, false
+}
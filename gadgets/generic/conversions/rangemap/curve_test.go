@@ -0,0 +1,119 @@
+package conversions
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jcw/flow"
+)
+
+func TestCurveLinear(t *testing.T) {
+
+	c, err := NewCurve(CurveLinear, [][2]float64{{100, 10}, {0, 0}, {200, 50}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range [][2]float64{{-5, 0}, {0, 0}, {50, 5}, {100, 10}, {150, 30}, {200, 50}, {500, 50}} {
+		if v, ok := c.Map(tc[0]); !ok || v != tc[1] {
+			t.Errorf("Map(%v) expected %v, got %v %v", tc[0], tc[1], v, ok)
+		}
+	}
+}
+
+func TestCurveSplineThroughPoints(t *testing.T) {
+
+	points := [][2]float64{{0, 0}, {1, 1}, {2, 4}, {3, 9}, {4, 16}}
+	c, err := NewCurve(CurveSpline, points)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range points {
+		if v, _ := c.Map(p[0]); math.Abs(v-p[1]) > 1e-9 {
+			t.Errorf("spline should pass through %v, got %v", p, v)
+		}
+	}
+
+	//x^2 sampled at integers, the spline should be close in between
+	if v, _ := c.Map(2.5); math.Abs(v-6.25) > 0.1 {
+		t.Error("spline Map(2.5) expected about 6.25, got", v)
+	}
+}
+
+func TestCurveLogExp(t *testing.T) {
+
+	l, err := NewCurve(CurveLog, [][2]float64{{1, 0}, {1000, 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := l.Map(100); math.Abs(v-2) > 1e-9 {
+		t.Error("log Map(100) expected 2, got", v)
+	}
+
+	e, err := NewCurve(CurveExp, [][2]float64{{0, 1}, {3, 1000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := e.Map(2); math.Abs(v-100) > 1e-9 {
+		t.Error("exp Map(2) expected 100, got", v)
+	}
+}
+
+func TestCurveInvalid(t *testing.T) {
+
+	if _, err := NewCurve(CurveLinear, [][2]float64{{0, 0}}); err == nil {
+		t.Error("a single point should not be a valid curve")
+	}
+	if _, err := NewCurve(CurveLinear, [][2]float64{{0, 0}, {0, 1}}); err == nil {
+		t.Error("duplicate inputs should not be a valid curve")
+	}
+	if _, err := NewCurve(CurveLog, [][2]float64{{0, 0}, {10, 1}}); err == nil {
+		t.Error("log curve with zero input should not be valid")
+	}
+	if _, err := NewCurve(CurveExp, [][2]float64{{0, -1}, {10, 1}}); err == nil {
+		t.Error("exp curve with negative output should not be valid")
+	}
+	if _, err := NewCurve("cubic", [][2]float64{{0, 0}, {10, 1}}); err == nil {
+		t.Error("unknown mode should not be valid")
+	}
+}
+
+func ExampleRangeFlowCurves() {
+
+	f, _ := ioutil.TempFile("", "curves")
+	defer os.Remove(f.Name())
+	f.WriteString(`{
+		"soil": { "points": [[200, 100], [800, 0]] },
+		"ldr":  { "mode": "log", "points": [[1, 0], [100, 2]] }
+	}`)
+	f.Close()
+
+	g := new(RangeMapper)
+	p := make(chan flow.Message, 5)
+	in := make(chan flow.Message, 5)
+	g.Param, g.In, g.Out = p, in, new(MockOutput)
+
+	p <- flow.Tag{"fromlow", float64(0)}
+	p <- flow.Tag{"fromhi", float64(255)}
+	p <- flow.Tag{"tolow", float64(0)}
+	p <- flow.Tag{"tohi", float64(1023)}
+	p <- flow.Tag{"curves", f.Name()}
+	close(p)
+
+	go func() { g.Run() }()
+
+	in <- flow.Tag{"soil", 500}
+	in <- flow.Tag{"ldr", uint8(10)}
+	in <- flow.Tag{"other", float64(128)}
+
+	<-time.After(time.Millisecond * 100)
+
+	// Output:
+	// flow.Tag: {soil 50}
+	// flow.Tag: {ldr 1}
+	// flow.Tag: {other 514}
+}
@@ -2,6 +2,8 @@
 package conversions
 
 import (
+	"fmt"
+
 	"github.com/golang/glog"
 	"github.com/jcw/flow"
 	"math"
@@ -14,157 +16,275 @@ func init() {
 
 
 // RangeMapper helps to convert an input value to an equivalent output value within a set scale
+// Named calibration curves can also be loaded (see LoadCurves), a flow.Tag whose Tag names a curve is
+// mapped through that curve and emitted as a float64, anything else uses the linear range.
+// A table of ranges keyed by topic pattern can also be given, so one RangeMapper can serve a mixed stream of
+// flow.Tag's, those not matching any pattern use the linear range, or failing that pass through (or are dropped).
 type RangeMapper struct {
 	flow.Gadget
 	Param    flow.Input
 	In       flow.Input
 	Out      flow.Output
+	Reject   flow.Output //inputs outside the from range when the clamp mode is 'reject'
+	Error    flow.Output //configuration problems, mapping is held off until the configuration is usable
 }
 
 
 //Gadget loop
+//.Param stays live alongside .In, so ranges, curves and tables can be retuned while the circuit runs.
+//Any pending .Param changes are applied before the next .In message is mapped.
 func (g *RangeMapper) Run() {
 
-	//need upper and lower bounds input
-	//gi := &RangeMapData{fromLow:0,fromHi:1023,toLow:0,toHi:255}  //typical ADC to PWM
-	gi := NewRangeMap()
-	for param := range g.Param {
-
-		switch param.(type) {
-
-		case flow.Tag:
-			switch param.(flow.Tag).Tag {
-			case "fromlow":
-				gi.SetFromLow( int64(param.(flow.Tag).Msg.(float64) ) )
-			case "fromhi":
-				gi.SetFromHi( int64(param.(flow.Tag).Msg.(float64) ) )
-			case "tolow":
-				gi.SetToLow( int64(param.(flow.Tag).Msg.(float64) ) )
-			case "tohi":
-				gi.SetToHi( int64(param.(flow.Tag).Msg.(float64) ) )
+	cfg := newRangeMapperConfig()
+	reported := false //we only report an incomplete configuration once per change
+
+	params := g.Param
+	for {
+		select {
+		case param, ok := <-params:
+			if !ok {
+				params = nil //no more changes, but carry on mapping
+				continue
+			}
+			g.applyParam(cfg, param)
+			reported = false
+
+		case m, ok := <-g.In:
+			if !ok {
+				return
+			}
+
+			//take on any changes that arrived alongside this message
+			for pending := true; pending && params != nil; {
+				select {
+				case param, ok := <-params:
+					if !ok {
+						params = nil
+						break
+					}
+					g.applyParam(cfg, param)
+					reported = false
+				default:
+					pending = false
+				}
+			}
+
+			if !cfg.Ready() {
+				//hold off mapping until we have something to map with
+				if !reported {
+					g.Error.Send("rangemap: incomplete configuration, need fromlow, fromhi, tolow and tohi, a table or curves")
+					reported = true
+				}
+				continue
 			}
+
+			g.mapMessage(cfg, m)
 		}
 	}
+}
+
+//applyParam applies a single .Param change, reporting anything we cannot use on .Error
+func (g *RangeMapper) applyParam(cfg *rangeMapperConfig, param flow.Message) {
+	if err := cfg.Apply(param); err != nil {
+		g.Error.Send(fmt.Sprintf("rangemap: %s", err))
+	}
+}
 
+//mapMessage maps a single .In message using the current configuration
+func (g *RangeMapper) mapMessage(cfg *rangeMapperConfig, m flow.Message) {
 
-	if !gi.Valid() {
-		glog.Fatal()
+	//a named curve takes precedence over the linear range
+	if t, ok := m.(flow.Tag); ok {
+		if c, ok := cfg.curves[t.Tag]; ok {
+			if f, ok := toFloat64(t.Msg); ok {
+				if v, ok := c.Map(f); ok {
+					g.Out.Send(flow.Tag{Tag: t.Tag, Msg: v})
+				}
+			}
+			return
+		}
 	}
 
+	//then the first matching topic pattern, falling back to the linear range. With a table, a tag no pattern
+	//matches is only mapped linearly when unmatched is "pass", "drop" drops it even if there is a linear range.
+	rm := cfg.gi
+	if t, ok := m.(flow.Tag); ok && cfg.tables.Len() > 0 {
+		if trm, ok := cfg.tables.Lookup(t.Tag); ok {
+			rm = trm
+		} else if !cfg.passUnmatched {
+			return
+		}
+	}
 
-	for m := range g.In {
+	if !rm.Valid() {
+		if cfg.passUnmatched {
+			g.Out.Send(m)
+		}
+		return
+	}
 
-		switch m.(type) {
-		case flow.Tag: //the input is a flow.Tag
-			switch m.(flow.Tag).Msg.(type) {
-			case float64:
-				if f,ok := m.(flow.Tag).Msg.(float64); ok {
-					if v,ok := gi.Map(int64(f));ok {
-						g.Out.Send(flow.Tag{Tag:m.(flow.Tag).Tag , Msg:float64(v)})
-					}
-				}
-			case float32:
-				if f,ok := m.(flow.Tag).Msg.(float32); ok {
-					if v,ok := gi.Map(int64(f));ok {
-						g.Out.Send(flow.Tag{Tag:m.(flow.Tag).Tag , Msg:float32(v)})
-					}
-				}
-			case int64:
-				if f,ok := m.(flow.Tag).Msg.(int64); ok {
-					if v,ok := gi.Map(f); ok {
-						g.Out.Send(flow.Tag{Tag:m.(flow.Tag).Tag , Msg:int64(v)})
-					}
-				}
-			case int32:
-				if f,ok := m.(flow.Tag).Msg.(int32); ok {
-					if v,ok := gi.Map(int64(f));ok {
-						g.Out.Send(flow.Tag{Tag:m.(flow.Tag).Tag , Msg:int32(v)})
-					}
-				}
-			case uint32:
-				if f,ok := m.(flow.Tag).Msg.(uint32); ok {
-					if v,ok := gi.Map(int64(f));ok {
-						g.Out.Send(flow.Tag{Tag:m.(flow.Tag).Tag , Msg:uint32(v)})
-					}
-				}
-			case int16:
-				if f,ok := m.(flow.Tag).Msg.(int16); ok {
-					if v,ok := gi.Map(int64(f));ok {
-						g.Out.Send(flow.Tag{Tag:m.(flow.Tag).Tag , Msg:int16(v)})
-					}
-				}
-			case uint16:
-				if f,ok := m.(flow.Tag).Msg.(uint16); ok {
-					if v,ok := gi.Map(int64(f));ok {
-						g.Out.Send(flow.Tag{Tag:m.(flow.Tag).Tag , Msg:uint16(v)})
-					}
-				}
-			case int8:
-				if f,ok := m.(flow.Tag).Msg.(int8); ok {
-					if v,ok := gi.Map(int64(f));ok {
-						g.Out.Send(flow.Tag{Tag:m.(flow.Tag).Tag , Msg:int8(v)})
-					}
-				}
-			case uint8:
-				if f,ok := m.(flow.Tag).Msg.(uint8); ok {
-					if v,ok := gi.Map(int64(f));ok {
-						g.Out.Send(flow.Tag{Tag:m.(flow.Tag).Tag , Msg:uint8(v)})
-					}
-				}
-			case int:
-				if f,ok := m.(flow.Tag).Msg.(int); ok {
-					if v,ok := gi.Map(int64(f));ok {
-						g.Out.Send(flow.Tag{Tag:m.(flow.Tag).Tag , Msg:int(v)})
-					}
-				}
+	switch m.(type) {
+	case flow.Tag: //the input is a flow.Tag
+		if v, ok := mapValue(rm, m.(flow.Tag).Msg); ok {
+			g.Out.Send(flow.Tag{Tag:m.(flow.Tag).Tag , Msg:v})
+		} else if _, numeric := toFloat64(m.(flow.Tag).Msg); numeric {
+			g.Reject.Send(m)
+		}
+	default: //the input is a normal flow.Message
+		if v, ok := mapValue(rm, m); ok {
+			g.Out.Send(v)
+		} else if _, numeric := toFloat64(m); numeric {
+			g.Reject.Send(m)
+		}
+	}
+}
 
+//rangeMapperConfig is everything a RangeMapper maps with, as built up from .Param
+type rangeMapperConfig struct {
+	gi            *RangeMapData      //the linear range
+	curves        map[string]*Curve  //calibration curves selected by flow.Tag.Tag
+	tables        *RangeTable        //ranges selected by matching flow.Tag.Tag against a topic pattern
+	passUnmatched bool               //what to do with messages we have no range for
+}
 
-			}
-		default: //the input is a normal flow.Message
-			switch m.(type) {
-			case float64:
-				f:= m.(float64)
-				if v,ok := gi.Map(int64(f));ok {
-					g.Out.Send( float64(v) )
-				}
-			case float32:
-				f:= m.(float32)
-				if v,ok := gi.Map(int64(f));ok {
-					g.Out.Send( float32(v) )
-				}
-			case  int64:
-				f:= m.(int64)
-				if v,ok := gi.Map(int64(f));ok {
-					g.Out.Send( int64(v) )
-				}
-			case  int32:
-				f:= m.(int32)
-				if v,ok := gi.Map(int64(f));ok {
-					g.Out.Send( int32(v) )
-				}
-			case  int16:
-				f:= m.(int16)
-				if v,ok := gi.Map(int64(f));ok {
-					g.Out.Send( int16(v) )
-				}
-			case  int8:
-				f:= m.(int8)
-				if v,ok := gi.Map(int64(f));ok {
-					g.Out.Send( int8(v) )
-				}
-			case  int:
-				f:= m.(int)
-				if v,ok := gi.Map(int64(f));ok {
-					g.Out.Send( int(v) )
-				}
+func newRangeMapperConfig() *rangeMapperConfig {
+	//need upper and lower bounds input
+	//gi := &RangeMapData{fromLow:0,fromHi:1023,toLow:0,toHi:255}  //typical ADC to PWM
+	return &rangeMapperConfig{
+		gi:            NewRangeMap(),
+		curves:        make(map[string]*Curve),
+		tables:        &RangeTable{},
+		passUnmatched: true,
+	}
+}
+
+//Ready is true once there is at least one way of mapping messages
+func (c *rangeMapperConfig) Ready() bool {
+	return c.gi.Valid() || len(c.curves) > 0 || c.tables.Len() > 0
+}
 
+//Apply takes on a single .Param flow.Tag, a bad value leaves the existing configuration untouched
+func (c *rangeMapperConfig) Apply(param flow.Message) error {
+
+	p, ok := param.(flow.Tag)
+	if !ok {
+		return fmt.Errorf("param must be a flow.Tag, got:%v", param)
+	}
+
+	switch p.Tag {
+	case "fromlow", "fromhi", "tolow", "tohi", "precision":
+		f, ok := toFloat64(p.Msg)
+		if !ok {
+			return fmt.Errorf("%s must be a number, got:%v", p.Tag, p.Msg)
+		}
+		switch p.Tag {
+		case "fromlow":
+			c.gi.SetFromLowFloat(f)
+		case "fromhi":
+			c.gi.SetFromHiFloat(f)
+		case "tolow":
+			c.gi.SetToLowFloat(f)
+		case "tohi":
+			c.gi.SetToHiFloat(f)
+		case "precision":
+			if !c.gi.SetPrecision(int(f)) {
+				return fmt.Errorf("invalid precision:%v", p.Msg)
 			}
 		}
-
+	case "clamp":
+		if mode, ok := p.Msg.(string); !ok || !c.gi.SetClamp(mode) {
+			return fmt.Errorf("unknown clamp mode:%v", p.Msg)
+		}
+	case "table":
+		hash, ok := p.Msg.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("table must be a hash, got:%v", p.Msg)
+		}
+		pattern, _ := hash["match"].(string)
+		if pattern == "" {
+			return fmt.Errorf("table needs a match pattern:%v", p.Msg)
+		}
+		rm, err := NewRangeMapFromParams(hash)
+		if err != nil {
+			return fmt.Errorf("table %s: %s", pattern, err)
+		}
+		c.tables.Add(pattern, rm)
+	case "unmatched":
+		switch p.Msg {
+		case "pass":
+			c.passUnmatched = true
+		case "drop":
+			c.passUnmatched = false
+		default:
+			return fmt.Errorf("unmatched must be pass or drop, got:%v", p.Msg)
+		}
+	case "curves":
+		file, ok := p.Msg.(string)
+		if !ok {
+			return fmt.Errorf("curves must be a filename, got:%v", p.Msg)
+		}
+		loaded, err := LoadCurves(file)
+		if err != nil {
+			return err
+		}
+		for name, curve := range loaded {
+			c.curves[name] = curve
+		}
+	default:
+		return fmt.Errorf("unknown param:%s", p.Tag)
 	}
 
+	return nil
+}
+
+//mapValue maps a numeric message, keeping its type. Floats are mapped at the configured precision, integers
+//are rounded to the nearest whole value. ok is false if the message is not numeric or could not be mapped.
+func mapValue(gi *RangeMapData, m flow.Message) (flow.Message, bool) {
 
+	switch f := m.(type) {
+	case float64:
+		if v, ok := gi.MapFloat(f); ok {
+			return float64(v), true
+		}
+	case float32:
+		if v, ok := gi.MapFloat(float64(f)); ok {
+			return float32(v), true
+		}
+	case int64:
+		if v, ok := gi.Map(f); ok {
+			return int64(v), true
+		}
+	case int32:
+		if v, ok := gi.Map(int64(f)); ok {
+			return int32(v), true
+		}
+	case uint32:
+		if v, ok := gi.Map(int64(f)); ok {
+			return uint32(v), true
+		}
+	case int16:
+		if v, ok := gi.Map(int64(f)); ok {
+			return int16(v), true
+		}
+	case uint16:
+		if v, ok := gi.Map(int64(f)); ok {
+			return uint16(v), true
+		}
+	case int8:
+		if v, ok := gi.Map(int64(f)); ok {
+			return int8(v), true
+		}
+	case uint8:
+		if v, ok := gi.Map(int64(f)); ok {
+			return uint8(v), true
+		}
+	case int:
+		if v, ok := gi.Map(int64(f)); ok {
+			return int(v), true
+		}
+	}
 
+	return nil, false
 }
 
 
@@ -177,54 +297,117 @@ type RangeMap interface {
 	SetFromHi(int64) bool
 }
 
+//RangeMapFloat is the float64 equivalent of RangeMap, with control over output precision and clamping
+type RangeMapFloat interface {
+	MapFloat(float64) (float64, bool)
+	SetToLowFloat(float64) bool
+	SetToHiFloat(float64) bool
+	SetFromLowFloat(float64) bool
+	SetFromHiFloat(float64) bool
+	SetPrecision(int) bool
+	SetClamp(string) bool
+}
+
+//Clamp modes determine what happens to inputs outside the from range
+const (
+	ClampCap    = "clamp"  //cap the output to the to range (default)
+	ClampPass   = "pass"   //extrapolate beyond the to range
+	ClampReject = "reject" //refuse to map the input
+)
+
 type RangeMapData struct {
-	fromLow int64
-	fromHi int64
-	toLow int64
-	toHi int64
+	fromLow float64
+	fromHi float64
+	toLow float64
+	toHi float64
 	bit uint8
+
+	precision int    //decimal places MapFloat rounds to
+	clamp     string //one of the Clamp modes
 }
 
 //NewRangeMap creates a RangeMap that must be provided a From/To range later otherwise its not valid
 func NewRangeMap() (*RangeMapData) {
-	return &RangeMapData{}
+	return &RangeMapData{clamp: ClampCap}
 }
 
 //NewRangeMapFrom creates a RangeMap with the From/To values provided
 func NewRangeMapFrom(fromLo, fromHi, toLo, toHi int64) (*RangeMapData) {
-	return &RangeMapData{fromLow: fromLo, fromHi: fromHi, toLow:toLo, toHi: toHi, bit:15}
+	return NewRangeMapFloat(float64(fromLo), float64(fromHi), float64(toLo), float64(toHi))
+}
 
+//NewRangeMapFloat creates a RangeMap with the float64 From/To values provided
+func NewRangeMapFloat(fromLo, fromHi, toLo, toHi float64) (*RangeMapData) {
+	return &RangeMapData{fromLow: fromLo, fromHi: fromHi, toLow:toLo, toHi: toHi, bit:15, clamp: ClampCap}
 }
 
 func (r *RangeMapData) Valid() (bool) {
-	return r.bit == 15
+	return r.bit == 15 && r.fromHi != r.fromLow
 }
 
 func (r *RangeMapData) SetFromLow(v int64) (bool) {
+	return r.SetFromLowFloat(float64(v))
+}
+func (r *RangeMapData) SetFromHi(v int64) (bool) {
+	return r.SetFromHiFloat(float64(v))
+}
+func (r *RangeMapData) SetToLow(v int64) (bool) {
+	return r.SetToLowFloat(float64(v))
+}
+func (r *RangeMapData) SetToHi(v int64) (bool) {
+	return r.SetToHiFloat(float64(v))
+}
+
+func (r *RangeMapData) SetFromLowFloat(v float64) (bool) {
 	r.fromLow = v
 	r.setBit(0)
 	return true
 }
-func (r *RangeMapData) SetFromHi(v int64) (bool) {
+func (r *RangeMapData) SetFromHiFloat(v float64) (bool) {
 	r.fromHi = v
 	r.setBit(1)
 	return true
 }
-func (r *RangeMapData) SetToLow(v int64) (bool) {
+func (r *RangeMapData) SetToLowFloat(v float64) (bool) {
 	r.toLow = v
 	r.setBit(2)
 	return true
 }
-func (r *RangeMapData) SetToHi(v int64) (bool) {
+func (r *RangeMapData) SetToHiFloat(v float64) (bool) {
 	r.toHi = v
 	r.setBit(3)
 	return true
 }
 
+//SetPrecision sets the number of decimal places MapFloat rounds its output to
+func (r *RangeMapData) SetPrecision(p int) (bool) {
+	if p < 0 {
+		return false
+	}
+	r.precision = p
+	return true
+}
+
+//SetClamp selects how inputs outside the from range are handled, see the Clamp modes
+func (r *RangeMapData) SetClamp(mode string) (bool) {
+	switch mode {
+	case ClampCap, ClampPass, ClampReject:
+		r.clamp = mode
+		return true
+	}
+	return false
+}
+
 func (r *RangeMapData) setBit(pos uint) () {
 	r.bit |= 1 << pos
 }
 
+//InRange reports whether v lies within the from range, whichever way round it was given
+func (r *RangeMapData) InRange(v float64) (bool) {
+	lo, hi := math.Min(r.fromLow, r.fromHi), math.Max(r.fromLow, r.fromHi)
+	return v >= lo && v <= hi
+}
+
 
 //MustMap will panic if the Map function returns false, otherwise it silently returns Map value.
 func (r *RangeMapData) MustMap(v int64) (int64) {
@@ -239,25 +422,45 @@ func (r *RangeMapData) MustMap(v int64) (int64) {
 //using this simple formula: = (x - in_min) * (out_max - out_min) / (in_max - in_min) + out_min;
 //input is converted to float64 before calculations and the result is rounded back down
 //to fit an int64 output, where 1.51 = 2 and 1.49=1
-//output is capped to stay within output range
+//output is capped to stay within output range (unless the clamp mode says otherwise)
 //this is a generalised function for *MY* wide use-cases, there are many ways to get specific results faster and more efficiently
 func (r *RangeMapData) Map(v int64) (int64,bool) {
 
-	if ! r.Valid() {
+	fr, ok := r.mapRounded(float64(v), 0)
+
+	return  int64( fr ), ok
+}
+
+//MapFloat is Map for float64 input and output, the output is rounded to the configured precision
+func (r *RangeMapData) MapFloat(v float64) (float64,bool) {
+	return r.mapRounded(v, r.precision)
+}
+
+func (r *RangeMapData) mapRounded(v float64, prec int) (float64,bool) {
+
+	if ! r.Valid() || math.IsNaN(v) {
 		return 0,false
 	}
 
-	f := float64(v-r.fromLow)/float64(r.fromHi-r.fromLow) * float64(r.toHi-r.toLow) + float64(r.toLow)
-
-	fr := RoundPrec(f,0)
-	if fr > float64(r.toHi) {
-		fr = float64(r.toHi)
-	} else if fr < float64(r.toLow) {
-		fr = float64(r.toLow)
+	if r.clamp == ClampReject && !r.InRange(v) {
+		return 0,false
 	}
 
+	f := (v-r.fromLow)/(r.fromHi-r.fromLow) * (r.toHi-r.toLow) + r.toLow
+
+	fr := RoundPrec(f,prec)
+
+	if r.clamp == ClampCap {
+		//the output range may be inverted (tolow > tohi), so cap to whichever bound is which
+		lo, hi := math.Min(r.toLow, r.toHi), math.Max(r.toLow, r.toHi)
+		if fr > hi {
+			fr = hi
+		} else if fr < lo {
+			fr = lo
+		}
+	}
 
-	return  int64( fr ), true
+	return fr, true
 }
 
 //generic Precision rounding of float64 (go-lang-nuts discussion)
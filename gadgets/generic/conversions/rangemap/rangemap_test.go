@@ -26,6 +26,15 @@ func (c *MockOutput) Send(m flow.Message) {
 
 func (c *MockOutput) Disconnect() {}
 
+//PinOutput prints like MockOutput, prefixed by the name of the pin, for examples that use several outputs
+type PinOutput string
+
+func (c PinOutput) Send(m flow.Message) {
+	fmt.Printf("%s %T: %v\n", c, m, m)
+}
+
+func (c PinOutput) Disconnect() {}
+
 
 func ExampleRangeFlow() {
 
@@ -1029,3 +1038,122 @@ func ExampleRangeToBool() {
 	//	Input 214 Output 0
 
 }
+
+
+func TestRangeMapFloatPrecision(t *testing.T) () {
+
+	r := NewRangeMapFloat(0, 100, 32, 212) //celsius to fahrenheit
+
+	if v, ok := r.MapFloat(21.7); !ok || v != 71 {
+		t.Error("Expected 71 at default precision, got", v)
+	}
+
+	r.SetPrecision(2)
+	if v, ok := r.MapFloat(21.7); !ok || v != 71.06 {
+		t.Error("Expected 71.06, got", v)
+	}
+}
+
+func TestRangeInvertedOutputClamp(t *testing.T) () {
+
+	r := NewRangeMapFrom(0, 255, 1023, 0)
+
+	if v := r.MustMap(0); v != 1023 {
+		t.Error("Expected 1023, got", v)
+	}
+	if v := r.MustMap(255); v != 0 {
+		t.Error("Expected 0, got", v)
+	}
+	if v := r.MustMap(300); v != 0 {
+		t.Error("Expected over range to clamp to 0, got", v)
+	}
+	if v := r.MustMap(-45); v != 1023 {
+		t.Error("Expected under range to clamp to 1023, got", v)
+	}
+}
+
+func TestRangeClampModes(t *testing.T) () {
+
+	r := NewRangeMapFrom(255, 0, 0, 100) //inverted input range
+
+	if v := r.MustMap(300); v != 0 {
+		t.Error("Expected clamp to 0, got", v)
+	}
+
+	r.SetClamp(ClampPass)
+	if v := r.MustMap(306); v != -20 {
+		t.Error("Expected pass through to -20, got", v)
+	}
+
+	r.SetClamp(ClampReject)
+	if _, ok := r.Map(306); ok {
+		t.Error("Expected 306 to be rejected")
+	}
+	if v, ok := r.Map(51); !ok || v != 80 {
+		t.Error("Expected 80, got", v, ok)
+	}
+
+	if r.SetClamp("wrap") {
+		t.Error("Expected unknown clamp mode to be refused")
+	}
+}
+
+func ExampleRangeFlowReject() {
+
+	g := new(RangeMapper)
+	p := make(chan flow.Message, 6)
+	in := make(chan flow.Message, 3)
+	g.Param, g.In, g.Out, g.Reject = p, in, PinOutput("Out"), PinOutput("Reject")
+
+	p <- flow.Tag{"fromlow", float64(0)}
+	p <- flow.Tag{"fromhi", float64(40)}
+	p <- flow.Tag{"tolow", float64(0)}
+	p <- flow.Tag{"tohi", float64(1)}
+	p <- flow.Tag{"precision", float64(3)}
+	p <- flow.Tag{"clamp", "reject"}
+	close(p)
+
+	go func() { g.Run() }()
+
+	in <- flow.Tag{"temp", float64(21.7)}
+	in <- flow.Tag{"temp", float64(-5)}
+	in <- flow.Tag{"temp", int(20)}
+
+	<-time.After(time.Millisecond * 100)
+
+	// Output:
+	// Out flow.Tag: {temp 0.543}
+	// Reject flow.Tag: {temp -5}
+	// Out flow.Tag: {temp 1}
+}
+
+//an incomplete range is reported on .Error rather than exiting, then retuned live via .Param
+func ExampleRangeFlowLiveParams() {
+
+	g := new(RangeMapper)
+	p := make(chan flow.Message)
+	in := make(chan flow.Message)
+	g.Param, g.In, g.Out, g.Error = p, in, new(MockOutput), new(MockOutput)
+
+	go func() { g.Run() }()
+
+	p <- flow.Tag{"fromlow", float64(0)}
+	p <- flow.Tag{"fromhi", float64(255)}
+	p <- flow.Tag{"tolow", "zero"}
+	in <- float64(100)
+
+	p <- flow.Tag{"tolow", float64(0)}
+	p <- flow.Tag{"tohi", float64(1)}
+	in <- float64(100)
+
+	p <- flow.Tag{"fromhi", float64(150)} //the evenings are drawing in
+	in <- float64(100)
+
+	<-time.After(time.Millisecond * 100)
+
+	// Output:
+	// string: rangemap: tolow must be a number, got:zero
+	// string: rangemap: incomplete configuration, need fromlow, fromhi, tolow and tohi, a table or curves
+	// float64: 0
+	// float64: 1
+}
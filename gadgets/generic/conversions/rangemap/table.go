@@ -0,0 +1,109 @@
+package conversions
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+//RangeTable holds a RangeMapData per MQTT style topic pattern, allowing one RangeMapper to handle a mixed
+//stream of flow.Tag's such as those from MQTTSub or DataSub.
+type RangeTable struct {
+	entries []rangeTableEntry
+}
+
+type rangeTableEntry struct {
+	pattern string
+	rm      *RangeMapData
+}
+
+//Add sets the RangeMapData for a pattern, patterns are matched in the order they were first added
+func (t *RangeTable) Add(pattern string, rm *RangeMapData) {
+	for i, e := range t.entries {
+		if e.pattern == pattern {
+			t.entries[i].rm = rm
+			return
+		}
+	}
+	t.entries = append(t.entries, rangeTableEntry{pattern, rm})
+}
+
+//Len is the number of patterns in the table
+func (t *RangeTable) Len() int {
+	return len(t.entries)
+}
+
+//Lookup finds the RangeMapData of the first pattern that matches the topic
+func (t *RangeTable) Lookup(topic string) (*RangeMapData, bool) {
+	for _, e := range t.entries {
+		if MatchTopic(e.pattern, topic) {
+			return e.rm, true
+		}
+	}
+	return nil, false
+}
+
+//MatchTopic matches a topic against an MQTT style pattern where '+' matches exactly one level
+//and a trailing '#' matches any remaining levels (including none).
+func MatchTopic(pattern, topic string) bool {
+	pp := strings.Split(pattern, "/")
+	tp := strings.Split(topic, "/")
+
+	for i, p := range pp {
+		if p == "#" && i == len(pp)-1 {
+			return true
+		}
+		if i >= len(tp) {
+			return false
+		}
+		if p != "+" && p != tp[i] {
+			return false
+		}
+	}
+
+	return len(pp) == len(tp)
+}
+
+//NewRangeMapFromParams creates a RangeMap from a .Param style hash such as:
+//
+//	{ match: "sensor/+/light", fromlow: 0, fromhi: 255, tolow: 0, tohi: 1, precision: 0, clamp: "clamp" }
+//
+//the 'match' key is ignored here, it is up to the caller to use it.
+func NewRangeMapFromParams(params map[string]interface{}) (*RangeMapData, error) {
+
+	rm := NewRangeMap()
+
+	for k, v := range params {
+		switch k {
+		case "fromlow", "fromhi", "tolow", "tohi", "precision":
+			f, ok := v.(float64)
+			if !ok {
+				return nil, fmt.Errorf("%s must be a number, got:%v", k, v)
+			}
+			switch k {
+			case "fromlow":
+				rm.SetFromLowFloat(f)
+			case "fromhi":
+				rm.SetFromHiFloat(f)
+			case "tolow":
+				rm.SetToLowFloat(f)
+			case "tohi":
+				rm.SetToHiFloat(f)
+			case "precision":
+				if !rm.SetPrecision(int(f)) {
+					return nil, fmt.Errorf("invalid precision:%v", v)
+				}
+			}
+		case "clamp":
+			if mode, ok := v.(string); !ok || !rm.SetClamp(mode) {
+				return nil, fmt.Errorf("unknown clamp mode:%v", v)
+			}
+		}
+	}
+
+	if !rm.Valid() {
+		return nil, errors.New("range needs fromlow, fromhi, tolow and tohi")
+	}
+
+	return rm, nil
+}
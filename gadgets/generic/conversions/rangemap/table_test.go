@@ -0,0 +1,112 @@
+package conversions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jcw/flow"
+)
+
+func TestMatchTopic(t *testing.T) {
+
+	cases := []struct {
+		pattern, topic string
+		match          bool
+	}{
+		{"sensor/+/light", "sensor/garage/light", true},
+		{"sensor/+/light", "sensor/garage/temp", false},
+		{"sensor/+/light", "sensor/garage/light/123", false},
+		{"sensor/#", "sensor/garage/light/123", true},
+		{"sensor/#", "sensor", true},
+		{"sensor/garage/light", "sensor/garage/light", true},
+		{"+/+", "sensor", false},
+	}
+
+	for _, c := range cases {
+		if MatchTopic(c.pattern, c.topic) != c.match {
+			t.Errorf("MatchTopic(%q, %q) expected %v", c.pattern, c.topic, c.match)
+		}
+	}
+}
+
+func TestNewRangeMapFromParams(t *testing.T) {
+
+	if _, err := NewRangeMapFromParams(map[string]interface{}{"fromlow": float64(0), "fromhi": float64(255)}); err == nil {
+		t.Error("partial range should not be valid")
+	}
+
+	rm, err := NewRangeMapFromParams(map[string]interface{}{
+		"fromlow": float64(0), "fromhi": float64(255), "tolow": float64(0), "tohi": float64(1), "clamp": "reject"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := rm.Map(300); ok {
+		t.Error("expected clamp mode to be taken from params")
+	}
+}
+
+func ExampleRangeFlowTables() {
+
+	g := new(RangeMapper)
+	p := make(chan flow.Message, 4)
+	in := make(chan flow.Message, 4)
+	g.Param, g.In, g.Out = p, in, new(MockOutput)
+
+	p <- flow.Tag{"table", map[string]interface{}{
+		"match": "sensor/+/light", "fromlow": float64(0), "fromhi": float64(255), "tolow": float64(0), "tohi": float64(1)}}
+	p <- flow.Tag{"table", map[string]interface{}{
+		"match": "sensor/+/temp", "fromlow": float64(0), "fromhi": float64(1000), "tolow": float64(0), "tohi": float64(100), "precision": float64(1)}}
+	p <- flow.Tag{"unmatched", "drop"}
+	close(p)
+
+	go func() { g.Run() }()
+
+	in <- flow.Tag{"sensor/garage/light", float64(200)}
+	in <- flow.Tag{"sensor/garage/temp", float64(217)}
+	in <- flow.Tag{"sensor/garage/moved", float64(1)}
+	in <- flow.Tag{"sensor/loft/light", float64(20)}
+
+	<-time.After(time.Millisecond * 100)
+
+	// Output:
+	// flow.Tag: {sensor/garage/light 1}
+	// flow.Tag: {sensor/garage/temp 21.7}
+	// flow.Tag: {sensor/loft/light 0}
+}
+
+//with a valid linear range as well as a table, unmatched tags are still dropped, while plain values and
+//(with unmatched pass) unmatched tags use the linear range
+func ExampleRangeFlowTablesWithRange() {
+
+	g := new(RangeMapper)
+	p := make(chan flow.Message, 10)
+	in := make(chan flow.Message, 10)
+	g.Param, g.In, g.Out = p, in, new(MockOutput)
+
+	p <- flow.Tag{"fromlow", float64(0)}
+	p <- flow.Tag{"fromhi", float64(100)}
+	p <- flow.Tag{"tolow", float64(0)}
+	p <- flow.Tag{"tohi", float64(10)}
+	p <- flow.Tag{"table", map[string]interface{}{
+		"match": "sensor/+/light", "fromlow": float64(0), "fromhi": float64(255), "tolow": float64(0), "tohi": float64(1)}}
+	p <- flow.Tag{"unmatched", "drop"}
+
+	go func() { g.Run() }()
+
+	in <- flow.Tag{"sensor/garage/light", float64(200)}
+	in <- flow.Tag{"sensor/garage/moved", float64(50)}
+	in <- float64(50)
+	<-time.After(time.Millisecond * 50)
+
+	p <- flow.Tag{"unmatched", "pass"}
+	close(p)
+	<-time.After(time.Millisecond * 50)
+	in <- flow.Tag{"sensor/garage/moved", float64(50)}
+
+	<-time.After(time.Millisecond * 100)
+
+	// Output:
+	// flow.Tag: {sensor/garage/light 1}
+	// float64: 5
+	// flow.Tag: {sensor/garage/moved 5}
+}
@@ -22,6 +22,12 @@ func init() {
 }
 
 //LogArchiverTGZ supports either [tar]ing and/or [gzip]ing files using an input mask to determine output characteristics
+//
+//By default a tar archive is only emitted once a file from the following period is seen. Supplying a grace period
+//(-g) switches to wall-clock rollover, where an archive is emitted once its period has ended and no file has been
+//added to it for the grace period. Supplying one or more directories to scan (-s) finalises any archives left behind
+//by a previous run. In either mode emitted archives are listed in a .logarchiver-emitted file next to them, so a
+//scan does not emit them twice; without -g or -s no such file is written.
 type LogArchiverTGZ struct {
 	flow.Gadget
 	Param  flow.Input
@@ -44,6 +50,10 @@ func (w *LogArchiverTGZ) Run() {
 	rm := false      //remove source after operation
 	verbose := false //emit some data on .Info pin
 
+	rollover := false          //emit archives by wall-clock rather than by seeing the next period
+	grace := time.Duration(0) //how long an ended period stays open for late files
+	scandirs := []string{}    //directories to check for orphaned archives on startup
+
 	mask := "20060102" //The default mask unless overridden - just .gz input files
 	for t := range w.Param {
 		switch m := t.(type) {
@@ -55,6 +65,15 @@ func (w *LogArchiverTGZ) Run() {
 				verbose = m.Msg.(bool)
 			case "-d":
 				rm = m.Msg.(bool)
+			case "-g":
+				if d, err := time.ParseDuration(m.Msg.(string)); err == nil {
+					grace = d
+					rollover = true
+				} else {
+					w.Info.Send(fmt.Sprintf("err:%s", err))
+				}
+			case "-s":
+				scandirs = append(scandirs, m.Msg.(string))
 			}
 		}
 
@@ -74,7 +93,36 @@ func (w *LogArchiverTGZ) Run() {
 
 	sumTo := len(mask)
 
-	for m := range w.In {
+	track := rollover || len(scandirs) > 0 //only a scan needs to know what was emitted
+
+	//finalise any archives a previous run left open whose period has since ended
+	if maskbase != ".gz" {
+		for _, dir := range scandirs {
+			for _, tarFile := range orphanedArchives(dir, mask, grace, time.Now()) {
+				w.emitArchive(tarFile, track)
+			}
+		}
+	}
+
+	queue := newRolloverQueue()
+
+	for {
+		var m flow.Message
+		var ok bool
+
+		select {
+		case m, ok = <-w.In:
+		case now := <-queue.C():
+			for _, tarFile := range queue.Expired(now) {
+				w.emitArchive(tarFile, track)
+			}
+			continue
+		}
+
+		if !ok {
+			break
+		}
+
 		curFile = m.(string)
 
 		base := path.Base(curFile)
@@ -89,7 +137,7 @@ func (w *LogArchiverTGZ) Run() {
 
 		part := base[:sumTo]
 
-		curDate, err := time.Parse(mask, part)
+		curDate, err := time.ParseInLocation(mask, part, time.Local)
 		if err != nil {
 			w.Reject.Send(fmt.Sprintf("ignore:%s err:%s", curFile, err))
 			continue //we ignore it if not matching input mask
@@ -226,12 +274,20 @@ func (w *LogArchiverTGZ) Run() {
 
 				w.Info.Send(info)
 			}
-			if curDate != prevDate {
+			if rollover {
+				//late files push the deadline out, so a backlog is only emitted once it has been fully added
+				end := periodEnd(curDate, sumTo)
+				due := time.Now()
+				if end.After(due) {
+					due = end
+				}
+				queue.Add(tarFile, end, due.Add(grace))
+			} else if curDate != prevDate {
 				prevdir := path.Dir(prevFile)
 
 				prevTarFile := path.Join(prevdir, prevDate.Format(mask)+".tar")
 				if _, err := os.Stat(prevTarFile); err == nil {
-					w.Out.Send(prevTarFile)
+					w.emitArchive(prevTarFile, track)
 				} else {
 					//fmt.Println("missing:", prevTarFile)
 				}
@@ -243,4 +299,24 @@ func (w *LogArchiverTGZ) Run() {
 		prevFile = curFile
 		prevDate = curDate
 	}
+
+	//we are shutting down, so anything whose period has ended will not see any more files
+	for _, tarFile := range queue.Flush(time.Now()) {
+		w.emitArchive(tarFile, track)
+	}
+}
+
+//emitArchive sends a finished archive on .Out, provided it actually exists, and notes it as emitted if tracking
+func (w *LogArchiverTGZ) emitArchive(tarFile string, track bool) {
+	if _, err := os.Stat(tarFile); err != nil {
+		w.Info.Send(fmt.Sprintf("err:%s", err))
+		return
+	}
+	w.Out.Send(tarFile)
+	if !track {
+		return
+	}
+	if err := markEmitted(tarFile); err != nil {
+		w.Info.Send(fmt.Sprintf("err:%s", err))
+	}
 }
@@ -1,7 +1,8 @@
 //The logging package provides a basic hierarchical logging fascility.
 //It is based upon the premise that a log file uses the pattern YYYY<MM><DD>.ext
 //Hierarchical logging is driven by the patterns observed from the previously
-//seen log file.Hence a change in pattern MUST be seen to trigger an event.
+//seen log file.Hence a change in pattern MUST be seen to trigger an event, unless a grace period (-g) is
+//supplied, in which case archives are emitted by wall-clock once their period has ended.
 //A General hierarchy would be:
 // logger->path/20140430.txt->add to path/201404.tar
 // logger->path/20140501.txt->add to path/201405.tar
@@ -11,6 +12,7 @@ package logging
 
 import (
 	"testing"
+	"io/ioutil"
 	"os"
 	"path"
 	"fmt"
@@ -39,8 +41,17 @@ func init() {
 		InitOK = false
 		return
 	}
+	if err:= os.MkdirAll("./log/2016",os.ModeDir | os.ModePerm );err != nil {
+		InitOK = false
+		return
+	}
+	if err:= os.MkdirAll("./log/2017",os.ModeDir | os.ModePerm );err != nil {
+		InitOK = false
+		return
+	}
 
-	files := []string{"20140331.txt","20140401.txt","20140430.txt","20140501.txt", "2014bad0331.txt", "20140731.txt","20140801.txt", "20150101.txt",  }
+	files := []string{"20140331.txt","20140401.txt","20140430.txt","20140501.txt", "2014bad0331.txt", "20140731.txt","20140801.txt", "20150101.txt",
+		"20160130.txt", "20160201.txt", "20170130.txt", "20170201.txt", }
 
 	for _,file := range files {
 		fd,err := os.Create( path.Join("log",file[:4],file))
@@ -75,6 +86,46 @@ func TestInit(t *testing.T) {
 	}
 }
 
+//archives emitted by seeing the next period are not tracked, nothing scans for them
+func TestEmittedUntracked(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "logging")
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"20180130.txt", "20180201.txt"} {
+		ioutil.WriteFile(path.Join(dir, name), []byte("x"), 0644)
+	}
+
+	g := flow.NewCircuit()
+	g.Add("f", "LogArchiverTGZ")
+	g.Feed("f.Param", flow.Tag{"-m", "200601.tar"})
+	g.Feed("f.In", path.Join(dir, "20180130.txt"))
+	g.Feed("f.In", path.Join(dir, "20180201.txt"))
+	g.Run()
+
+	if _, err := os.Stat(path.Join(dir, emittedFile)); !os.IsNotExist(err) {
+		t.Error("emitted list written without -g or -s", err)
+	}
+}
+
+func TestMarkEmittedPrunes(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "logging")
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"201801.tar", "201802.tar", "201803.tar"} {
+		ioutil.WriteFile(path.Join(dir, name), nil, 0644)
+	}
+
+	markEmitted(path.Join(dir, "201801.tar"))
+	markEmitted(path.Join(dir, "201802.tar"))
+	os.Remove(path.Join(dir, "201801.tar"))
+	if err := markEmitted(path.Join(dir, "201803.tar")); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := ioutil.ReadFile(path.Join(dir, emittedFile))
+	if string(data) != "201802.tar\n201803.tar\n" {
+		t.Errorf("expected the removed archive dropped, got %q", data)
+	}
+}
+
 
 //our mask contains a Daily mask, with .gz, so we expect gzip output files for each input.
 func ExampleTGZByDayGZ() {
@@ -220,5 +271,54 @@ func ExampleTGZMonthlyTarGZ() {
 }
 
 
+//with a grace period we no longer rely on seeing the next period, both monthly tarballs are closed by
+//wall-clock, the last one being flushed as the circuit shuts down.
+func ExampleTGZByMonthTarRollover() {
+	g := flow.NewCircuit()
+	g.Add("f", "LogArchiverTGZ")
+	g.Feed("f.Param", flow.Tag{"-m", "200601.tar"}	)
+	g.Feed("f.Param", flow.Tag{"-g", "1h"}	)
+	g.Feed("f.Param", flow.Tag{"-v", true}	)
+	g.Feed("f.In", "log/2016/20160130.txt")
+	g.Feed("f.In", "log/2016/20160201.txt")
+	g.Run()
+	// Output:
+	// Lost string: add:log/2016/20160130.txt to:log/2016/201601.tar
+	// Lost string: add:log/2016/20160201.txt to:log/2016/201602.tar
+	// Lost string: log/2016/201601.tar
+	// Lost string: log/2016/201602.tar
+}
+
+//a previous run left 201702.tar behind (it never saw a March file), a fresh start finds and finalises
+//it, but not 201701.tar which was already gzipped. Another start finds nothing left to do, as the scan
+//notes what it emitted.
+func ExampleTGZByMonthTarOrphaned() {
+	g := flow.NewCircuit()
+	g.Add("f", "LogArchiverTGZ")
+	g.Feed("f.Param", flow.Tag{"-m", "200601.tar"}	)
+	g.Feed("f.In", "log/2017/20170130.txt")
+	g.Feed("f.In", "log/2017/20170201.txt")
+	g.Run()
 
+	g = flow.NewCircuit()
+	g.Add("f", "LogArchiverTGZ")
+	g.Feed("f.Param", flow.Tag{"-m", "200601.gz"}	)
+	g.Feed("f.In", "log/2017/201701.tar")
+	g.Run()
+
+	g = flow.NewCircuit()
+	g.Add("f", "LogArchiverTGZ")
+	g.Feed("f.Param", flow.Tag{"-m", "200601.tar"}	)
+	g.Feed("f.Param", flow.Tag{"-s", "log/2017"}	)
+	g.Run()
 
+	g = flow.NewCircuit()
+	g.Add("f", "LogArchiverTGZ")
+	g.Feed("f.Param", flow.Tag{"-m", "200601.tar"}	)
+	g.Feed("f.Param", flow.Tag{"-s", "log/2017"}	)
+	g.Run()
+	// Output:
+	// Lost string: log/2017/201701.tar
+	// Lost string: log/2017/201701.tar.gz
+	// Lost string: log/2017/201702.tar
+}
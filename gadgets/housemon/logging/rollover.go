@@ -0,0 +1,182 @@
+package logging
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+//emittedFile lists, per directory, the archives that have already been emitted, one name per line
+const emittedFile = ".logarchiver-emitted"
+
+//pendingArchive is an archive waiting to be emitted once its period has ended and its grace period has passed
+type pendingArchive struct {
+	end time.Time //when the period the archive covers ends
+	due time.Time //when the archive should be emitted
+}
+
+//rolloverQueue tracks archives awaiting wall-clock rollover and keeps a single timer armed for the earliest one
+type rolloverQueue struct {
+	pending map[string]pendingArchive
+	timer   *time.Timer
+}
+
+func newRolloverQueue() *rolloverQueue {
+	return &rolloverQueue{pending: make(map[string]pendingArchive)}
+}
+
+//C provides the channel that fires when the next archive falls due, nil (blocks forever) when nothing is pending
+func (q *rolloverQueue) C() <-chan time.Time {
+	if q.timer == nil {
+		return nil
+	}
+	return q.timer.C
+}
+
+//Add (re)schedules an archive, a later Add for the same archive replaces the earlier deadline
+func (q *rolloverQueue) Add(archive string, end, due time.Time) {
+	q.pending[archive] = pendingArchive{end: end, due: due}
+	q.rearm()
+}
+
+//Expired removes and returns archives that are due at now, in due order
+func (q *rolloverQueue) Expired(now time.Time) []string {
+	return q.take(func(p pendingArchive) bool { return !p.due.After(now) })
+}
+
+//Flush removes and returns archives whose period has ended at now, regardless of any remaining grace
+func (q *rolloverQueue) Flush(now time.Time) []string {
+	return q.take(func(p pendingArchive) bool { return !p.end.After(now) })
+}
+
+func (q *rolloverQueue) take(match func(pendingArchive) bool) []string {
+	taken := []string{}
+	for archive, p := range q.pending {
+		if match(p) {
+			taken = append(taken, archive)
+		}
+	}
+
+	sort.Slice(taken, func(i, j int) bool {
+		a, b := q.pending[taken[i]], q.pending[taken[j]]
+		if !a.due.Equal(b.due) {
+			return a.due.Before(b.due)
+		}
+		return taken[i] < taken[j]
+	})
+
+	for _, archive := range taken {
+		delete(q.pending, archive)
+	}
+	q.rearm()
+
+	return taken
+}
+
+//rearm points the timer at the earliest pending deadline
+func (q *rolloverQueue) rearm() {
+	if q.timer != nil {
+		q.timer.Stop()
+		q.timer = nil
+	}
+
+	var next time.Time
+	for _, p := range q.pending {
+		if next.IsZero() || p.due.Before(next) {
+			next = p.due
+		}
+	}
+
+	if !next.IsZero() {
+		q.timer = time.NewTimer(next.Sub(time.Now()))
+	}
+}
+
+//periodEnd provides the instant the period starting at start ends, based upon the length of the mask
+func periodEnd(start time.Time, sumTo int) time.Time {
+	switch sumTo {
+	case sumToYear:
+		return start.AddDate(1, 0, 0)
+	case sumToMonth:
+		return start.AddDate(0, 1, 0)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+//markEmitted notes an archive as emitted, so a later startup scan does not emit it again. Names whose archive has
+//gone since (moved or removed) are dropped, the list only keeps what a scan could still find.
+func markEmitted(tarFile string) error {
+	dir, base := path.Dir(tarFile), path.Base(tarFile)
+	names := []string{base}
+	for name := range emittedArchives(dir) {
+		if _, err := os.Stat(path.Join(dir, name)); err == nil && name != base {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	tmp := path.Join(dir, emittedFile+".tmp")
+	if err := ioutil.WriteFile(tmp, []byte(strings.Join(names, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path.Join(dir, emittedFile))
+}
+
+//emittedArchives gives the names of the archives in dir that have been emitted
+func emittedArchives(dir string) map[string]bool {
+	emitted := map[string]bool{}
+	data, err := ioutil.ReadFile(path.Join(dir, emittedFile))
+	if err != nil {
+		return emitted
+	}
+	for _, name := range strings.Split(string(data), "\n") {
+		if name != "" {
+			emitted[name] = true
+		}
+	}
+	return emitted
+}
+
+//orphanedArchives finds tar archives within dir matching mask whose period and grace have passed but have not
+//been emitted, according to the emitted list, nor taken any further, which we recognise by a .gz sibling.
+func orphanedArchives(dir, mask string, grace time.Duration, now time.Time) []string {
+	found := []string{}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return found
+	}
+	emitted := emittedArchives(dir)
+
+	for _, fi := range entries {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasSuffix(name, ".tar") || len(name) != len(mask)+len(".tar") {
+			continue
+		}
+
+		start, err := time.ParseInLocation(mask, name[:len(mask)], time.Local)
+		if err != nil {
+			continue
+		}
+
+		if periodEnd(start, len(mask)).Add(grace).After(now) || fi.ModTime().Add(grace).After(now) {
+			continue //still open, or still receiving late files
+		}
+
+		if emitted[name] {
+			continue //a previous run emitted it
+		}
+
+		tarFile := path.Join(dir, name)
+		if _, err := os.Stat(tarFile + ".gz"); err == nil {
+			continue //already finalised
+		}
+
+		found = append(found, tarFile)
+	}
+
+	return found
+}
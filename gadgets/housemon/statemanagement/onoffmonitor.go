@@ -51,10 +51,14 @@
 // The Value of each emitted message will be the 'reference' time of the event in UnixTime(Millisecond) format or
 // standard go 'Duration' syntax for -For messages.
 //
+// To survive a restart, wire .State to the In of a StateStore and its Out to .Restore, the last known state of each
+// watched <location> (and which -For events are still to come) is then saved and handed back on startup.
+//
 // See the example circuits for usage
 package statemanagement
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/TheDistractor/flow-ext/go-helpers/int64utils"
@@ -87,6 +91,8 @@ type OnOffMonitor struct {
 	In  flow.Input  //Inboud Flow circuit messages
 	Out flow.Output //Outbound Flow circuit messages
 
+	Restore flow.Input  //saved state from a StateStore, read once before any .In messages
+	State   flow.Output //state snapshots for a StateStore, only sent if .Restore is wired
 }
 
 type OnOffMonitorInst struct {
@@ -246,6 +252,24 @@ func (w *OnOffMonitor) Run() {
 	timerFor := time.NewTimer(2)
 	timerFor.Stop() //we limp to stop as we only want to start when we have a 'For' to shoot at.
 
+	//pick up where we left off, before any new readings arrive
+	persist := false
+	if saved, ok := (<-w.Restore).(flow.Tag); ok {
+		persist = true
+		if saved.Msg != nil {
+			if err := wi.Restore(saved.Msg); err != nil {
+				glog.Errorln("OnOffMonitor: could not restore state:", err)
+			} else if next, err := wi.RecalcNextFor(); err == nil {
+				timerFor.Reset(next.Sub(time.Now()))
+			}
+		}
+	}
+	saveState := func() {
+		if persist {
+			w.State.Send(wi.Snapshot())
+		}
+	}
+
 
 	for {
 
@@ -274,6 +298,7 @@ func (w *OnOffMonitor) Run() {
 			if err == nil {
 				timerFor.Reset(next.Sub(time.Now()))
 			}
+			saveState()
 
 		case t := <-timerSince.C:
 
@@ -383,6 +408,7 @@ func (w *OnOffMonitor) Run() {
 								glog.Info(  fmt.Sprintf("Timers Reset by %s, next event:%s", location, then))
 							}
 						}
+						saveState()
 
 					}
 
@@ -395,6 +421,43 @@ func (w *OnOffMonitor) Run() {
 }
 
 
+//OnOffSnapshot is what is kept of a watched location across a restart
+type OnOffSnapshot struct {
+	Current   float64
+	On        int64
+	Off       int64
+	Remaining []int64 //-For events still to come
+}
+
+//Snapshot gives the state of every watched location, for a StateStore
+func (w *OnOffMonitorInst) Snapshot() map[string]OnOffSnapshot {
+	snap := map[string]OnOffSnapshot{}
+	for name, s := range w.Watched {
+		snap[name] = OnOffSnapshot{s.Current, s.On, s.Off, append([]int64{}, s.Remaining...)}
+	}
+	return snap
+}
+
+//Restore takes back a Snapshot, as handed back by a StateStore (i.e. decoded from JSON).
+//Only locations that are still being watched are restored.
+func (w *OnOffMonitorInst) Restore(saved interface{}) error {
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	snap := map[string]OnOffSnapshot{}
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return err
+	}
+
+	for name, v := range snap {
+		if s, ok := w.Watched[name]; ok {
+			s.Current, s.On, s.Off, s.Remaining = v.Current, v.On, v.Off, v.Remaining
+		}
+	}
+	return nil
+}
+
 //find the closest remaining timeslot
 func (s *OnOffMonitorInst) RecalcNextFor() (time.Time, error) {
 	min := int64(math.MaxInt64)
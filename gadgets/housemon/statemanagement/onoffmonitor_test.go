@@ -0,0 +1,41 @@
+package statemanagement
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	wi := NewOnOffMonitorInst()
+	s := wi.NewState(wi.birth, "Garage")
+	s.AddThreshold("5m")
+	s.Current, s.On = s.stateOn, wi.birth+1000
+	s.ResetRemaining()
+	wi.NewState(wi.birth, "Hall")
+
+	//as a StateStore would hand it back
+	data, _ := json.Marshal(wi.Snapshot())
+	var saved interface{}
+	json.Unmarshal(data, &saved)
+
+	restarted := NewOnOffMonitorInst()
+	restarted.NewState(restarted.birth, "Garage").AddThreshold("5m")
+	if err := restarted.Restore(saved); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := restarted.Watched["Hall"]; ok {
+		t.Error("Hall is no longer watched and should not come back")
+	}
+
+	g := restarted.Watched["Garage"]
+	if g.Current != g.stateOn || g.On != wi.birth+1000 || g.Off != wi.birth {
+		t.Errorf("unexpected state %+v", g)
+	}
+	if next, err := restarted.RecalcNextFor(); err != nil || UnixMs(next) != wi.birth+1000+5*60*1000 {
+		t.Error("the 5m -For event should still be due", next, err)
+	}
+
+	if err := restarted.Restore("not a snapshot"); err == nil {
+		t.Error("expected an error")
+	}
+}
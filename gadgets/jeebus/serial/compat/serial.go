@@ -14,6 +14,7 @@ import (
 //Automatically override the standard SerialPort from core with Extended version from this package
 func init() {
 	flow.Registry["SerialPort"] = func() flow.Circuitry { return new(serialex.SerialPort) }
+	flow.Registry["SerialPorts"] = func() flow.Circuitry { return new(serialex.SerialPorts) }
 }
 
 
@@ -0,0 +1,181 @@
+package serial
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang/glog"
+	"github.com/jcw/flow"
+)
+
+//Capture directions, what the device sent us, what we sent the device and port events
+const (
+	CaptureRead  = "<"
+	CaptureWrite = ">"
+	CaptureEvent = "*"
+)
+
+//CaptureRecord is one line of a capture transcript
+type CaptureRecord struct {
+	Time time.Time
+	Port string
+	Dir  string
+	Data []byte
+}
+
+//FormatCapture renders a record as a line with its direction, a clock to the microsecond, the port and the data Go
+//quoted so every byte survives. Reads are recorded as they come off the wire, line ends and all; one that is nothing
+//but plain text is written as a housemon logger line instead ("L <clock> <port> <text>"):
+//
+//	< 01:02:03.537412 /dev/ttyUSB0 "OK 9 25 54 66\r\n"
+//	L 01:02:03.537415 /dev/ttyUSB0 OK 9
+//	> 01:02:03.538006 /dev/ttyUSB0 "v\n"
+//	* 01:02:03.540122 /dev/ttyUSB0 "disconnected"
+func FormatCapture(r CaptureRecord) string {
+	clock := r.Time.Format(captureClock)
+	if r.Dir == CaptureRead && isText(r.Data) {
+		return fmt.Sprintf("L %s %s %s", clock, r.Port, r.Data)
+	}
+	return fmt.Sprintf("%s %s %s %s", r.Dir, clock, r.Port, strconv.Quote(string(r.Data)))
+}
+
+const captureClock = "15:04:05.000000"
+
+//isText tells whether data can go in a logger line as it is
+func isText(data []byte) bool {
+	if !utf8.Valid(data) {
+		return false
+	}
+	for _, r := range string(data) {
+		if !strconv.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
+//ParseCapture reads back a transcript line (or any housemon logger line), the date comes from day (transcripts are one
+//file per day)
+func ParseCapture(day time.Time, line string) (CaptureRecord, error) {
+	r := CaptureRecord{}
+
+	fields := strings.SplitN(line, " ", 4)
+	if len(fields) < 3 {
+		return r, errors.New("not a capture line")
+	}
+	switch fields[0] {
+	case "L", CaptureRead, CaptureWrite, CaptureEvent:
+	default:
+		return r, errors.New("not a capture line")
+	}
+
+	clock, err := time.Parse("15:04:05", fields[1]) //takes any fraction, the logger's own lines have milliseconds
+	if err != nil {
+		return r, err
+	}
+	y, m, d := day.Date()
+	r.Time = time.Date(y, m, d, clock.Hour(), clock.Minute(), clock.Second(), clock.Nanosecond(), day.Location())
+	r.Port = fields[2]
+
+	rest := ""
+	if len(fields) == 4 {
+		rest = fields[3]
+	}
+	if fields[0] == "L" {
+		r.Dir, r.Data = CaptureRead, []byte(rest)
+		return r, nil
+	}
+	data, err := strconv.Unquote(rest)
+	if err != nil {
+		return r, err
+	}
+	r.Dir, r.Data = fields[0], []byte(data)
+	return r, nil
+}
+
+//capture writes the transcript to a file per day (named like the housemon logger's, so LogArchiverTGZ can roll them up)
+//and/or sends each line on .Trace
+type capture struct {
+	sync.Mutex
+	dir   string      //no file when empty
+	trace flow.Output //nil unless tracing
+	port  string
+
+	day  string
+	file *os.File
+}
+
+func (c *capture) record(dir string, data []byte) {
+	line := FormatCapture(CaptureRecord{time.Now(), c.port, dir, data})
+
+	if c.dir != "" {
+		c.write(line)
+	}
+	if c.trace != nil {
+		c.trace.Send(line)
+	}
+}
+
+func (c *capture) write(line string) {
+	c.Lock()
+	defer c.Unlock()
+
+	day := time.Now().Format("20060102")
+	if day != c.day || c.file == nil {
+		if c.file != nil {
+			c.file.Close()
+			c.file = nil
+		}
+		c.day = day
+
+		name := filepath.Join(c.dir, day+".txt")
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			glog.Errorln("SerialPortEx capture:", err)
+			return
+		}
+		c.file = f
+	}
+
+	if _, err := c.file.WriteString(line + "\n"); err != nil {
+		glog.Errorln("SerialPortEx capture:", err)
+	}
+}
+
+func (c *capture) close() {
+	c.Lock()
+	defer c.Unlock()
+	if c.file != nil {
+		c.file.Close()
+		c.file = nil
+	}
+}
+
+//capturedTransport records everything read and written through a Transport, as it went over the wire
+type capturedTransport struct {
+	Transport
+	c *capture
+}
+
+func (t *capturedTransport) Read(p []byte) (int, error) {
+	n, err := t.Transport.Read(p)
+	if n > 0 {
+		t.c.record(CaptureRead, p[:n])
+	}
+	return n, err
+}
+
+func (t *capturedTransport) Write(p []byte) (int, error) {
+	n, err := t.Transport.Write(p)
+	if n > 0 {
+		t.c.record(CaptureWrite, p[:n])
+	}
+	return n, err
+}
@@ -0,0 +1,198 @@
+package serial
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/jcw/flow"
+)
+
+//DefaultCommandTimeout is how long a command waits for its reply when no timeout is given
+const DefaultCommandTimeout = time.Second
+
+//Command is a request sent on .Command, such as:
+//
+//	{ id: "cfg", send: "v", expect: "^\\[RF12demo\\.(\\d+)\\]", timeout: 2000 }
+//
+//without an expect pattern the command is just sent, and is answered once written.
+type Command struct {
+	Id      interface{} //passed back on .Reply, for the caller to match up
+	Send    interface{} //anything .To accepts
+	Expect  *regexp.Regexp
+	Timeout time.Duration
+}
+
+//ParseCommand creates a Command from a .Command hash
+func ParseCommand(m flow.Message) (*Command, error) {
+	hash, ok := m.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("command must be a hash, got:%v", m)
+	}
+
+	cmd := &Command{Timeout: DefaultCommandTimeout}
+	for k, v := range hash {
+		switch k {
+		case "id":
+			cmd.Id = v
+		case "send":
+			switch v.(type) {
+			case string, []byte, float64, int, bool:
+			default:
+				return nil, fmt.Errorf("send must be text, bytes, a DTR pulse in ms or an RTS bool, got:%v", v)
+			}
+			cmd.Send = v
+		case "expect":
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("expect must be a string, got:%v", v)
+			}
+			re, err := regexp.Compile(s)
+			if err != nil {
+				return nil, err
+			}
+			cmd.Expect = re
+		case "timeout":
+			ms, ok := v.(float64)
+			if !ok || ms <= 0 {
+				return nil, fmt.Errorf("timeout must be a positive number of ms, got:%v", v)
+			}
+			cmd.Timeout = time.Millisecond * time.Duration(ms)
+		default:
+			return nil, fmt.Errorf("unknown command key:%s", k)
+		}
+	}
+
+	if cmd.Send == nil {
+		return nil, errors.New("command has nothing to send")
+	}
+	return cmd, nil
+}
+
+//result is what is sent on .Reply, as a flow.Tag of "reply", "timeout" or "error"
+func (c *Command) result(extra map[string]interface{}) map[string]interface{} {
+	r := map[string]interface{}{"send": c.Send}
+	if c.Id != nil {
+		r["id"] = c.Id
+	}
+	for k, v := range extra {
+		r[k] = v
+	}
+	return r
+}
+
+//commander runs one Command at a time, taking the first line that matches the pending command away from .From
+type commander struct {
+	sync.Mutex
+	pending *Command
+	reply   chan []string //submatches of the reply line
+}
+
+//offer passes a line read from the device to the pending command, reporting whether it was taken
+func (c *commander) offer(msg flow.Message) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.pending == nil {
+		return false
+	}
+
+	var text string
+	switch v := msg.(type) {
+	case string:
+		text = v
+	case []byte:
+		text = string(v)
+	default:
+		return false
+	}
+
+	match := c.pending.Expect.FindStringSubmatch(text)
+	if match == nil {
+		return false
+	}
+
+	c.pending = nil
+	c.reply <- match
+	return true
+}
+
+func (c *commander) wait(cmd *Command) {
+	c.Lock()
+	defer c.Unlock()
+	c.pending = cmd
+	c.reply = make(chan []string, 1)
+}
+
+func (c *commander) cancel() {
+	c.Lock()
+	defer c.Unlock()
+	c.pending = nil
+}
+
+//run serialises commands onto whichever device is current and answers each on reply, until commands is closed or
+//quit is (a command still waiting for its reply then gets none)
+func (c *commander) run(commands flow.Input, quit <-chan struct{}, conn *connection, queue *writeQueue, reply flow.Output) {
+	for {
+		select {
+		case <-quit:
+			return
+		default:
+		}
+		var m flow.Message
+		select {
+		case msg, ok := <-commands:
+			if !ok {
+				return
+			}
+			m = msg
+		case <-quit:
+			return
+		}
+
+		cmd, err := ParseCommand(m)
+		if err != nil {
+			reply.Send(flow.Tag{"error", map[string]interface{}{"error": err.Error(), "command": m}})
+			continue
+		}
+
+		dev := conn.await()
+		if dev == nil {
+			reply.Send(flow.Tag{"error", cmd.result(map[string]interface{}{"error": "not connected"})})
+			continue
+		}
+
+		if cmd.Expect != nil {
+			c.wait(cmd) //before sending, the reply may be quick
+		}
+
+		if err := queue.send(LaneNormal, dev, cmd.Send); err != nil {
+			c.cancel()
+			reply.Send(flow.Tag{"error", cmd.result(map[string]interface{}{"error": err.Error()})})
+			continue
+		}
+
+		if cmd.Expect == nil {
+			reply.Send(flow.Tag{"reply", cmd.result(nil)})
+			continue
+		}
+
+		select {
+		case match := <-c.reply:
+			reply.Send(flow.Tag{"reply", cmd.result(map[string]interface{}{"line": match[0], "match": match[1:]})})
+		case <-quit:
+			c.cancel()
+			return
+		case <-time.After(cmd.Timeout):
+			c.cancel()
+			select {
+			case match := <-c.reply: //arrived just as we gave up
+				reply.Send(flow.Tag{"reply", cmd.result(map[string]interface{}{"line": match[0], "match": match[1:]})})
+			default:
+				reply.Send(flow.Tag{"timeout", cmd.result(nil)})
+			}
+		}
+	}
+}
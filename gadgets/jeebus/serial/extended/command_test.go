@@ -0,0 +1,44 @@
+package serial
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCommand(t *testing.T) {
+	cmd, err := ParseCommand(map[string]interface{}{"send": "v", "expect": "^OK"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd.Timeout != DefaultCommandTimeout || !cmd.Expect.MatchString("OK 5") {
+		t.Error("unexpected command", cmd)
+	}
+
+	cmd, err = ParseCommand(map[string]interface{}{"send": 100.0, "timeout": 250.0})
+	if err != nil || cmd.Timeout != 250*time.Millisecond || cmd.Expect != nil {
+		t.Error("unexpected command", cmd, err)
+	}
+
+	//a number from JSON is a DTR pulse
+	r := &recorder{}
+	if _, err := writeHandler(r, cmd.Send); err != nil || len(r.calls) != 2 || r.calls[0] != "dtr on" || r.calls[1] != "dtr off" {
+		t.Error("expected a DTR pulse, got", r.calls, err)
+	}
+	if _, err := writeHandler(r, map[string]interface{}{}); err == nil {
+		t.Error("expected an error for a type that can't be sent")
+	}
+
+	for _, bad := range []interface{}{
+		"v",
+		map[string]interface{}{"expect": "^OK"},
+		map[string]interface{}{"send": "v", "expect": "(("},
+		map[string]interface{}{"send": "v", "timeout": -1.0},
+		map[string]interface{}{"send": "v", "retries": 3.0},
+		map[string]interface{}{"send": map[string]interface{}{"cmd": "v"}},
+		map[string]interface{}{"send": []interface{}{"v"}},
+	} {
+		if _, err := ParseCommand(bad); err == nil {
+			t.Error("expected an error for", bad)
+		}
+	}
+}
@@ -0,0 +1,6 @@
+// +build !linux,!darwin
+
+package serial
+
+//plain device paths are opened via goserialproxy where rs232 is not available
+const defaultTransport = SchemeProxy
@@ -0,0 +1,6 @@
+// +build linux darwin
+
+package serial
+
+//plain device paths are opened with rs232
+const defaultTransport = SchemeRS232
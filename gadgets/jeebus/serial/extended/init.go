@@ -0,0 +1,251 @@
+package serial
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/jcw/flow"
+)
+
+//DefaultExpectTimeout is how long an init expect waits when no timeout is given
+const DefaultExpectTimeout = 5 * time.Second
+
+//how deeply init includes may nest, a file including itself would otherwise never end
+const maxIncludeDepth = 8
+
+//initStep is one entry of an init script, which is made up of:
+//
+//	"8b"                                          sent as a line (or []byte as is, or an int to pulse DTR)
+//	{ delay: 20 }                                 wait 20ms
+//	{ expect: "^\\[RF12demo", timeout: 5000 }     wait for a matching line from the device
+//	{ if: "RF12demo\\.1[2-9]", then: [...], else: [...] }   branch on the line the last expect matched
+//	{ include: "rf12init.json" }                  a JSON file holding a list of entries
+//	[ ... ]                                       a list of entries
+type initStep struct {
+	send    interface{}
+	delay   time.Duration
+	expect  *regexp.Regexp
+	timeout time.Duration
+	cond    *regexp.Regexp
+	then    []initStep
+	els     []initStep
+}
+
+//parseInit checks an init entry (see initStep) and loads any includes
+func parseInit(entry interface{}) ([]initStep, error) {
+	return parseInitDepth(entry, 0)
+}
+
+func parseInitDepth(entry interface{}, depth int) ([]initStep, error) {
+
+	switch v := entry.(type) {
+	case []interface{}:
+		steps := []initStep{}
+		for _, e := range v {
+			s, err := parseInitDepth(e, depth)
+			if err != nil {
+				return nil, err
+			}
+			steps = append(steps, s...)
+		}
+		return steps, nil
+
+	case map[string]interface{}:
+		return parseInitHash(v, depth)
+	}
+
+	return []initStep{{send: entry}}, nil
+}
+
+func parseInitHash(hash map[string]interface{}, depth int) ([]initStep, error) {
+
+	if file, ok := hash["include"]; ok {
+		if len(hash) != 1 {
+			return nil, fmt.Errorf("init include takes nothing else:%v", hash)
+		}
+		name, ok := file.(string)
+		if !ok {
+			return nil, fmt.Errorf("init include must be a file name:%v", file)
+		}
+		return loadInit(name, depth+1)
+	}
+
+	step := initStep{}
+	for k, v := range hash {
+		switch k {
+		case "delay", "timeout":
+			ms, ok := v.(float64)
+			if !ok || ms < 0 {
+				return nil, fmt.Errorf("init %s must be a number of ms, got:%v", k, v)
+			}
+			d := time.Millisecond * time.Duration(ms)
+			if k == "delay" {
+				step.delay = d
+			} else {
+				step.timeout = d
+			}
+		case "expect", "if":
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("init %s must be a regexp, got:%v", k, v)
+			}
+			re, err := regexp.Compile(s)
+			if err != nil {
+				return nil, err
+			}
+			if k == "expect" {
+				step.expect = re
+			} else {
+				step.cond = re
+			}
+		case "then", "else":
+			steps, err := parseInitDepth(v, depth)
+			if err != nil {
+				return nil, err
+			}
+			if k == "then" {
+				step.then = steps
+			} else {
+				step.els = steps
+			}
+		default:
+			return nil, fmt.Errorf("unknown init key:%s", k)
+		}
+	}
+
+	if step.cond == nil && (step.then != nil || step.els != nil) {
+		return nil, fmt.Errorf("init then/else without if:%v", hash)
+	}
+	if step.expect != nil && step.timeout == 0 {
+		step.timeout = DefaultExpectTimeout
+	}
+	return []initStep{step}, nil
+}
+
+//loadInit reads an init script from a JSON file
+func loadInit(name string, depth int) ([]initStep, error) {
+	if depth > maxIncludeDepth {
+		return nil, fmt.Errorf("init includes nested too deeply at:%s", name)
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var entries interface{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return parseInitDepth(entries, depth)
+}
+
+//lineWatch lets a running init script see what the device says, without taking it away from .From
+type lineWatch struct {
+	sync.Mutex
+	lines  chan string
+	closed chan struct{} //the device has gone, see gone
+}
+
+//errGone ends an init script whose device has gone, there is nothing to report
+var errGone = errors.New("device gone")
+
+//lines arriving while nobody is expecting are kept (up to a point), a banner may come during a delay
+const watchBuffer = 100
+
+func newLineWatch() *lineWatch {
+	return &lineWatch{lines: make(chan string, watchBuffer), closed: make(chan struct{})}
+}
+
+//gone tells a running init script its device has gone, it stops at the next expect or delay
+func (w *lineWatch) gone() {
+	close(w.closed)
+}
+
+func (w *lineWatch) see(msg flow.Message) {
+	w.Lock()
+	defer w.Unlock()
+	if w.lines == nil {
+		return
+	}
+
+	var text string
+	switch v := msg.(type) {
+	case string:
+		text = v
+	case []byte:
+		text = string(v)
+	default:
+		return
+	}
+
+	select {
+	case w.lines <- text:
+	default: //nobody is looking, drop the oldest
+		select {
+		case <-w.lines:
+		default:
+		}
+		select {
+		case w.lines <- text:
+		default:
+		}
+	}
+}
+
+//stop is called once init is over, lines are no longer kept
+func (w *lineWatch) stop() {
+	w.Lock()
+	defer w.Unlock()
+	w.lines = nil
+}
+
+//runInit plays an init script, the last line matched by an expect is what an if tests
+func runInit(write func(interface{}) error, steps []initStep, watch *lineWatch, last *string) error {
+	for _, s := range steps {
+		switch {
+		case s.cond != nil:
+			branch := s.els
+			if s.cond.MatchString(*last) {
+				branch = s.then
+			}
+			if err := runInit(write, branch, watch, last); err != nil {
+				return err
+			}
+
+		case s.expect != nil:
+			timeout := time.After(s.timeout)
+		wait:
+			for {
+				select {
+				case line := <-watch.lines:
+					if s.expect.MatchString(line) {
+						*last = line
+						break wait
+					}
+				case <-timeout:
+					return fmt.Errorf("init: timed out waiting for %s", s.expect)
+				case <-watch.closed:
+					return errGone
+				}
+			}
+
+		case s.send != nil:
+			if err := write(s.send); err != nil {
+				return err
+			}
+		}
+
+		if s.delay > 0 {
+			select {
+			case <-time.After(s.delay):
+			case <-watch.closed:
+				return errGone
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package serial
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseInit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "init")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rf12 := filepath.Join(dir, "rf12.json")
+	ioutil.WriteFile(rf12, []byte(`[
+		{ "expect": "^\\[RF12demo\\.(\\d+)\\]", "timeout": 3000 },
+		{ "if": "RF12demo\\.1[2-9]", "then": ["8b", "5i", "212g"], "else": [["8b"], { "delay": 20 }] }
+	]`), 0644)
+
+	steps, err := parseInit([]interface{}{"v", map[string]interface{}{"include": rf12}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 3 || steps[0].send != "v" || steps[1].expect == nil || steps[2].cond == nil {
+		t.Fatal("unexpected steps", steps)
+	}
+	if len(steps[2].then) != 3 || len(steps[2].els) != 2 {
+		t.Error("unexpected branches", steps[2])
+	}
+
+	steps, _ = parseInit(map[string]interface{}{"expect": "^OK"})
+	if steps[0].timeout != DefaultExpectTimeout {
+		t.Error("expected the default timeout")
+	}
+
+	loop := filepath.Join(dir, "loop.json")
+	ioutil.WriteFile(loop, []byte(`[{ "include": "`+loop+`" }]`), 0644)
+
+	for _, bad := range []interface{}{
+		map[string]interface{}{"expect": "(("},
+		map[string]interface{}{"delay": "soon"},
+		map[string]interface{}{"then": []interface{}{"8b"}},
+		map[string]interface{}{"wait": 20.0},
+		map[string]interface{}{"include": filepath.Join(dir, "missing.json")},
+		map[string]interface{}{"include": loop},
+	} {
+		if _, err := parseInit(bad); err == nil {
+			t.Error("expected an error for", bad)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package serial
+
+import (
+	"bufio"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jcw/flow"
+)
+
+//PortInfo describes a serial port found on this machine
+type PortInfo struct {
+	Path         string //such as /dev/ttyUSB0
+	Vendor       string //USB vendor id in hex, such as 0403 (empty if not a USB device)
+	Product      string //USB product id in hex, such as 6001
+	Serial       string //USB serial number, such as A900abcd
+	Manufacturer string
+	Description  string
+}
+
+//Selector is a stable way to refer to a USB port, e.g. usb:0403:6001:A900abcd, which survives a reboot
+//when /dev/ttyUSBn may not.
+func (p PortInfo) Selector() string {
+	if p.Vendor == "" {
+		return ""
+	}
+	sel := "usb:" + p.Vendor + ":" + p.Product
+	if p.Serial != "" {
+		sel += ":" + p.Serial
+	}
+	return sel
+}
+
+//MatchUSB checks a port against a usb:vendor[:product[:serial]] selector, ids are not case sensitive
+func (p PortInfo) MatchUSB(selector string) bool {
+	parts := strings.Split(selector, ":")
+	if len(parts) < 2 || len(parts) > 4 || parts[0] != "usb" || p.Vendor == "" {
+		return false
+	}
+	want := []string{p.Vendor, p.Product, p.Serial}
+	for i, v := range parts[1:] {
+		if i < 2 && !strings.EqualFold(v, want[i]) || i == 2 && v != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+//RF12demoBanner matches the banner an RF12demo sketch prints on reset
+const RF12demoBanner = `^\[RF12demo\.\d+\]`
+
+//Prober looks for a device on a port by opening it and waiting for a line matching Banner
+type Prober struct {
+	Options Options
+	Send    string //sent once the port is open (if not empty), to prompt a reply
+	Banner  *regexp.Regexp
+	Timeout time.Duration
+}
+
+//NewProber creates a Prober for a banner regexp, using SerialPort's default line settings
+func NewProber(banner string) (*Prober, error) {
+	re, err := regexp.Compile(banner)
+	if err != nil {
+		return nil, err
+	}
+	return &Prober{
+		Options: Options{BitRate: 57600, DataBits: 8, StopBits: 1},
+		Banner:  re,
+		Timeout: 3 * time.Second, //a JeeLink resets when opened, and takes a moment to say hello
+	}, nil
+}
+
+//Probe reports whether the device on port prints the banner within the timeout
+func (p *Prober) Probe(port string) bool {
+	transport, address, err := lookupTransport(port, defaultTransport)
+	if err != nil {
+		return false
+	}
+	dev, err := transport.open(address, p.Options)
+	if err != nil {
+		return false
+	}
+	defer dev.Close() //also unblocks the reader on timeout
+
+	found := make(chan bool, 1)
+	go func() {
+		if p.Send != "" {
+			writeHandler(dev, p.Send)
+		}
+		scanner := bufio.NewScanner(dev)
+		for scanner.Scan() {
+			if p.Banner.MatchString(scanner.Text()) {
+				found <- true
+				return
+			}
+		}
+		found <- false
+	}()
+
+	select {
+	case ok := <-found:
+		return ok
+	case <-time.After(p.Timeout):
+		return false
+	}
+}
+
+//Resolve finds the port for a selector:
+//
+//	usb:0403:6001:A900abcd   by USB vendor, product and (optionally) serial number
+//	rf12demo                 the first port that prints an RF12demo banner
+//	probe:<regexp>           the first port that prints a line matching the regexp
+//	/dev/ttyUSB0             anything else is passed on as it is
+//
+//probing only tries USB ports when there are any, to avoid poking at built in serial lines.
+func Resolve(selector string, prober *Prober) (string, error) {
+	if !isSelector(selector) {
+		return selector, nil
+	}
+	ports, err := ListPorts()
+	if err != nil {
+		return "", err
+	}
+	return resolveIn(selector, ports, prober)
+}
+
+func isSelector(s string) bool {
+	return strings.HasPrefix(s, "usb:") || s == "rf12demo" || strings.HasPrefix(s, "probe:")
+}
+
+func resolveIn(selector string, ports []PortInfo, prober *Prober) (string, error) {
+
+	switch {
+	case strings.HasPrefix(selector, "usb:"):
+		for _, p := range ports {
+			if p.MatchUSB(selector) {
+				return p.Path, nil
+			}
+		}
+		return "", fmt.Errorf("no port matches %s", selector)
+
+	case selector == "rf12demo", strings.HasPrefix(selector, "probe:"):
+		banner := RF12demoBanner
+		if selector != "rf12demo" {
+			banner = strings.TrimPrefix(selector, "probe:")
+		}
+		re, err := regexp.Compile(banner)
+		if err != nil {
+			return "", err
+		}
+		pr := *prober
+		pr.Banner = re
+
+		candidates := []PortInfo{}
+		for _, p := range ports {
+			if p.Vendor != "" {
+				candidates = append(candidates, p)
+			}
+		}
+		if len(candidates) == 0 {
+			candidates = ports
+		}
+
+		for _, p := range candidates {
+			if pr.Probe(p.Path) {
+				return p.Path, nil
+			}
+		}
+		return "", fmt.Errorf("no port answers %s", selector)
+	}
+
+	return selector, nil
+}
+
+//SerialPorts lists the serial ports on this machine and resolves port selectors to a device path for SerialPort.Port.
+//Send a selector such as usb:0403:6001:A900abcd or rf12demo to .In and the path comes out on .Out,
+//send "list" and each port is described on .Ports.
+//Registers as "SerialPorts".
+type SerialPorts struct {
+	flow.Gadget
+	Param flow.Input
+	In    flow.Input
+	Out   flow.Output
+	Ports flow.Output //one hash per port, in reply to "list"
+	Error flow.Output //selectors that could not be resolved
+}
+
+//Start resolving selectors.
+func (g *SerialPorts) Run() {
+
+	prober, _ := NewProber(RF12demoBanner)
+
+	for param := range g.Param {
+		p := param.(flow.Tag)
+		switch p.Tag {
+		case "baud":
+			prober.Options.BitRate = uint32(p.Msg.(float64))
+		case "probesend":
+			prober.Send = p.Msg.(string)
+		case "probetimeout":
+			prober.Timeout = time.Millisecond * time.Duration(p.Msg.(float64))
+		}
+	}
+
+	for m := range g.In {
+		selector, ok := m.(string)
+		if !ok {
+			g.Error.Send(fmt.Sprintf("serialports: selector must be a string, got:%v", m))
+			continue
+		}
+
+		if selector == "list" {
+			ports, err := ListPorts()
+			if err != nil {
+				g.Error.Send("serialports: " + err.Error())
+				continue
+			}
+			for _, p := range ports {
+				g.Ports.Send(map[string]interface{}{
+					"path": p.Path, "selector": p.Selector(), "vendor": p.Vendor, "product": p.Product,
+					"serial": p.Serial, "manufacturer": p.Manufacturer, "description": p.Description,
+				})
+			}
+			continue
+		}
+
+		path, err := Resolve(selector, prober)
+		if err != nil {
+			g.Error.Send("serialports: " + err.Error())
+			continue
+		}
+		g.Out.Send(path)
+	}
+}
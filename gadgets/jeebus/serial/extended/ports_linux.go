@@ -0,0 +1,79 @@
+// +build linux
+
+package serial
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//where ListPorts looks, changed by tests
+var (
+	sysfsRoot = "/sys"
+	devRoot   = "/dev"
+)
+
+//ListPorts finds the serial ports on this machine from sysfs, USB ports have their ids filled in.
+//Built in 8250 style ports are only listed when they have a real UART behind them.
+func ListPorts() ([]PortInfo, error) {
+	ttys, err := ioutil.ReadDir(filepath.Join(sysfsRoot, "class", "tty"))
+	if err != nil {
+		return nil, err
+	}
+
+	ports := []PortInfo{}
+	for _, tty := range ttys {
+		name := tty.Name()
+		base := filepath.Join(sysfsRoot, "class", "tty", name)
+
+		device, err := filepath.EvalSymlinks(filepath.Join(base, "device"))
+		if err != nil {
+			continue //virtual, such as consoles and ptys
+		}
+
+		p := PortInfo{Path: filepath.Join(devRoot, name)}
+		if usb := usbDevice(device); usb != "" {
+			p.Vendor = readAttr(usb, "idVendor")
+			p.Product = readAttr(usb, "idProduct")
+			p.Serial = readAttr(usb, "serial")
+			p.Manufacturer = readAttr(usb, "manufacturer")
+			p.Description = readAttr(usb, "product")
+		} else if driver, _ := os.Readlink(filepath.Join(device, "driver")); filepath.Base(driver) == "serial8250" {
+			if t := readAttr(base, "type"); t == "" || t == "0" {
+				continue //placeholder for a UART that is not there
+			}
+		}
+
+		ports = append(ports, p)
+	}
+
+	sort.Sort(byPath(ports))
+	return ports, nil
+}
+
+//usbDevice walks up from a tty's device to the USB device that holds the ids
+func usbDevice(dir string) string {
+	for d := dir; d != "/" && d != "." && strings.HasPrefix(d, sysfsRoot); d = filepath.Dir(d) {
+		if _, err := os.Stat(filepath.Join(d, "idVendor")); err == nil {
+			return d
+		}
+	}
+	return ""
+}
+
+func readAttr(dir, name string) string {
+	b, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+type byPath []PortInfo
+
+func (p byPath) Len() int           { return len(p) }
+func (p byPath) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byPath) Less(i, j int) bool { return p[i].Path < p[j].Path }
@@ -0,0 +1,130 @@
+// +build linux
+
+package serial
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TheDistractor/flow-ext/go-helpers/ptytest"
+)
+
+//fakeSysfs builds just enough of /sys for two JeeLinks (FTDI and CDC-ACM), a built in UART and a console
+func fakeSysfs(t *testing.T) string {
+	root, err := ioutil.TempDir("", "sysfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mk := func(dir string, attrs map[string]string) {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range attrs {
+			ioutil.WriteFile(filepath.Join(root, dir, k), []byte(v+"\n"), 0644)
+		}
+	}
+	link := func(target, name string) {
+		os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0755)
+		if err := os.Symlink(filepath.Join(root, target), filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mk("devices/pci0000:00/usb1/1-1", map[string]string{"idVendor": "0403", "idProduct": "6001", "serial": "A900abcd", "manufacturer": "FTDI", "product": "FT232R USB UART"})
+	mk("devices/pci0000:00/usb1/1-1/1-1:1.0/ttyUSB0", nil)
+	link("devices/pci0000:00/usb1/1-1/1-1:1.0/ttyUSB0", "class/tty/ttyUSB0/device")
+
+	mk("devices/pci0000:00/usb1/1-2", map[string]string{"idVendor": "0403", "idProduct": "6001", "serial": "A600efgh"})
+	mk("devices/pci0000:00/usb1/1-2/1-2:1.0", nil)
+	link("devices/pci0000:00/usb1/1-2/1-2:1.0", "class/tty/ttyACM0/device")
+
+	mk("devices/platform/serial8250", nil)
+	mk("devices/platform/drivers/serial8250", nil)
+	link("devices/platform/drivers/serial8250", "devices/platform/serial8250/driver")
+	link("devices/platform/serial8250", "class/tty/ttyS0/device")
+	link("devices/platform/serial8250", "class/tty/ttyS1/device")
+	mk("class/tty/ttyS0", map[string]string{"type": "4"})
+	mk("class/tty/ttyS1", map[string]string{"type": "0"})
+
+	mk("class/tty/console", nil)
+
+	return root
+}
+
+func TestListPorts(t *testing.T) {
+	root := fakeSysfs(t)
+	defer os.RemoveAll(root)
+
+	sysfsRoot = root
+	defer func() { sysfsRoot = "/sys" }()
+
+	ports, err := ListPorts()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"/dev/ttyACM0", "/dev/ttyS0", "/dev/ttyUSB0"}
+	if len(ports) != len(want) {
+		t.Fatal("got", ports)
+	}
+	for i, p := range ports {
+		if p.Path != want[i] {
+			t.Errorf("port %d: got %s, want %s", i, p.Path, want[i])
+		}
+	}
+
+	if sel := ports[2].Selector(); sel != "usb:0403:6001:A900abcd" || ports[2].Description != "FT232R USB UART" {
+		t.Error("unexpected ttyUSB0", ports[2])
+	}
+	if ports[1].Selector() != "" {
+		t.Error("ttyS0 is not a USB port", ports[1])
+	}
+
+	for sel, path := range map[string]string{
+		"usb:0403:6001:A900abcd": "/dev/ttyUSB0",
+		"usb:0403:6001:A600efgh": "/dev/ttyACM0",
+		"usb:0403:6001":          "/dev/ttyACM0", //first match
+		"/dev/ttyS0":             "/dev/ttyS0",
+	} {
+		got, err := resolveIn(sel, ports, nil)
+		if err != nil || got != path {
+			t.Errorf("%s: got %s %v, want %s", sel, got, err, path)
+		}
+	}
+	if _, err := resolveIn("usb:0403:6001:A900ABCD", ports, nil); err == nil {
+		t.Error("serial numbers should be case sensitive")
+	}
+}
+
+func TestResolveProbe(t *testing.T) {
+	quiet, err := ptytest.Open()
+	if err != nil {
+		t.Skip("no pty available:", err)
+	}
+	defer quiet.Close()
+	jeelink, err := ptytest.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jeelink.Close()
+
+	go jeelink.Script([]ptytest.Step{{Expect: "v", Reply: []string{"", "[RF12demo.12] A i1 g5 @ 868 MHz"}}}, wait)
+
+	prober, _ := NewProber(RF12demoBanner)
+	prober.Send = "v"
+	prober.Timeout = 200 * time.Millisecond
+
+	ports := []PortInfo{{Path: quiet.Path}, {Path: jeelink.Path}}
+	got, err := resolveIn("rf12demo", ports, prober)
+	if err != nil || got != jeelink.Path {
+		t.Errorf("got %s %v, want %s", got, err, jeelink.Path)
+	}
+
+	if _, err := resolveIn("probe:^\\[RFM69", ports[:1], prober); err == nil {
+		t.Error("expected nothing to answer")
+	}
+}
@@ -0,0 +1,13 @@
+// +build !linux
+
+package serial
+
+import (
+	"errors"
+	"runtime"
+)
+
+//ListPorts needs sysfs, elsewhere use a device path (or a network transport) directly
+func ListPorts() ([]PortInfo, error) {
+	return nil, errors.New("serial port listing is not available on " + runtime.GOOS)
+}
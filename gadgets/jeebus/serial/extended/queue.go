@@ -0,0 +1,300 @@
+package serial
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/jcw/flow"
+)
+
+//Write queue lanes, a higher lane is always written first
+const (
+	LaneHigh   = 0 //init scripts and DTR/RTS control
+	LaneNormal = 1 //.To and .Command
+	LaneBulk   = 2 //.To messages tagged "bulk"
+	laneCount  = 3
+)
+
+var laneNames = map[string]int{"high": LaneHigh, "normal": LaneNormal, "bulk": LaneBulk}
+
+//What happens when a write arrives and the queue is full
+const (
+	DropBlock  = "block"  //wait for room (the writer is held up, as before there was a queue)
+	DropOldest = "oldest" //drop the oldest write of the lowest lane queued
+	DropNewest = "newest" //drop the write that just arrived
+)
+
+var errDropped = errors.New("write dropped, queue full")
+var errQueueClosed = errors.New("write queue closed")
+
+//queueConfig paces writes so a device such as RF12demo is not overrun, the zero value writes as fast as possible
+type queueConfig struct {
+	byteRate  float64       //bytes per second, 0 for no limit
+	lineRate  float64       //writes per second, 0 for no limit
+	lineDelay time.Duration //minimum gap between writes
+	size      int           //bound on queued writes
+	drop      string
+	report    time.Duration //how often depth is sent on .Status (if it changed), 0 for never
+	reportSet bool
+}
+
+func newQueueConfig() queueConfig {
+	return queueConfig{size: 100, drop: DropBlock}
+}
+
+//apply sets a queue param, reporting whether the tag was one of ours
+func (c *queueConfig) apply(p flow.Tag) (bool, error) {
+	switch p.Tag {
+	case "rate", "linerate", "linedelay", "queuesize", "queuereport":
+		n, ok := p.Msg.(float64)
+		if !ok || n < 0 {
+			return true, fmt.Errorf("%s must be a positive number, got:%v", p.Tag, p.Msg)
+		}
+		switch p.Tag {
+		case "rate":
+			c.byteRate = n
+		case "linerate":
+			c.lineRate = n
+		case "linedelay":
+			c.lineDelay = time.Millisecond * time.Duration(n)
+		case "queuesize":
+			if n < 1 {
+				return true, fmt.Errorf("queuesize must be at least 1, got:%v", n)
+			}
+			c.size = int(n)
+		case "queuereport":
+			c.report = time.Millisecond * time.Duration(n)
+			c.reportSet = true
+		}
+	case "drop":
+		switch p.Msg {
+		case DropBlock, DropOldest, DropNewest:
+			c.drop = p.Msg.(string)
+		default:
+			return true, fmt.Errorf("unknown drop policy:%v", p.Msg)
+		}
+	default:
+		return false, nil
+	}
+	if !c.reportSet {
+		c.report = time.Second //asking for a queue implies wanting to see it
+	}
+	return true, nil
+}
+
+//gap is how long to leave after writing n bytes
+func (c *queueConfig) gap(n int) time.Duration {
+	gap := c.lineDelay
+	if c.lineRate > 0 {
+		if d := time.Duration(float64(time.Second) / c.lineRate); d > gap {
+			gap = d
+		}
+	}
+	if c.byteRate > 0 {
+		if d := time.Duration(float64(n) * float64(time.Second) / c.byteRate); d > gap {
+			gap = d
+		}
+	}
+	return gap
+}
+
+type queuedWrite struct {
+	dev  Transport
+	msg  flow.Message
+	done chan error //nil if nobody waits for the outcome
+}
+
+func (w queuedWrite) finish(err error) {
+	if w.done != nil {
+		w.done <- err
+	}
+}
+
+//writeQueue serialises all writes to the port through one goroutine, highest lane first
+type writeQueue struct {
+	sync.Mutex
+	cfg     queueConfig
+	lanes   [laneCount][]queuedWrite
+	depth   int
+	dropped int
+	closed  bool
+	more     chan struct{} //something was queued
+	room     *sync.Cond    //something was taken off, or the queue was closed
+	finished chan struct{} //closed when run returns
+	status   flow.Output
+}
+
+func newWriteQueue(cfg queueConfig, status flow.Output) *writeQueue {
+	q := &writeQueue{cfg: cfg, status: status, more: make(chan struct{}, 1), finished: make(chan struct{})}
+	q.room = sync.NewCond(&q.Mutex)
+	go q.run()
+	return q
+}
+
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+//push queues a write, applying the drop policy when full
+func (q *writeQueue) push(lane int, w queuedWrite) {
+	q.Lock()
+	for !q.closed && q.depth >= q.cfg.size && q.cfg.drop == DropBlock {
+		q.room.Wait()
+	}
+	if q.closed {
+		q.Unlock()
+		w.finish(errQueueClosed)
+		return
+	}
+
+	if q.depth >= q.cfg.size {
+		victim := -1
+		if q.cfg.drop == DropOldest {
+			for l := laneCount - 1; l >= lane; l-- {
+				if len(q.lanes[l]) > 0 {
+					victim = l
+					break
+				}
+			}
+		}
+		q.dropped++
+		if victim < 0 { //newest, or everything queued matters more
+			q.Unlock()
+			w.finish(errDropped)
+			return
+		}
+		old := q.lanes[victim][0]
+		q.lanes[victim] = q.lanes[victim][1:]
+		q.depth--
+		old.finish(errDropped)
+	}
+
+	q.lanes[lane] = append(q.lanes[lane], w)
+	q.depth++
+	q.Unlock()
+	signal(q.more)
+}
+
+//send queues a write and waits until it has been written
+func (q *writeQueue) send(lane int, dev Transport, m flow.Message) error {
+	done := make(chan error, 1)
+	q.push(lane, queuedWrite{dev, m, done})
+	return <-done
+}
+
+//post queues a write without waiting
+func (q *writeQueue) post(lane int, dev Transport, m flow.Message) {
+	q.push(lane, queuedWrite{dev, m, nil})
+}
+
+func (q *writeQueue) pop() (queuedWrite, bool) {
+	q.Lock()
+	defer q.Unlock()
+	for l := range q.lanes {
+		if len(q.lanes[l]) > 0 {
+			w := q.lanes[l][0]
+			q.lanes[l] = q.lanes[l][1:]
+			q.depth--
+			q.room.Signal()
+			return w, true
+		}
+	}
+	return queuedWrite{}, false
+}
+
+//close fails whatever is still queued, as its device is closed or about to be, and waits for a write in progress so
+//nothing is written or reported once it returns
+func (q *writeQueue) close() {
+	q.Lock()
+	q.closed = true
+	var pending []queuedWrite
+	for l := range q.lanes {
+		pending = append(pending, q.lanes[l]...)
+		q.lanes[l] = nil
+	}
+	q.depth = 0
+	q.room.Broadcast() //every blocked push gives up
+	q.Unlock()
+
+	for _, w := range pending {
+		w.finish(errQueueClosed)
+	}
+	signal(q.more)
+	<-q.finished
+}
+
+func (q *writeQueue) run() {
+	defer close(q.finished)
+	var tick <-chan time.Time
+	if q.cfg.report > 0 {
+		ticker := time.NewTicker(q.cfg.report)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	reported := [2]int{0, 0}
+	next := time.Now()
+
+	for {
+		w, ok := q.pop()
+		if !ok {
+			q.Lock()
+			closed := q.closed
+			q.Unlock()
+			if closed {
+				return
+			}
+			select {
+			case <-q.more:
+			case <-tick:
+				reported = q.reportDepth(reported)
+			}
+			continue
+		}
+
+		if wait := next.Sub(time.Now()); wait > 0 {
+			<-time.After(wait)
+		}
+		n, err := writeHandler(w.dev, w.msg)
+		if err != nil && glog.V(2) {
+			glog.Infoln("SerialPortEx write:", err)
+		}
+		next = time.Now().Add(q.cfg.gap(n))
+		w.finish(err)
+
+		select {
+		case <-tick:
+			reported = q.reportDepth(reported)
+		default:
+		}
+	}
+}
+
+//reportDepth sends the queue depth and drop count on .Status when either has changed
+func (q *writeQueue) reportDepth(last [2]int) [2]int {
+	q.Lock()
+	now := [2]int{q.depth, q.dropped}
+	q.Unlock()
+	if now != last {
+		q.status.Send(flow.Tag{"queue", map[string]interface{}{"depth": now[0], "dropped": now[1]}})
+	}
+	return now
+}
+
+//laneOf picks the lane for a .To message, unwrapping a lane tag such as {tag: "bulk", msg: "..."}
+func laneOf(m flow.Message) (int, flow.Message) {
+	switch v := m.(type) {
+	case flow.Tag:
+		if lane, ok := laneNames[v.Tag]; ok {
+			return lane, v.Msg
+		}
+	case int, float64, bool: //DTR/RTS control
+		return LaneHigh, m
+	}
+	return LaneNormal, m
+}
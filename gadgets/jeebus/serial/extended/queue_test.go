@@ -0,0 +1,229 @@
+package serial
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jcw/flow"
+	"github.com/TheDistractor/flow-ext/go-helpers/flowtest"
+)
+
+const wait = 2 * time.Second
+
+//recorder is a Transport that notes what is written and done to the control lines
+type recorder struct {
+	sync.Mutex
+	calls   []string
+	at      []time.Time
+	written []byte
+	writes  []string
+	writeAt []time.Time
+}
+
+func (r *recorder) note(call string) error {
+	r.Lock()
+	defer r.Unlock()
+	r.calls = append(r.calls, call)
+	r.at = append(r.at, time.Now())
+	return nil
+}
+
+func (r *recorder) Read(p []byte) (int, error) { return 0, errors.New("not readable") }
+func (r *recorder) Close() error               { return nil }
+
+func (r *recorder) Write(p []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+	r.written = append(r.written, p...)
+	r.writes = append(r.writes, strings.TrimSuffix(string(p), "\n"))
+	r.writeAt = append(r.writeAt, time.Now())
+	return len(p), nil
+}
+
+func (r *recorder) SetDTR(on bool) error {
+	if on {
+		return r.note("dtr on")
+	}
+	return r.note("dtr off")
+}
+
+func (r *recorder) SetRTS(on bool) error {
+	if on {
+		return r.note("rts on")
+	}
+	return r.note("rts off")
+}
+
+func (r *recorder) lines() []string {
+	r.Lock()
+	defer r.Unlock()
+	return append([]string{}, r.writes...)
+}
+
+func queueWith(t *testing.T, status flow.Output, params ...flow.Tag) *writeQueue {
+	cfg := newQueueConfig()
+	for _, p := range params {
+		if ok, err := cfg.apply(p); !ok || err != nil {
+			t.Fatal(p, ok, err)
+		}
+	}
+	return newWriteQueue(cfg, status)
+}
+
+func TestQueueLanes(t *testing.T) {
+	r := &recorder{}
+	q := queueWith(t, make(flowtest.Pin, 100), flow.Tag{"linedelay", 50.0})
+	defer q.close()
+
+	q.send(LaneNormal, r, "first") //the next writes queue up behind its delay
+	for _, m := range []flow.Message{flow.Tag{"bulk", "b1"}, flow.Tag{"bulk", "b2"}, "n1", true, flow.Tag{"high", "h1"}} {
+		lane, data := laneOf(m)
+		q.post(lane, r, data)
+	}
+	q.send(LaneBulk, r, "last")
+
+	want := "first h1 n1 b1 b2 last"
+	if got := strings.Join(r.lines(), " "); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if len(r.calls) != 1 || r.calls[0] != "rts on" {
+		t.Error("control write missing", r.calls)
+	}
+	for i := 1; i < len(r.writeAt); i++ {
+		if gap := r.writeAt[i].Sub(r.writeAt[i-1]); gap < 50*time.Millisecond {
+			t.Errorf("write %d only %v after the previous", i, gap)
+		}
+	}
+}
+
+func TestQueueRates(t *testing.T) {
+	r := &recorder{}
+	q := queueWith(t, make(flowtest.Pin, 100), flow.Tag{"rate", 100.0}, flow.Tag{"linerate", 50.0})
+	defer q.close()
+
+	q.post(LaneNormal, r, "123456789") //10 bytes at 100 bytes/s
+	q.post(LaneNormal, r, "a")         //2 bytes, but only 50 lines/s
+	q.send(LaneNormal, r, "b")
+
+	if gap := r.writeAt[1].Sub(r.writeAt[0]); gap < 100*time.Millisecond {
+		t.Error("byte rate not honoured:", gap)
+	}
+	if gap := r.writeAt[2].Sub(r.writeAt[1]); gap < 20*time.Millisecond || gap > 80*time.Millisecond {
+		t.Error("line rate not honoured:", gap)
+	}
+}
+
+func TestQueueDrop(t *testing.T) {
+	r := &recorder{}
+	status := make(flowtest.Pin, 100)
+	q := queueWith(t, status, flow.Tag{"linedelay", 100.0}, flow.Tag{"queuesize", 2.0},
+		flow.Tag{"drop", "oldest"}, flow.Tag{"queuereport", 10.0})
+
+	q.send(LaneNormal, r, "first")
+	q.post(LaneBulk, r, "b1")
+	q.post(LaneNormal, r, "n1")
+	q.post(LaneNormal, r, "n2") //full, b1 goes
+	if err := q.send(LaneBulk, r, "b2"); err != errDropped {
+		t.Error("a bulk write should not push out normal ones, got", err)
+	}
+
+	//depth is reported while the queue drains
+	report := status.Next(t).(flow.Tag)
+	if report.Tag != "queue" || report.Msg.(map[string]interface{})["dropped"] != 2 {
+		t.Error("unexpected report", report)
+	}
+
+	q.send(LaneHigh, r, "h1")
+	if got := strings.Join(r.lines(), " "); got != "first n1 n2 h1" {
+		t.Error("got", got)
+	}
+
+	q.close()
+	if err := q.send(LaneHigh, r, "late"); err != errQueueClosed {
+		t.Error("expected a closed queue, got", err)
+	}
+}
+
+//stuck is a Transport whose writes hang until it is released
+type stuck struct {
+	recorder
+	release chan struct{}
+}
+
+func (s *stuck) Write(p []byte) (int, error) {
+	<-s.release
+	return s.recorder.Write(p)
+}
+
+func TestQueueCloseBlocked(t *testing.T) {
+	dev := &stuck{release: make(chan struct{})}
+	q := queueWith(t, make(flowtest.Pin, 100), flow.Tag{"queuesize", 1.0})
+
+	q.post(LaneNormal, dev, "written") //taken by run, which then hangs
+	for {
+		q.Lock()
+		depth := q.depth
+		q.Unlock()
+		if depth == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	q.post(LaneNormal, dev, "queued") //fills the queue
+
+	errs := make(chan error)
+	for i := 0; i < 3; i++ {
+		go func() { errs <- q.send(LaneNormal, dev, "blocked") }()
+	}
+	time.Sleep(20 * time.Millisecond)
+	closed := make(chan struct{})
+	go func() {
+		q.close()
+		close(closed)
+	}()
+
+	for i := 0; i < 3; i++ {
+		select {
+		case err := <-errs:
+			if err != errQueueClosed {
+				t.Error("expected a closed queue, got", err)
+			}
+		case <-time.After(wait):
+			t.Fatal("blocked writers were not all released by close")
+		}
+	}
+
+	//close waits for the write in progress, and what was still queued never reaches the device
+	select {
+	case <-closed:
+		t.Fatal("close returned during a write")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(dev.release)
+	select {
+	case <-closed:
+	case <-time.After(wait):
+		t.Fatal("close did not return")
+	}
+	if got := dev.lines(); len(got) != 1 || got[0] != "written" {
+		t.Error("expected only the first write, got", got)
+	}
+}
+
+func TestQueueConfig(t *testing.T) {
+	cfg := newQueueConfig()
+	if cfg.report != 0 || cfg.gap(100) != 0 {
+		t.Error("default queue should not pace or report", cfg)
+	}
+	if ok, _ := cfg.apply(flow.Tag{"baud", 9600.0}); ok {
+		t.Error("baud is not a queue param")
+	}
+	for _, bad := range []flow.Tag{{"rate", -1.0}, {"queuesize", 0.0}, {"drop", "random"}, {"linedelay", "1s"}} {
+		if ok, err := cfg.apply(bad); !ok || err == nil {
+			t.Error("expected an error for", bad)
+		}
+	}
+}
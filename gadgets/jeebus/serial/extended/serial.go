@@ -1,30 +1,46 @@
-// +build linux darwin
-
-// Interface to serial port devices (only Linux and Mac OSX).
+// Interface to serial port devices, local or across the network.
 // SerialPortEx is an extended SerialPort with access to port params
+// The Port selects a transport by scheme, e.g. tcp://pi-garage:4001 or rfc2217://pi-garage:4002,
+// a plain device path uses rs232 on Linux and Mac OSX and goserialproxy elsewhere (including Windows).
 // It is NOT auto instantiated to the flow Registry from this package, use serial/serialex to autoadd to Registry
 package serial
 
 import (
-	"bufio"
+	"fmt"
+	"sync"
 	"time"
 
-	"github.com/chimera/rs232"
+	"github.com/golang/glog"
 	"github.com/jcw/flow"
+	"github.com/TheDistractor/flow-ext/go-helpers/framing"
+	"github.com/TheDistractor/flow-ext/go-helpers/termios"
 )
 
 
-// Line-oriented serial port, opened once the Port input is set.
+// Line-oriented serial port, opened once the Port input is set (binary framing can be selected via Param).
+// If the device goes away (unplugged, driver glitch) it is re-opened as soon as it comes back,
+// with connect/disconnect events reported on Status.
 type SerialPort struct {
 	flow.Gadget
 	Param flow.Input
 	Port flow.Input
 	To   flow.Input
 	From flow.Output
+	Command flow.Input //request/response commands, see Command
+	Reply flow.Output  //the outcome of each Command
+	Status flow.Output //connected/disconnected/error events as flow.Tag's
+	Trace flow.Output  //capture transcript lines, if the trace param is set
+
+	scheme string //transport used for a Port without a scheme://
+}
+
+//NewSerialPort creates a SerialPort whose plain device paths are opened with the given transport scheme
+func NewSerialPort(scheme string) *SerialPort {
+	return &SerialPort{scheme: scheme}
 }
 
 // Start processing text lines to and from the serial interface.
-// Send a bool to adjust RTS or an int to pulse DTR for that many milliseconds.
+// Send a bool to adjust RTS or a number to pulse DTR for that many milliseconds.
 // Registers as "SerialPort".
 func (w *SerialPort) Run() {
 
@@ -32,7 +48,18 @@ func (w *SerialPort) Run() {
 	databits := uint8(8)
 	stopbits := uint8(1)
 
-	initdata := make([]interface{},0) //initialization data sequence (if supplied)
+	reconnect := true                   //re-open the port when it goes away
+	retryMin := 500 * time.Millisecond  //first retry delay, also how often we look for the device to reappear
+	retryMax := 30 * time.Second        //retry delay backs off up to this
+
+	line := termios.LineSettings{}  //parity, flow control and read timeout
+	controls := map[string]bool{}  //explicit dtr/rts line states, set each time the port is opened
+	idleTimeout := time.Duration(0) //if nothing is read for this long, the port is closed
+	frame := framing.NewConfig()    //how .From is split up, text lines by default
+	capturing := &capture{}         //traffic transcript, off unless capture or trace is set
+	queueCfg := newQueueConfig()    //write pacing, as fast as possible by default
+
+	initdata := []initStep{} //initialization script (if supplied)
 
 	for param := range w.Param {
 
@@ -45,19 +72,165 @@ func (w *SerialPort) Run() {
 			databits = uint8(p.Msg.(float64))
 		case "stopbits":
 			stopbits = uint8(p.Msg.(float64))
-		case "init":
-			initdata = append(initdata,p.Msg) //initialization sequence
+		case "init", "initfile":
+			entry := p.Msg
+			if p.Tag == "initfile" {
+				entry = map[string]interface{}{"include": p.Msg}
+			}
+			steps, err := parseInit(entry)
+			if err != nil {
+				glog.Errorln("SerialPortEx:", err)
+				continue
+			}
+			initdata = append(initdata, steps...) //initialization sequence
+		case "parity":
+			if err := termios.ValidParity(p.Msg.(string)); err != nil {
+				glog.Errorln("SerialPortEx:", err)
+				continue
+			}
+			line.Parity = p.Msg.(string)
+		case "rtscts":
+			line.RTSCTS = p.Msg.(bool)
+		case "xonxoff":
+			line.XONXOFF = p.Msg.(bool)
+		case "dtr", "rts":
+			controls[p.Tag] = p.Msg.(bool)
+		case "framing":
+			cfg, err := framing.ParseConfig(p.Msg)
+			if err != nil {
+				glog.Errorln("SerialPortEx:", err)
+				continue
+			}
+			frame = cfg
+		case "readtimeout":
+			d := time.Millisecond*time.Duration(p.Msg.(float64))
+			if err := termios.ValidReadTimeout(d); err != nil {
+				glog.Errorln("SerialPortEx:", err)
+				continue
+			}
+			line.ReadTimeout = d
+		case "idletimeout":
+			idleTimeout = time.Millisecond*time.Duration(p.Msg.(float64))
+		case "capture":
+			capturing.dir = p.Msg.(string)
+		case "trace":
+			if p.Msg.(bool) {
+				capturing.trace = w.Trace
+			}
+		case "reconnect":
+			reconnect = p.Msg.(bool)
+		case "retrymin":
+			retryMin = time.Millisecond*time.Duration(p.Msg.(float64))
+		case "retrymax":
+			retryMax = time.Millisecond*time.Duration(p.Msg.(float64))
+		default:
+			if _, err := queueCfg.apply(p); err != nil {
+				glog.Errorln("SerialPortEx:", err)
+			}
 		}
 
 	}
 
 
+	port, ok := <-w.Port
+	if !ok {
+		return
+	}
+	path := port.(string)
+
+	scheme := w.scheme
+	if scheme == "" {
+		scheme = defaultTransport
+	}
+	transport, address, err := lookupTransport(path, scheme)
+	if err != nil {
+		glog.Errorln("SerialPortEx:", err)
+		w.Status.Send(flow.Tag{"error", err.Error()})
+		return
+	}
+	if line.ReadTimeout > 0 && !transport.local {
+		glog.Warningln("SerialPortEx: readtimeout only applies to local devices, not:", path)
+	}
+	//said now rather than on every attempt to open the port
+	if err := termios.Check(line); err != nil && transport.local {
+		glog.Errorln("SerialPortEx:", err)
+		w.Status.Send(flow.Tag{"error", err.Error()})
+		return
+	}
+	opt := Options{BitRate: baud, DataBits: databits, StopBits: stopbits, Line: line}
+
+	capturing.port = path
+	if capturing.dir == "" && capturing.trace == nil {
+		capturing = nil
+	} else {
+		defer capturing.close()
+	}
 
+	conn := &connection{}
 
-	if port, ok := <-w.Port; ok {
-		opt := rs232.Options{BitRate: baud, DataBits: databits, StopBits: stopbits}
-		dev, err := rs232.Open(port.(string), opt)
-		flow.Check(err)
+	// every write goes through the queue, so the device is never overrun. On the way out the queue is closed first
+	// (failing what is still queued), then the command runner is stopped and waited for: nothing is written or sent
+	// once Run has returned
+	quit := make(chan struct{})
+	var helpers sync.WaitGroup
+	defer helpers.Wait()
+	defer close(quit)
+	queue := newWriteQueue(queueCfg, w.Status)
+	defer queue.close()
+
+	// separate process to copy data out to the serial port, whichever device is current (once it is initialised)
+	go func() {
+		for m := range w.To {
+			if dev := conn.await(); dev != nil {
+				lane, data := laneOf(m)
+				queue.post(lane, dev, data)
+			} else if glog.V(2) {
+				glog.Infoln("SerialPortEx not connected, dropped:", m)
+			}
+		}
+	}()
+
+	// commands are sent one at a time, their replies are taken out of .From
+	cmds := &commander{}
+	helpers.Add(1)
+	go func() {
+		defer helpers.Done()
+		cmds.run(w.Command, quit, conn, queue, w.Reply)
+	}()
+
+	retry := retryMin
+	for {
+		// wait for a hot-plugged device to (re)appear before trying to open it, saying so once
+		if !transport.present(address) {
+			if !reconnect {
+				w.Status.Send(flow.Tag{"error", "no such device:" + path})
+				return
+			}
+			w.Status.Send(flow.Tag{"waiting", path})
+			for !transport.present(address) {
+				<-time.After(retryMin)
+			}
+		}
+
+		dev, err := transport.open(address, opt)
+		if err != nil {
+			glog.Errorln("SerialPortEx open:", err)
+			w.Status.Send(flow.Tag{"error", err.Error()})
+			if !reconnect {
+				return
+			}
+			<-time.After(retry)
+			if retry *= 2; retry > retryMax {
+				retry = retryMax
+			}
+			continue
+		}
+		retry = retryMin
+
+		if capturing != nil {
+			dev = &capturedTransport{dev, capturing}
+			capturing.record(CaptureEvent, []byte("connected"))
+		}
 
 		// try to avoid kernel panics due to that wretched buggy FTDI driver!
 		// defer func() {
@@ -66,46 +239,173 @@ func (w *SerialPort) Run() {
 		// }()
 		// time.Sleep(time.Second)
 
+		if err := setControls(dev, controls); err != nil {
+			glog.Errorln("SerialPortEx dtr/rts:", err)
+			w.Status.Send(flow.Tag{"error", err.Error()})
+		}
+
+		conn.set(dev)
+		w.Status.Send(flow.Tag{"connected", path})
 
-		//handle initialization data (this loop only happens once)
-		go func() {
-			for _,data := range initdata {
-				switch data.(type) {
-					case map[string]interface{}:
-						hash := data.(map[string]interface{})
-
-						for k,v := range hash {
-							switch k {
-								case "delay":
-									if d,ok := v.(float64);ok {
-										<-time.After(time.Millisecond*time.Duration(int(d)))
-									}
-							}
-
-						}
-					default:
-						_,_ = writeHandler(dev, data)
-				}
+		//handle initialization data (replayed on every connect), .To and .Command are held until it is done
+		watch := newLineWatch()
+		initDone := make(chan struct{})
+		go func(dev Transport) {
+			defer close(initDone)
+			last := ""
+			write := func(m interface{}) error { return queue.send(LaneHigh, dev, m) }
+			if err := runInit(write, initdata, watch, &last); err != nil && err != errGone {
+				glog.Errorln("SerialPortEx", err)
+				w.Status.Send(flow.Tag{"error", err.Error()})
 			}
-		}()
+			watch.stop()
+			conn.initialised(dev)
+		}(dev)
 
-		// separate process to copy data out to the serial port
-		go func() {
-			for m := range w.To {
-				_,_ = writeHandler(dev, m)
-			}
-		}()
+		//a silent device is treated as a lost one
+		var idle *idleTimer
+		if idleTimeout > 0 {
+			idle = newIdleTimer(idleTimeout, func() {
+				w.Status.Send(flow.Tag{"idle", path})
+				dev.Close()
+			})
+		}
 
-		scanner := bufio.NewScanner(dev)
+		scanner := framing.NewReader(dev, frame)
 		for scanner.Scan() {
-			msg:=scanner.Text()
+			if idle != nil {
+				idle.reset()
+			}
+			msg := frame.Message(scanner.Bytes()) //a string for lines, []byte for binary frames
+			watch.see(msg)
+			if cmds.offer(msg) {
+				continue
+			}
 			w.From.Send(msg)
 		}
+		if err := scanner.Err(); err != nil {
+			glog.Errorln("SerialPortEx read:", err)
+		}
+
+		if idle != nil {
+			idle.stop()
+		}
+		conn.set(nil)
+		dev.Close()
+		watch.gone() //an init still running gives up, quietly
+		<-initDone
+		w.Status.Send(flow.Tag{"disconnected", path})
+		if capturing != nil {
+			capturing.record(CaptureEvent, []byte("disconnected"))
+		}
+
+		if !reconnect {
+			return
+		}
 	}
 }
 
+//idleTimer fires when it has not been reset for a while, once stop returns it is not firing and won't
+type idleTimer struct {
+	sync.Mutex
+	d       time.Duration
+	t       *time.Timer
+	stopped bool
+}
+
+func newIdleTimer(d time.Duration, fire func()) *idleTimer {
+	i := &idleTimer{d: d}
+	i.t = time.AfterFunc(d, func() {
+		i.Lock()
+		defer i.Unlock()
+		if !i.stopped {
+			fire()
+		}
+	})
+	return i
+}
+
+func (i *idleTimer) reset() {
+	i.t.Reset(i.d)
+}
+
+func (i *idleTimer) stop() {
+	i.t.Stop()
+	i.Lock() //waits for a fire in progress
+	i.stopped = true
+	i.Unlock()
+}
+
+//connection holds the currently open device, shared between the reader and the .To writer
+type connection struct {
+	sync.Mutex
+	dev   Transport
+	ready chan struct{} //closed once dev has been initialised, or has gone
+}
+
+func (c *connection) get() Transport {
+	c.Lock()
+	defer c.Unlock()
+	return c.dev
+}
+
+func (c *connection) set(dev Transport) {
+	c.Lock()
+	defer c.Unlock()
+	c.release()
+	c.dev = dev
+	if dev != nil {
+		c.ready = make(chan struct{})
+	}
+}
+
+//initialised lets .To traffic through to dev, unless it has already been replaced
+func (c *connection) initialised(dev Transport) {
+	c.Lock()
+	defer c.Unlock()
+	if c.dev == dev {
+		c.release()
+	}
+}
+
+func (c *connection) release() {
+	if c.ready != nil {
+		close(c.ready)
+		c.ready = nil
+	}
+}
+
+//await waits until the current device is initialised, nil means there is no device
+func (c *connection) await() Transport {
+	for {
+		c.Lock()
+		dev, ready := c.dev, c.ready
+		c.Unlock()
+		if ready == nil {
+			return dev
+		}
+		<-ready
+	}
+}
+
+//setControls applies the explicit dtr/rts line states
+func setControls(dev Transport, controls map[string]bool) (err error) {
+	for k, v := range controls {
+		switch k {
+		case "dtr":
+			err = dev.SetDTR(v)
+		case "rts":
+			err = dev.SetRTS(v)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 //writeHandler is a generic type converter for Serial Input (used by both .Param and .To )
-func writeHandler(dev *rs232.Port,  m interface{} ) (int,error) {
+func writeHandler(dev Transport,  m interface{} ) (int,error) {
 
 	switch v := m.(type) {
 	case string:
@@ -113,13 +413,21 @@ func writeHandler(dev *rs232.Port,  m interface{} ) (int,error) {
 	case []byte:
 		return dev.Write(v)
 	case int:
-		if err:= dev.SetDTR(true); err==nil { // pulse DTR to reset
-			time.Sleep(time.Duration(v) * time.Millisecond)
-			return 0,dev.SetDTR(false)
-		}
+		return 0,pulseDTR(dev, time.Duration(v) * time.Millisecond)
+	case float64: //numbers arrive as float64 from JSON
+		return 0,pulseDTR(dev, time.Duration(v) * time.Millisecond)
 	case bool:
 		return 0,dev.SetRTS(v)
 	}
 
-	return 0,nil //TODO: we lost this type - perhaps log?
+	return 0,fmt.Errorf("can't send %T:%v", m, m)
+}
+
+//pulseDTR raises DTR for d, to reset the device
+func pulseDTR(dev Transport, d time.Duration) error {
+	if err := dev.SetDTR(true); err != nil {
+		return err
+	}
+	time.Sleep(d)
+	return dev.SetDTR(false)
 }
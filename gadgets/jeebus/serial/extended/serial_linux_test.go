@@ -0,0 +1,406 @@
+// +build linux
+
+package serial
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TheDistractor/flow-ext/go-helpers/flowtest"
+	"github.com/TheDistractor/flow-ext/go-helpers/ptytest"
+	"github.com/jcw/flow"
+)
+
+//harness runs a SerialPort against a pty, feeding it params and the device path
+type harness struct {
+	dev    *ptytest.Device
+	to     chan flow.Message
+	from   flowtest.Pin
+	status flowtest.Pin
+	trace  flowtest.Pin
+	cmd    chan flow.Message
+	reply  flowtest.Pin
+	done   chan struct{}
+}
+
+func startSerial(t *testing.T, params ...flow.Tag) *harness {
+	dev, err := ptytest.Open()
+	if err != nil {
+		t.Skip("no pty available:", err)
+	}
+
+	param := make(chan flow.Message, len(params)+1)
+	for _, p := range params {
+		param <- p
+	}
+	param <- flow.Tag{"reconnect", false} //so Run returns once the device hangs up
+	close(param)
+
+	port := make(chan flow.Message, 1)
+	port <- dev.Path
+	close(port)
+
+	h := &harness{dev: dev, to: make(chan flow.Message), from: make(flowtest.Pin, 100), status: make(flowtest.Pin, 100), trace: make(flowtest.Pin, 100),
+		cmd: make(chan flow.Message), reply: make(flowtest.Pin, 100), done: make(chan struct{})}
+
+	w := NewSerialPort(SchemeRS232)
+	w.Param, w.Port, w.To = param, port, h.to
+	w.From, w.Status, w.Trace = h.from, h.status, h.trace
+	w.Command, w.Reply = h.cmd, h.reply
+
+	go func() {
+		w.Run()
+		close(h.done)
+	}()
+
+	if s := h.status.Next(t).(flow.Tag); s.Tag != "connected" {
+		t.Fatal("expected connected, got", s)
+	}
+	return h
+}
+
+//stop hangs up the device and waits for the gadget to notice
+func (h *harness) stop(t *testing.T) {
+	h.dev.Close()
+	select {
+	case <-h.done:
+	case <-time.After(wait):
+		t.Fatal("gadget did not stop after hangup")
+	}
+	close(h.to)
+	close(h.cmd)
+}
+
+func TestSerialFrom(t *testing.T) {
+	h := startSerial(t)
+
+	h.dev.Send("OK 5 1 2", "OK 6 3")
+	for _, want := range []string{"OK 5 1 2", "OK 6 3"} {
+		if got := h.from.Next(t); got != want {
+			t.Errorf("got %v, want %s", got, want)
+		}
+	}
+
+	h.stop(t)
+	if s := h.status.Next(t).(flow.Tag); s.Tag != "disconnected" {
+		t.Error("expected disconnected, got", s)
+	}
+}
+
+func TestSerialTo(t *testing.T) {
+	h := startSerial(t)
+	defer h.stop(t)
+
+	h.to <- "v"
+	if _, err := h.dev.Expect("v", wait); err != nil {
+		t.Error(err)
+	}
+
+	h.to <- []byte{0xC0, 0x01, 0xC0} //bytes go out untouched, with no newline
+	b, err := h.dev.ReadFull(3, wait)
+	if err != nil || string(b) != "\xC0\x01\xC0" {
+		t.Errorf("got %v %v", b, err)
+	}
+}
+
+//startMissing runs a SerialPort on a device path that does not exist (yet)
+func startMissing(path string, params ...flow.Tag) (flowtest.Pin, chan struct{}) {
+	param := make(chan flow.Message, len(params))
+	for _, p := range params {
+		param <- p
+	}
+	close(param)
+	port := make(chan flow.Message, 1)
+	port <- path
+	close(port)
+
+	status, done := make(flowtest.Pin, 100), make(chan struct{})
+	w := NewSerialPort(SchemeRS232)
+	w.Param, w.Port, w.To, w.Command = param, port, make(chan flow.Message), make(chan flow.Message)
+	w.From, w.Status, w.Trace, w.Reply = make(flowtest.Pin, 100), status, make(flowtest.Pin, 100), make(flowtest.Pin, 100)
+	go func() {
+		w.Run()
+		close(done)
+	}()
+	return status, done
+}
+
+func TestSerialMissing(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "serial")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ttyUSB0")
+
+	status, done := startMissing(path, flow.Tag{"reconnect", false})
+	if s := status.Next(t).(flow.Tag); s.Tag != "error" || !strings.Contains(s.Msg.(string), path) {
+		t.Error("expected an error, got", s)
+	}
+	select {
+	case <-done:
+	case <-time.After(wait):
+		t.Fatal("gadget kept waiting without reconnect")
+	}
+}
+
+func TestSerialWaiting(t *testing.T) {
+	dev, err := ptytest.Open()
+	if err != nil {
+		t.Skip("no pty available:", err)
+	}
+	defer dev.Close()
+	dir, _ := ioutil.TempDir("", "serial")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ttyUSB0")
+
+	status, _ := startMissing(path, flow.Tag{"retrymin", 10.0})
+	if s := status.Next(t).(flow.Tag); s.Tag != "waiting" {
+		t.Fatal("expected waiting, got", s)
+	}
+	time.Sleep(50 * time.Millisecond) //several polls, which are not reported
+	os.Symlink(dev.Path, path)        //plugged in
+	if s := status.Next(t).(flow.Tag); s.Tag != "connected" {
+		t.Error("expected connected, got", s)
+	}
+}
+
+func TestSerialIdle(t *testing.T) {
+	h := startSerial(t, flow.Tag{"idletimeout", 50.0})
+	defer h.stop(t)
+
+	h.dev.Send("OK 5")
+	h.from.Next(t)
+	for _, want := range []string{"idle", "disconnected"} {
+		if s := h.status.Next(t).(flow.Tag); s.Tag != want {
+			t.Errorf("expected %s, got %v", want, s)
+		}
+	}
+}
+
+func TestSerialStopQuiet(t *testing.T) {
+	h := startSerial(t, flow.Tag{"init", map[string]interface{}{"delay": 10000.0}}, flow.Tag{"init", "late"})
+	h.cmd <- map[string]interface{}{"send": "v", "expect": "never", "timeout": 10000.0} //held until init is done
+
+	h.stop(t) //neither the init delay nor the command holds Run up
+	if r := h.reply.Next(t).(flow.Tag); r.Tag != "error" {
+		t.Error("expected the held command to fail, got", r)
+	}
+	if s := h.status.Next(t).(flow.Tag); s.Tag != "disconnected" {
+		t.Error("expected disconnected, got", s)
+	}
+
+	//nothing is sent once Run has returned, the init that gave up has nothing to report
+	time.Sleep(100 * time.Millisecond)
+	if len(h.status) != 0 || len(h.reply) != 0 {
+		t.Error("sent after Run returned", len(h.status), len(h.reply))
+	}
+}
+
+func TestSerialInitReplay(t *testing.T) {
+	h := startSerial(t,
+		flow.Tag{"init", "8b"},
+		flow.Tag{"init", map[string]interface{}{"delay": 150.0}},
+		flow.Tag{"init", "5i"},
+		flow.Tag{"init", "212g"},
+	)
+	defer h.stop(t)
+
+	lines := []ptytest.Line{}
+	for _, want := range []string{"8b", "5i", "212g"} {
+		l, err := h.dev.ReadLine(wait)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l.Text != want {
+			t.Fatalf("init out of order, got %s, want %s", l.Text, want)
+		}
+		lines = append(lines, l)
+	}
+
+	if gap := lines[1].At.Sub(lines[0].At); gap < 150*time.Millisecond {
+		t.Error("delay not honoured, gap was", gap)
+	}
+	if gap := lines[2].At.Sub(lines[1].At); gap > 100*time.Millisecond {
+		t.Error("unexpected delay after 5i:", gap)
+	}
+}
+
+func TestSerialInitExpect(t *testing.T) {
+	h := startSerial(t, flow.Tag{"init", []interface{}{
+		map[string]interface{}{"expect": `^\[RF12demo\.(\d+)\]`, "timeout": 1000.0},
+		map[string]interface{}{"if": `RF12demo\.1[2-9]`, "then": []interface{}{"8b", "5i"}, "else": "old"},
+	}})
+	defer h.stop(t)
+
+	go func() { h.to <- "v" }() //held back until init is done
+
+	time.Sleep(100 * time.Millisecond) //a JeeLink takes a while to come out of reset
+	h.dev.Send("[RF12demo.12] A i1 g5 @ 868 MHz")
+
+	for _, want := range []string{"8b", "5i", "v"} {
+		if l, err := h.dev.ReadLine(wait); err != nil || l.Text != want {
+			t.Fatalf("got %q %v, want %s", l.Text, err, want)
+		}
+	}
+	if got := h.from.Next(t); got != "[RF12demo.12] A i1 g5 @ 868 MHz" {
+		t.Error("banner should still reach .From, got", got)
+	}
+}
+
+func TestSerialInitTimeout(t *testing.T) {
+	h := startSerial(t, flow.Tag{"init", map[string]interface{}{"expect": "^never", "timeout": 50.0}}, flow.Tag{"init", "8b"})
+	defer h.stop(t)
+
+	if s := h.status.Next(t).(flow.Tag); s.Tag != "error" {
+		t.Error("expected an init error, got", s)
+	}
+
+	h.to <- "v" //released even though init failed
+	if _, err := h.dev.Expect("v", wait); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSerialScript(t *testing.T) {
+	h := startSerial(t, flow.Tag{"init", "v"})
+	defer h.stop(t)
+
+	go h.dev.Script([]ptytest.Step{
+		{Expect: "v", Reply: []string{"[RF12demo.12] A i1 g5 @ 868 MHz"}},
+		{Expect: "3b", Delay: 20 * time.Millisecond, Reply: []string{" A i1 g5 @ 433 MHz"}},
+	}, wait)
+
+	if got := h.from.Next(t); got != "[RF12demo.12] A i1 g5 @ 868 MHz" {
+		t.Fatal("unexpected banner:", got)
+	}
+	h.to <- "3b"
+	if got := h.from.Next(t); got != " A i1 g5 @ 433 MHz" {
+		t.Error("unexpected reply:", got)
+	}
+}
+
+func TestSerialCapture(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := startSerial(t, flow.Tag{"capture", dir}, flow.Tag{"trace", true}, flow.Tag{"init", "v"})
+
+	if _, err := h.dev.Expect("v", wait); err != nil {
+		t.Fatal(err)
+	}
+	h.dev.Write([]byte("OK 5 1\r\n"))
+	h.from.Next(t)
+	h.stop(t)
+
+	traced := []string{h.trace.Next(t).(string)}
+	for !strings.HasSuffix(traced[len(traced)-1], `"disconnected"`) {
+		traced = append(traced, h.trace.Next(t).(string))
+	}
+
+	name := filepath.Join(dir, time.Now().Format("20060102")+".txt")
+	file, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(file) != strings.Join(traced, "\n")+"\n" {
+		t.Errorf("file and trace differ:\n%s\n%q", file, traced)
+	}
+
+	//reads are as they came off the wire, in however many pieces, line ends included
+	var read, written []byte
+	for i, line := range traced {
+		r, err := ParseCapture(time.Now(), line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Port != h.dev.Path || len(strings.Fields(line)[1]) != len("15:04:05.000000") {
+			t.Errorf("line %d: %s", i, line)
+		}
+		switch r.Dir {
+		case CaptureRead:
+			read = append(read, r.Data...)
+		case CaptureWrite:
+			written = append(written, r.Data...)
+		}
+	}
+	if !strings.HasSuffix(traced[0], `"connected"`) || string(read) != "OK 5 1\r\n" || string(written) != "v\n" {
+		t.Errorf("unexpected transcript %q", traced)
+	}
+}
+
+func TestSerialCommand(t *testing.T) {
+	h := startSerial(t)
+	defer h.stop(t)
+
+	go h.dev.Script([]ptytest.Step{
+		{Expect: "v", Reply: []string{"OK 5 1 2", "[RF12demo.12] A i1 g5 @ 868 MHz", "OK 6 3"}},
+	}, wait)
+
+	h.cmd <- map[string]interface{}{"id": "cfg", "send": "v", "expect": `^\[RF12demo\.(\d+)\]`, "timeout": 1000.0}
+
+	r := h.reply.Next(t).(flow.Tag)
+	result := r.Msg.(map[string]interface{})
+	if r.Tag != "reply" || result["id"] != "cfg" || result["match"].([]string)[0] != "12" {
+		t.Error("unexpected reply:", r)
+	}
+
+	//unrelated lines still go to .From, in order
+	for _, want := range []string{"OK 5 1 2", "OK 6 3"} {
+		if got := h.from.Next(t); got != want {
+			t.Errorf("got %v, want %s", got, want)
+		}
+	}
+
+	h.cmd <- map[string]interface{}{"send": "1q", "expect": "^never", "timeout": 50.0}
+	if r := h.reply.Next(t).(flow.Tag); r.Tag != "timeout" {
+		t.Error("expected a timeout, got", r)
+	}
+
+	h.cmd <- map[string]interface{}{"send": "2q"}
+	if r := h.reply.Next(t).(flow.Tag); r.Tag != "reply" {
+		t.Error("expected a sent reply, got", r)
+	}
+	if _, err := h.dev.Expect("2q", wait); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWriteHandlerControls(t *testing.T) {
+	r := &recorder{}
+
+	writeHandler(r, 80) //pulse DTR for 80ms
+	writeHandler(r, true)
+	writeHandler(r, false)
+	writeHandler(r, "v")
+
+	want := []string{"dtr on", "dtr off", "rts on", "rts off"}
+	if len(r.calls) != len(want) {
+		t.Fatal("got", r.calls)
+	}
+	for i := range want {
+		if r.calls[i] != want[i] {
+			t.Errorf("call %d: got %s, want %s", i, r.calls[i], want[i])
+		}
+	}
+	if pulse := r.at[1].Sub(r.at[0]); pulse < 80*time.Millisecond {
+		t.Error("DTR pulse too short:", pulse)
+	}
+	if string(r.written) != "v\n" {
+		t.Errorf("wrote %q", r.written)
+	}
+}
+
+func TestSetControls(t *testing.T) {
+	r := &recorder{}
+	if err := setControls(r, map[string]bool{"dtr": false}); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.calls) != 1 || r.calls[0] != "dtr off" {
+		t.Error("got", r.calls)
+	}
+}
@@ -0,0 +1,109 @@
+package serial
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/TheDistractor/flow-ext/go-helpers/termios"
+)
+
+//Transport is whatever carries our serial data, a local device or something across the network.
+type Transport interface {
+	io.ReadWriteCloser
+	SetDTR(bool) error
+	SetRTS(bool) error
+}
+
+//Options are the line settings a Transport is opened with
+type Options struct {
+	BitRate  uint32
+	DataBits uint8
+	StopBits uint8
+	Line     termios.LineSettings //parity and flow control
+}
+
+//Opener opens a Transport for an address, the address is the Port with any scheme:// removed
+type Opener func(address string, opt Options) (Transport, error)
+
+type transportInfo struct {
+	open  Opener
+	local bool //the address is a device path we can watch for hot-plugging
+}
+
+//Transport schemes provided by this package
+const (
+	SchemeRS232   = "rs232"       //local device via chimera/rs232 (linux/darwin)
+	SchemeProxy   = "serialproxy" //local device via goserialproxy (linux/darwin/windows)
+	SchemeTCP     = "tcp"         //raw socket, such as ser2net in raw mode
+	SchemeRFC2217 = "rfc2217"     //telnet with COM port control, such as ser2net in telnet mode
+)
+
+var transports = map[string]transportInfo{}
+
+//RegisterTransport makes a Transport available to Port as scheme://address
+func RegisterTransport(scheme string, local bool, open Opener) {
+	transports[scheme] = transportInfo{open: open, local: local}
+}
+
+//splitPort separates a Port such as tcp://pi-garage:4001 into its scheme and address,
+//a plain device path uses the default scheme.
+func splitPort(port, defaultScheme string) (string, string) {
+	if i := strings.Index(port, "://"); i > 0 {
+		return port[:i], port[i+3:]
+	}
+	return defaultScheme, port
+}
+
+//lookupTransport finds the transport for a Port
+func lookupTransport(port, defaultScheme string) (transportInfo, string, error) {
+	scheme, address := splitPort(port, defaultScheme)
+	info, ok := transports[scheme]
+	if !ok {
+		return info, address, fmt.Errorf("unknown serial transport:%s", scheme)
+	}
+	return info, address, nil
+}
+
+//present reports whether a local device is present, remote transports are always worth trying
+func (t transportInfo) present(address string) bool {
+	if !t.local {
+		return true
+	}
+	_, err := os.Stat(address)
+	return err == nil
+}
+
+//timedReads is a local device with a read timeout (VTIME) on its line. A read that times out comes back empty,
+//which os.File turns into io.EOF, so it is simply tried again: the point is that no read blocks for longer than the
+//timeout, and once Close has been called the next one returns. An empty read well within the timeout is a real EOF.
+type timedReads struct {
+	Transport
+	timeout time.Duration
+	closed  int32
+}
+
+func newTimedReads(dev Transport, timeout time.Duration) *timedReads {
+	return &timedReads{Transport: dev, timeout: timeout}
+}
+
+func (t *timedReads) Read(b []byte) (int, error) {
+	for {
+		start := time.Now()
+		n, err := t.Transport.Read(b)
+		if n > 0 || (err != nil && err != io.EOF) {
+			return n, err
+		}
+		if atomic.LoadInt32(&t.closed) != 0 || time.Since(start) < t.timeout/2 {
+			return 0, io.EOF
+		}
+	}
+}
+
+func (t *timedReads) Close() error {
+	atomic.StoreInt32(&t.closed, 1)
+	return t.Transport.Close()
+}
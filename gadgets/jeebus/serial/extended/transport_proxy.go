@@ -0,0 +1,30 @@
+package serial
+
+import (
+	"github.com/TheDistractor/goserialproxy" //temp x-platform proxy
+	"github.com/TheDistractor/flow-ext/go-helpers/termios"
+)
+
+func init() {
+	RegisterTransport(SchemeProxy, true, openProxy)
+}
+
+//openProxy opens a local device via goserialproxy, which also works on windows
+func openProxy(address string, opt Options) (Transport, error) {
+	dev, err := goserialproxy.NewSerialProxy(address, goserialproxy.Options{BitRate: opt.BitRate, DataBits: opt.DataBits, StopBits: opt.StopBits})
+	if err != nil {
+		return nil, err
+	}
+
+	if !opt.Line.IsDefault() {
+		if err := termios.Apply(address, opt.Line); err != nil {
+			dev.Close()
+			return nil, err
+		}
+	}
+
+	if opt.Line.ReadTimeout > 0 {
+		return newTimedReads(dev, opt.Line.ReadTimeout), nil
+	}
+	return dev, nil
+}
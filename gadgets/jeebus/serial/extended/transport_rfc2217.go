@@ -0,0 +1,259 @@
+package serial
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"sync"
+
+	"github.com/TheDistractor/flow-ext/go-helpers/termios"
+)
+
+func init() {
+	RegisterTransport(SchemeRFC2217, false, openRFC2217)
+}
+
+//telnet commands and options (RFC 854, 856, 858)
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+
+	optBinary  = 0
+	optSGA     = 3
+	optComPort = 44
+)
+
+//COM-PORT-OPTION client commands (RFC 2217)
+const (
+	cpSetBaudRate = 1
+	cpSetDataSize = 2
+	cpSetParity   = 3
+	cpSetStopSize = 4
+	cpSetControl  = 5
+)
+
+//SET-CONTROL values
+const (
+	controlNoFlow  = 1
+	controlXONXOFF = 2
+	controlRTSCTS  = 3
+	controlDTROn   = 8
+	controlDTROff  = 9
+	controlRTSOn   = 11
+	controlRTSOff  = 12
+)
+
+var rfc2217Parity = map[string]byte{
+	"":                  1,
+	termios.ParityNone:  1,
+	termios.ParityOdd:   2,
+	termios.ParityEven:  3,
+	termios.ParityMark:  4,
+	termios.ParitySpace: 5,
+}
+
+//rfc2217Transport talks to a telnet serial server (such as ser2net) that supports remote COM port control,
+//so baud, parity, flow control and DTR/RTS are all set from our end.
+type rfc2217Transport struct {
+	conn net.Conn
+	r    *bufio.Reader
+	wmu  sync.Mutex //writes come from both .To and negotiation replies
+}
+
+func openRFC2217(address string, opt Options) (Transport, error) {
+	conn, err := net.DialTimeout("tcp", address, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	t := newRFC2217(conn)
+	if err := t.configure(opt); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+func newRFC2217(conn net.Conn) *rfc2217Transport {
+	return &rfc2217Transport{conn: conn, r: bufio.NewReader(conn)}
+}
+
+//configure negotiates binary mode and COM port control, then sends the line settings
+func (t *rfc2217Transport) configure(opt Options) error {
+
+	negotiation := []byte{
+		telnetIAC, telnetWILL, optBinary, telnetIAC, telnetDO, optBinary,
+		telnetIAC, telnetWILL, optSGA, telnetIAC, telnetDO, optSGA,
+		telnetIAC, telnetWILL, optComPort,
+	}
+	if err := t.writeRaw(negotiation); err != nil {
+		return err
+	}
+
+	baud := make([]byte, 4)
+	binary.BigEndian.PutUint32(baud, opt.BitRate)
+
+	stop := byte(1)
+	if opt.StopBits == 2 {
+		stop = 2
+	}
+
+	control := byte(controlNoFlow)
+	if opt.Line.RTSCTS {
+		control = controlRTSCTS
+	} else if opt.Line.XONXOFF {
+		control = controlXONXOFF
+	}
+
+	for _, cmd := range [][]byte{
+		append([]byte{cpSetBaudRate}, baud...),
+		{cpSetDataSize, opt.DataBits},
+		{cpSetParity, rfc2217Parity[opt.Line.Parity]},
+		{cpSetStopSize, stop},
+		{cpSetControl, control},
+	} {
+		if err := t.command(cmd[0], cmd[1:]...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//command sends a COM-PORT-OPTION subnegotiation
+func (t *rfc2217Transport) command(code byte, data ...byte) error {
+	msg := []byte{telnetIAC, telnetSB, optComPort, code}
+	msg = append(msg, escapeIAC(data)...)
+	msg = append(msg, telnetIAC, telnetSE)
+	return t.writeRaw(msg)
+}
+
+func (t *rfc2217Transport) writeRaw(b []byte) error {
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+	_, err := t.conn.Write(b)
+	return err
+}
+
+//escapeIAC doubles any 0xFF so it is not taken as a telnet command
+func escapeIAC(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	for _, c := range b {
+		if c == telnetIAC {
+			out = append(out, telnetIAC)
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+//Write sends serial data, escaped for telnet
+func (t *rfc2217Transport) Write(p []byte) (int, error) {
+	if err := t.writeRaw(escapeIAC(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+//Read provides serial data with the telnet protocol removed
+func (t *rfc2217Transport) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if n > 0 && t.r.Buffered() == 0 {
+			break //return what we have rather than wait
+		}
+
+		b, err := t.r.ReadByte()
+		if err != nil {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+		if b != telnetIAC {
+			p[n] = b
+			n++
+			continue
+		}
+
+		cmd, err := t.r.ReadByte()
+		if err != nil {
+			return n, err
+		}
+
+		switch cmd {
+		case telnetIAC: //escaped 0xFF
+			p[n] = telnetIAC
+			n++
+		case telnetDO, telnetDONT, telnetWILL, telnetWONT:
+			opt, err := t.r.ReadByte()
+			if err != nil {
+				return n, err
+			}
+			if err := t.negotiate(cmd, opt); err != nil {
+				return n, err
+			}
+		case telnetSB: //server notifications (line/modem state etc), we have no use for them
+			if err := t.skipSubnegotiation(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+//negotiate refuses anything the server offers or asks for that we did not ask for ourselves
+func (t *rfc2217Transport) negotiate(cmd, opt byte) error {
+	switch opt {
+	case optBinary, optSGA, optComPort:
+		return nil //our own requests being answered
+	}
+	switch cmd {
+	case telnetDO:
+		return t.writeRaw([]byte{telnetIAC, telnetWONT, opt})
+	case telnetWILL:
+		return t.writeRaw([]byte{telnetIAC, telnetDONT, opt})
+	}
+	return nil
+}
+
+func (t *rfc2217Transport) skipSubnegotiation() error {
+	for {
+		b, err := t.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b != telnetIAC {
+			continue
+		}
+		if b, err = t.r.ReadByte(); err != nil {
+			return err
+		}
+		if b == telnetSE {
+			return nil
+		}
+	}
+}
+
+func (t *rfc2217Transport) SetDTR(on bool) error {
+	if on {
+		return t.command(cpSetControl, controlDTROn)
+	}
+	return t.command(cpSetControl, controlDTROff)
+}
+
+func (t *rfc2217Transport) SetRTS(on bool) error {
+	if on {
+		return t.command(cpSetControl, controlRTSOn)
+	}
+	return t.command(cpSetControl, controlRTSOff)
+}
+
+func (t *rfc2217Transport) Close() error {
+	return t.conn.Close()
+}
@@ -0,0 +1,32 @@
+// +build linux darwin
+
+package serial
+
+import (
+	"github.com/chimera/rs232"
+	"github.com/TheDistractor/flow-ext/go-helpers/termios"
+)
+
+func init() {
+	RegisterTransport(SchemeRS232, true, openRS232)
+}
+
+//openRS232 opens a local device, rs232 only knows 8N1 style settings so the rest is applied to the line once open
+func openRS232(address string, opt Options) (Transport, error) {
+	dev, err := rs232.Open(address, rs232.Options{BitRate: opt.BitRate, DataBits: opt.DataBits, StopBits: opt.StopBits})
+	if err != nil {
+		return nil, err
+	}
+
+	if !opt.Line.IsDefault() {
+		if err := termios.Apply(address, opt.Line); err != nil {
+			dev.Close()
+			return nil, err
+		}
+	}
+
+	if opt.Line.ReadTimeout > 0 {
+		return newTimedReads(dev, opt.Line.ReadTimeout), nil
+	}
+	return dev, nil
+}
@@ -0,0 +1,35 @@
+package serial
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+func init() {
+	RegisterTransport(SchemeTCP, false, openTCP)
+}
+
+//dialTimeout limits how long we wait for a remote serial server
+var dialTimeout = 10 * time.Second
+
+//tcpTransport is a raw socket to a serial server such as ser2net, the line settings live on the server
+type tcpTransport struct {
+	net.Conn
+}
+
+func openTCP(address string, opt Options) (Transport, error) {
+	conn, err := net.DialTimeout("tcp", address, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &tcpTransport{conn}, nil
+}
+
+func (t *tcpTransport) SetDTR(bool) error {
+	return errors.New("tcp: dtr cannot be set over a raw socket, try rfc2217://")
+}
+
+func (t *tcpTransport) SetRTS(bool) error {
+	return errors.New("tcp: rts cannot be set over a raw socket, try rfc2217://")
+}
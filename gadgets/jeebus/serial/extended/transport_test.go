@@ -0,0 +1,174 @@
+package serial
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSplitPort(t *testing.T) {
+	for _, c := range []struct{ port, scheme, address string }{
+		{"/dev/ttyUSB0", "rs232", "/dev/ttyUSB0"},
+		{"COM3", "rs232", "COM3"},
+		{"tcp://pi-garage:4001", "tcp", "pi-garage:4001"},
+		{"rfc2217://pi-garage:4002", "rfc2217", "pi-garage:4002"},
+		{"serialproxy:///dev/ttyACM0", "serialproxy", "/dev/ttyACM0"},
+	} {
+		scheme, address := splitPort(c.port, "rs232")
+		if scheme != c.scheme || address != c.address {
+			t.Errorf("%s: got %s %s", c.port, scheme, address)
+		}
+	}
+
+	if _, _, err := lookupTransport("carrier-pigeon://loft", defaultTransport); err == nil {
+		t.Error("expected an unknown scheme to fail")
+	}
+}
+
+//vtimeDevice reads as a device with VTIME set does: empty (io.EOF from os.File) after each timeout, data once sent
+type vtimeDevice struct {
+	recorder
+	timeout time.Duration
+	data    chan []byte
+}
+
+func (d *vtimeDevice) Read(b []byte) (int, error) {
+	select {
+	case p, ok := <-d.data:
+		if !ok {
+			return 0, io.EOF //hung up, straight away
+		}
+		return copy(b, p), nil
+	case <-time.After(d.timeout):
+		return 0, io.EOF
+	}
+}
+
+func TestTimedReads(t *testing.T) {
+	dev := &vtimeDevice{timeout: 10 * time.Millisecond, data: make(chan []byte)}
+	r := newTimedReads(dev, dev.timeout)
+	go func() {
+		time.Sleep(50 * time.Millisecond) //several empty reads first
+		dev.data <- []byte("OK")
+		close(dev.data)
+	}()
+	b := make([]byte, 8)
+	if n, err := r.Read(b); err != nil || string(b[:n]) != "OK" {
+		t.Errorf("got %q %v", b[:n], err)
+	}
+	if _, err := r.Read(b); err != io.EOF {
+		t.Error("expected a real EOF to come through, got", err)
+	}
+
+	dev = &vtimeDevice{timeout: 10 * time.Millisecond, data: make(chan []byte)}
+	r = newTimedReads(dev, dev.timeout)
+	done := make(chan error)
+	go func() {
+		_, err := r.Read(b)
+		done <- err
+	}()
+	r.Close()
+	select {
+	case err := <-done:
+		if err != io.EOF {
+			t.Error("expected EOF after close, got", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("read kept waiting after close")
+	}
+}
+
+func TestRFC2217(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	tr := newRFC2217(client)
+
+	//the server asks for echo and a terminal type, wraps data around a notification and an escaped 0xFF
+	go server.Write([]byte{
+		'O', 'K',
+		telnetIAC, telnetDO, 1,
+		telnetIAC, telnetSB, optComPort, 107, 0x30, telnetIAC, telnetSE,
+		telnetIAC, telnetIAC,
+		telnetIAC, telnetWILL, 24,
+		'\n',
+	})
+
+	//both refusals must be answered before the rest of the data arrives
+	refusals := make(chan []byte)
+	go func() {
+		buf := make([]byte, 6)
+		io.ReadFull(server, buf)
+		refusals <- buf
+	}()
+
+	got := make([]byte, 0, 4)
+	buf := make([]byte, 16)
+	for len(got) < 4 {
+		n, err := tr.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, buf[:n]...)
+	}
+
+	if want := []byte{'O', 'K', 0xFF, '\n'}; !bytes.Equal(got, want) {
+		t.Errorf("read %v, want %v", got, want)
+	}
+	if want := []byte{telnetIAC, telnetWONT, 1, telnetIAC, telnetDONT, 24}; !bytes.Equal(<-refusals, want) {
+		t.Error("unexpected refusals")
+	}
+
+	//data written is IAC escaped, control lines are subnegotiations
+	go func() {
+		tr.Write([]byte{1, 0xFF, 2})
+		tr.SetDTR(true)
+	}()
+	out := make([]byte, 10)
+	if _, err := io.ReadFull(server, out); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{1, 0xFF, 0xFF, 2, telnetIAC, telnetSB, optComPort, cpSetControl, controlDTROn, telnetIAC}
+	if !bytes.Equal(out, want) {
+		t.Errorf("wrote %v, want %v", out, want)
+	}
+}
+
+func TestCaptureFormat(t *testing.T) {
+	at := time.Date(2014, 4, 30, 1, 2, 3, 537412000, time.Local)
+	for _, c := range []struct {
+		r    CaptureRecord
+		line string
+	}{
+		{CaptureRecord{at, "/dev/ttyUSB0", CaptureRead, []byte("OK 9 25 54 66")}, `L 01:02:03.537412 /dev/ttyUSB0 OK 9 25 54 66`},
+		{CaptureRecord{at, "/dev/ttyUSB0", CaptureRead, []byte("OK 9 \xff\r")}, `< 01:02:03.537412 /dev/ttyUSB0 "OK 9 \xff\r"`},
+		{CaptureRecord{at, "/dev/ttyUSB0", CaptureWrite, []byte("v\n")}, `> 01:02:03.537412 /dev/ttyUSB0 "v\n"`},
+		{CaptureRecord{at, "/dev/ttyUSB0", CaptureEvent, []byte("connected")}, `* 01:02:03.537412 /dev/ttyUSB0 "connected"`},
+		{CaptureRecord{at, "/dev/ttyUSB0", CaptureRead, []byte{}}, `L 01:02:03.537412 /dev/ttyUSB0 `},
+	} {
+		line := FormatCapture(c.r)
+		if line != c.line {
+			t.Errorf("got %s, want %s", line, c.line)
+			continue
+		}
+		r, err := ParseCapture(at, line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !r.Time.Equal(at) || r.Port != c.r.Port || r.Dir != c.r.Dir || string(r.Data) != string(c.r.Data) {
+			t.Error("round trip gave", r)
+		}
+	}
+
+	//the housemon logger's own lines read back as what the device sent
+	r, err := ParseCapture(at, "L 01:02:03.537 usb-A40117UK OK 9 25")
+	if err != nil || r.Time.Nanosecond() != 537000000 || r.Port != "usb-A40117UK" || r.Dir != CaptureRead || string(r.Data) != "OK 9 25" {
+		t.Error("logger line gave", r, err)
+	}
+	if _, err := ParseCapture(at, "OK 9 25"); err == nil {
+		t.Error("expected a bare line to be refused")
+	}
+}
@@ -1,12 +1,7 @@
-// +build linux darwin
-
-// Interface to serial port devices (only Linux and Mac OSX).
+// Interface to serial port devices, local or across the network.
 package serial
 
 import (
-	"bufio"
-	"time"
-	"github.com/chimera/rs232"
 	"github.com/jcw/flow"
 	serialex "github.com/TheDistractor/flow-ext/gadgets/jeebus/serial/extended"
 
@@ -15,4 +10,5 @@ import (
 //Automatic addition to flow registry
 func init() {
 	flow.Registry["SerialPortEx"] = func() flow.Circuitry { return new(serialex.SerialPort) }
+	flow.Registry["SerialPorts"] = func() flow.Circuitry { return new(serialex.SerialPorts) }
 }
@@ -14,7 +14,8 @@ import (
 
 //Automatically override the standard SerialPort from core with Extended version from this package
 func init() {
-	flow.Registry["SerialPort"] = func() flow.Circuitry { return new(serialex.SerialPort) }
+	flow.Registry["SerialPort"] = func() flow.Circuitry { return serialex.New() }
+	flow.Registry["SerialPorts"] = func() flow.Circuitry { return new(serialex.SerialPorts) }
 }
 
 
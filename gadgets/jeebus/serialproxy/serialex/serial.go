@@ -11,5 +11,6 @@ import (
 
 //Automatic addition to flow registry
 func init() {
-	flow.Registry["SerialPortEx"] = func() flow.Circuitry { return new(serialex.SerialPort) }
+	flow.Registry["SerialPortEx"] = func() flow.Circuitry { return serialex.New() }
+	flow.Registry["SerialPorts"] = func() flow.Circuitry { return new(serialex.SerialPorts) }
 }
@@ -0,0 +1,24 @@
+//Package extmqtt registers the extended MQTT Gadgets: MQTTSubEx and MQTTPubEx, alongside MQTTServerEx,
+//MQTTBridge, MQTTTestBroker and StateStore (from mqtt/mqttex). The core MQTTServer, MQTTSub and MQTTPub are left as they are.
+//
+//Usage:
+//
+// 	_ "github.com/TheDistractor/flow-ext/gadgets/network/extmqtt"
+package extmqtt
+
+import (
+
+	"github.com/golang/glog"
+	"github.com/jcw/flow"
+	mqttex "github.com/TheDistractor/flow-ext/gadgets/network/mqtt/extended"
+	_ "github.com/TheDistractor/flow-ext/gadgets/network/mqtt/mqttex"
+
+)
+
+func init() {
+	if glog.V(2) {
+		glog.Infoln("Loading MQTTSubEx and MQTTPubEx into Registry...")
+	}
+	flow.Registry["MQTTSubEx"] = func() flow.Circuitry { return &mqttex.MQTTSubEx{} }
+	flow.Registry["MQTTPubEx"] = func() flow.Circuitry { return &mqttex.MQTTPubEx{} }
+}
@@ -0,0 +1,378 @@
+package network
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jcw/flow"
+	"github.com/TheDistractor/flow-ext/go-helpers/passwd"
+)
+
+//how long a good basic password is remembered, so a client sending it with every request costs one PBKDF2 rather
+//than one per request
+var PasswordCache = 5 * time.Minute
+
+//Identity is who a request was authenticated as, and how: "cert", "basic" or "token"
+type Identity struct {
+	Name   string
+	Method string
+}
+
+//authenticator checks requests against the auth rules of a HTTPServer. Paths and protocols without a rule are
+//open to anyone, as they were before there were rules.
+type authenticator struct {
+	sync.Mutex
+	clientCA  *x509.CertPool
+	passwords map[string]string               //name -> hash
+	dummy     string                          //checked for unknown names, so they take as long as a wrong password
+	good      map[[sha256.Size]byte]time.Time //sha256 of name:password -> when to check it again
+	tokens    map[string]string               //hex sha256 of the token -> name
+	paths     map[string][]string
+	protocols map[string][]string
+	labelled  map[string]bool //protocols whose circuit has a pin labelled Identity, as their rule says
+}
+
+func newAuthenticator() *authenticator {
+	return &authenticator{good: map[[sha256.Size]byte]time.Time{}, paths: map[string][]string{}, protocols: map[string][]string{},
+		labelled: map[string]bool{}}
+}
+
+//apply takes one of the auth params, ok is false for a param that is not one of them
+func (a *authenticator) apply(p flow.Tag) (bool, error) {
+	switch p.Tag {
+	case "clientca", "passwords", "tokens":
+		file, ok := p.Msg.(string)
+		if !ok || file == "" {
+			return true, fmt.Errorf("%s must be a file name, got:%v", p.Tag, p.Msg)
+		}
+		var err error
+		switch p.Tag {
+		case "clientca":
+			err = a.loadClientCA(file)
+		case "passwords":
+			a.passwords, err = passwd.Load(file)
+			for _, hash := range a.passwords {
+				a.dummy = hash
+				break
+			}
+		case "tokens":
+			a.tokens, err = loadTokens(file)
+		}
+		return true, err
+	case "auth":
+		return true, a.addRule(p.Msg)
+	}
+	return false, nil
+}
+
+func (a *authenticator) loadClientCA(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	a.clientCA = x509.NewCertPool()
+	if !a.clientCA.AppendCertsFromPEM(data) {
+		return fmt.Errorf("no certificates in clientca:%s", file)
+	}
+	return nil
+}
+
+//loadTokens reads a file of name:sha256 lines, the sha256 of the token in hex (as sha256sum gives it)
+func loadTokens(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tokens := map[string]string{}
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		i := strings.Index(line, ":")
+		sum := strings.ToLower(line[i+1:])
+		if b, err := hex.DecodeString(sum); i < 1 || err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("%s:%d: expected name:sha256", file, n)
+		}
+		tokens[sum] = line[:i]
+	}
+	return tokens, s.Err()
+}
+
+//addRule takes {path: "/ws", with: "token"} or {protocol: "admin", with: ["cert", "basic"]}, any one of the
+//methods given lets a request in. A protocol rule with identity: true promises a circuit with a pin labelled Identity.
+func (a *authenticator) addRule(m flow.Message) error {
+	rule, _ := m.(map[string]interface{})
+	var with []string
+	switch v := rule["with"].(type) {
+	case string:
+		with = strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ' ' })
+	case []interface{}:
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				with = append(with, s)
+			}
+		}
+	}
+	if len(with) == 0 {
+		return fmt.Errorf("auth needs a path or protocol and the methods to allow, got:%v", m)
+	}
+	for _, w := range with {
+		if w != "cert" && w != "basic" && w != "token" {
+			return fmt.Errorf("unknown auth method:%s", w)
+		}
+	}
+
+	path, isPath := rule["path"].(string)
+	protocol, isProtocol := rule["protocol"].(string)
+	identity, _ := rule["identity"].(bool)
+	switch {
+	case isPath && !isProtocol && path != "":
+		if identity {
+			return fmt.Errorf("identity goes with a protocol rule, got:%v", m)
+		}
+		a.paths[path] = with
+	case isProtocol && !isPath && protocol != "":
+		a.protocols[protocol] = with
+		a.labelled[protocol] = identity
+	default:
+		return fmt.Errorf("auth needs either a path or a protocol, got:%v", m)
+	}
+	return nil
+}
+
+//check is called once all params are in, each method used needs its file (and client certificates need https)
+func (a *authenticator) check(https bool) error {
+	if a.clientCA != nil && !https {
+		return fmt.Errorf("clientca needs https, i.e. certfile and certkey")
+	}
+	for _, rules := range []map[string][]string{a.paths, a.protocols} {
+		for what, with := range rules {
+			for _, m := range with {
+				switch {
+				case m == "cert" && a.clientCA == nil:
+					return fmt.Errorf("auth for %s uses cert but there is no clientca", what)
+				case m == "basic" && a.passwords == nil:
+					return fmt.Errorf("auth for %s uses basic but there is no passwords file", what)
+				case m == "token" && a.tokens == nil:
+					return fmt.Errorf("auth for %s uses token but there is no tokens file", what)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+//methods lists the credentials worth checking on a path: those its rule allows, and for a websocket those of any
+//protocol rule as well
+func (a *authenticator) methods(path string, socket bool) []string {
+	var methods []string
+	add := func(with []string) {
+		for _, m := range with {
+			if !uses(methods, m) {
+				methods = append(methods, m)
+			}
+		}
+	}
+	add(a.paths[path])
+	if socket {
+		for _, with := range a.protocols {
+			add(with)
+		}
+	}
+	return methods
+}
+
+func uses(with []string, method string) bool {
+	for _, m := range with {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+//identify gives every identity a request has valid credentials for, of the methods given: cert, then basic, then token
+func (a *authenticator) identify(r *http.Request, methods []string) []Identity {
+	var ids []Identity
+	if uses(methods, "cert") && a.clientCA != nil && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		ids = append(ids, Identity{r.TLS.VerifiedChains[0][0].Subject.CommonName, "cert"})
+	}
+	if name, pw, ok := r.BasicAuth(); ok && uses(methods, "basic") && a.passwords != nil && a.password(name, pw) {
+		ids = append(ids, Identity{name, "basic"})
+	}
+	if !uses(methods, "token") {
+		return ids
+	}
+	//browsers can't set headers on a websocket, so the token may also come as ?access_token= (as RFC 6750 allows)
+	token := r.URL.Query().Get("access_token")
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token = strings.TrimPrefix(h, "Bearer ")
+	}
+	if token != "" && a.tokens != nil {
+		sum := sha256.Sum256([]byte(token))
+		if name, found := a.tokens[hex.EncodeToString(sum[:])]; found {
+			ids = append(ids, Identity{name, "token"})
+		}
+	}
+	return ids
+}
+
+//password checks a basic password, remembering good ones for PasswordCache. An unknown name is checked against some
+//other hash all the same, so how long it takes does not tell which names exist.
+func (a *authenticator) password(name, pw string) bool {
+	key := sha256.Sum256([]byte(name + ":" + pw))
+	now := time.Now()
+	a.Lock()
+	until, found := a.good[key]
+	if found && !now.Before(until) {
+		delete(a.good, key)
+		found = false
+	}
+	a.Unlock()
+	if found {
+		return true
+	}
+
+	hash, known := a.passwords[name]
+	if !known {
+		hash = a.dummy
+	}
+	if !passwd.Check(hash, pw) || !known {
+		return false
+	}
+	a.Lock()
+	defer a.Unlock()
+	for k, t := range a.good {
+		if !now.Before(t) {
+			delete(a.good, k)
+		}
+	}
+	a.good[key] = now.Add(PasswordCache)
+	return true
+}
+
+//pick gives the first identity a rule allows
+func pick(ids []Identity, with []string) (*Identity, bool) {
+	for i := range ids {
+		for _, m := range with {
+			if ids[i].Method == m {
+				return &ids[i], true
+			}
+		}
+	}
+	return nil, false
+}
+
+type identitiesKey struct{}
+
+//identities gives what identify found for a request, as stored by wrap
+func identities(r *http.Request) []Identity {
+	ids, _ := r.Context().Value(identitiesKey{}).([]Identity)
+	return ids
+}
+
+//wrap puts the auth rule of a handler path in front of its handler, a websocket's protocols may have rules too.
+//Requests to a path no rule cares about go straight through, without looking at their credentials.
+func (a *authenticator) wrap(path string, h http.Handler, socket bool) http.Handler {
+	methods := a.methods(path, socket)
+	if len(methods) == 0 {
+		return h
+	}
+	with := a.paths[path]
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ids := a.identify(r, methods)
+		if with != nil {
+			if _, ok := pick(ids, with); !ok {
+				challenge(w, with)
+				return
+			}
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identitiesKey{}, ids)))
+	})
+}
+
+//challenge turns a request away, telling the client which credentials would do
+func challenge(w http.ResponseWriter, with []string) {
+	for _, m := range with {
+		switch m {
+		case "basic":
+			w.Header().Add("WWW-Authenticate", `Basic realm="flow", charset="UTF-8"`)
+		case "token":
+			w.Header().Add("WWW-Authenticate", `Bearer realm="flow"`)
+		}
+	}
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
+
+//protocol picks the first WebSocket-<protocol> circuit the client offered that exists and that it may use,
+//"" for the default one
+func (a *authenticator) protocol(offered []string, r *http.Request) (string, error) {
+	refused := false
+	for _, v := range offered {
+		if flow.Registry["WebSocket-"+v] == nil {
+			continue
+		}
+		if with := a.protocols[v]; with != nil {
+			if _, ok := pick(identities(r), with); !ok {
+				refused = true
+				continue
+			}
+		}
+		return v, nil
+	}
+	if with := a.protocols["default"]; with != nil {
+		if _, ok := pick(identities(r), with); !ok {
+			refused = true
+		}
+	}
+	if refused {
+		return "", fmt.Errorf("not authorized for:%v", offered)
+	}
+	return "", nil
+}
+
+//identity is the one handed to the circuit of a websocket: the one its protocol's rule allowed, else the first one
+func (a *authenticator) identity(protocol string, r *http.Request) *Identity {
+	ids := identities(r)
+	if id, ok := pick(ids, a.protocols[protocol]); ok {
+		return id
+	}
+	if len(ids) > 0 {
+		return &ids[0]
+	}
+	return nil
+}
+
+//takesIdentity tells whether the circuitry of a websocket can be told who connected: a gadget with an Identity input,
+//or a circuit whose protocol rule says it has a pin labelled Identity (flow has no way to ask a circuit for its pins)
+func (a *authenticator) takesIdentity(protocol string, c flow.Circuitry) bool {
+	if _, ok := c.(*flow.Circuit); ok {
+		return a.labelled[protocol]
+	}
+	return hasInput(c, "Identity")
+}
+
+//hasInput tells whether a gadget has an input pin by that name
+func hasInput(c flow.Circuitry, pin string) bool {
+	v := reflect.ValueOf(c)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return false
+	}
+	f := v.Elem().FieldByName(pin)
+	return f.IsValid() && f.Type() == reflect.TypeOf((*flow.Input)(nil)).Elem()
+}
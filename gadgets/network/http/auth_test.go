@@ -0,0 +1,334 @@
+package network
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.net/websocket"
+	"github.com/jcw/flow"
+	"github.com/TheDistractor/flow-ext/go-helpers/passwd"
+)
+
+//clientCert makes a CA in dir and a client certificate for name signed by it, giving the clientca file
+func clientCert(t *testing.T, dir, name string) (string, tls.Certificate) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "flow test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDer}), 0644)
+
+	priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &priv.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return caFile, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}
+}
+
+//authFiles writes a passwords file with jcw:secret and a tokens file with the token "s3cr3t" for bot
+func authFiles(t *testing.T, dir string) []flow.Tag {
+	h, _ := passwd.Hash("secret")
+	sum := sha256.Sum256([]byte("s3cr3t"))
+	passwords, tokens := filepath.Join(dir, "passwords"), filepath.Join(dir, "tokens")
+	ioutil.WriteFile(passwords, []byte("jcw:"+h+"\n"), 0600)
+	ioutil.WriteFile(tokens, []byte("# bots\nbot:"+hex.EncodeToString(sum[:])+"\n"), 0600)
+	return []flow.Tag{{"passwords", passwords}, {"tokens", tokens}}
+}
+
+//whoami tells a websocket client who it is, then echoes
+type whoami struct {
+	flow.Gadget
+	Identity flow.Input
+	In       flow.Input
+	Out      flow.Output
+}
+
+func (w *whoami) Run() {
+	w.Out.Send(<-w.Identity)
+	for m := range w.In {
+		w.Out.Send(m)
+	}
+}
+
+func TestHasInput(t *testing.T) {
+	if !hasInput(new(whoami), "Identity") || hasInput(new(echo), "Identity") || hasInput(new(whoami), "Out") {
+		t.Error("wrong pins")
+	}
+
+	//a circuit (as loaded from JSON) can't be looked into, its rule has to say it has an Identity pin
+	a := newAuthenticator()
+	a.addRule(map[string]interface{}{"protocol": "plain", "with": "token"})
+	a.addRule(map[string]interface{}{"protocol": "labelled", "with": "token", "identity": true})
+	if a.takesIdentity("plain", flow.NewCircuit()) || !a.takesIdentity("labelled", flow.NewCircuit()) {
+		t.Error("circuit taken to have an Identity pin regardless of its rule")
+	}
+	if !a.takesIdentity("plain", new(whoami)) || a.takesIdentity("labelled", new(echo)) {
+		t.Error("a gadget has an Identity input or not, whatever the rule says")
+	}
+}
+
+func TestAuth(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "http")
+	defer os.RemoveAll(dir)
+	caFile, cert := clientCert(t, dir, "sensor-1")
+	params := append(writeCert(t, dir), authFiles(t, dir)...)
+	params = append(params, flow.Tag{"clientca", caFile},
+		flow.Tag{"auth", map[string]interface{}{"path": "/basic", "with": "basic"}},
+		flow.Tag{"auth", map[string]interface{}{"path": "/machines", "with": []interface{}{"cert", "token"}}},
+	)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "ok") })
+	s := startServerWith("127.0.0.1:0", nil, params,
+		flow.Tag{"/basic", ok}, flow.Tag{"/machines", ok}, flow.Tag{"/open", ok})
+	uri := s.ready(t)
+
+	withCert := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		InsecureSkipVerify: true, Certificates: []tls.Certificate{cert}}}}
+	status := func(c *http.Client, path string, set func(*http.Request)) *http.Response {
+		req, _ := http.NewRequest("GET", uri+path, nil)
+		if set != nil {
+			set(req)
+		}
+		r, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+		return r
+	}
+	basic := func(pw string) func(*http.Request) {
+		return func(r *http.Request) { r.SetBasicAuth("jcw", pw) }
+	}
+	bearer := func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cr3t") }
+
+	if r := status(insecure, "/open", nil); r.StatusCode != 200 {
+		t.Error("a path without a rule should be open", r.Status)
+	}
+	if r := status(insecure, "/basic", nil); r.StatusCode != 401 || !strings.HasPrefix(r.Header.Get("WWW-Authenticate"), "Basic") {
+		t.Error("expected a basic challenge", r.Status, r.Header)
+	}
+	if r := status(insecure, "/basic", basic("wrong")); r.StatusCode != 401 {
+		t.Error("wrong password let in", r.Status)
+	}
+	if r := status(insecure, "/basic", basic("secret")); r.StatusCode != 200 {
+		t.Error("right password refused", r.Status)
+	}
+	if r := status(insecure, "/basic", bearer); r.StatusCode != 401 {
+		t.Error("a token is not a password", r.Status)
+	}
+	if r := status(insecure, "/machines", basic("secret")); r.StatusCode != 401 || r.Header.Get("WWW-Authenticate") != `Bearer realm="flow"` {
+		t.Error("a password is not a token or certificate", r.Status, r.Header)
+	}
+	if r := status(insecure, "/machines", bearer); r.StatusCode != 200 {
+		t.Error("token refused", r.Status)
+	}
+	if r := status(insecure, "/machines?access_token=s3cr3t", nil); r.StatusCode != 200 {
+		t.Error("token as parameter refused", r.Status)
+	}
+	if r := status(withCert, "/machines", nil); r.StatusCode != 200 {
+		t.Error("client certificate refused", r.Status)
+	}
+
+	//only requests let in are sent on, without their token
+	for _, want := range []string{"/open", "/basic", "/machines", "/machines", "/machines"} {
+		if u, ok := s.out.Next(t).(*url.URL); !ok || u.Path != want || u.RawQuery != "" {
+			t.Errorf("expected %s, got %v", want, u)
+		}
+	}
+	if len(s.out) != 0 {
+		t.Error("refused request sent on", <-s.out)
+	}
+	if len(s.errs) != 0 {
+		t.Error("unexpected error", <-s.errs)
+	}
+}
+
+func TestIdentifyMethods(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "http")
+	defer os.RemoveAll(dir)
+	a := newAuthenticator()
+	for _, p := range authFiles(t, dir) {
+		if _, err := a.apply(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, _ := http.NewRequest("GET", "/open?access_token=s3cr3t", nil)
+	r.SetBasicAuth("jcw", "secret")
+	if ids := a.identify(r, nil); len(ids) != 0 {
+		t.Error("credentials checked when no rule asks for them", ids)
+	}
+	if ids := a.identify(r, []string{"token"}); len(ids) != 1 || ids[0] != (Identity{"bot", "token"}) {
+		t.Error("expected only the token checked, got", ids)
+	}
+	if ids := a.identify(r, []string{"token", "basic"}); len(ids) != 2 || ids[0] != (Identity{"jcw", "basic"}) {
+		t.Error("expected basic then token, got", ids)
+	}
+}
+
+func TestPasswordCache(t *testing.T) {
+	h, _ := passwd.Hash("secret")
+	a := newAuthenticator()
+	a.passwords, a.dummy = map[string]string{"jcw": h}, h
+	if a.password("nobody", "secret") || a.password("jcw", "wrong") {
+		t.Error("let in")
+	}
+	if !a.password("jcw", "secret") {
+		t.Fatal("right password refused")
+	}
+
+	a.passwords["jcw"] = "pbkdf2-sha256$1$AA$AA" //nothing matches this, but a remembered password isn't checked again
+	if !a.password("jcw", "secret") {
+		t.Error("good password not remembered")
+	}
+	a.good[sha256.Sum256([]byte("jcw:secret"))] = time.Now()
+	if a.password("jcw", "secret") {
+		t.Error("password remembered for too long")
+	}
+	if len(a.good) != 0 {
+		t.Error("expired entry kept", a.good)
+	}
+}
+
+func TestWebsocketAuth(t *testing.T) {
+	flow.Registry["WebSocket-whoami"] = func() flow.Circuitry { return new(whoami) }
+	flow.Registry["WebSocket-httptest"] = func() flow.Circuitry { return new(echo) }
+	flow.Registry["WebSocket-anonymous"] = func() flow.Circuitry { return new(echo) }
+	dir, _ := ioutil.TempDir("", "http")
+	defer os.RemoveAll(dir)
+	params := append(writeCert(t, dir), authFiles(t, dir)...)
+	params = append(params, flow.Tag{"auth", map[string]interface{}{"protocol": "whoami", "with": "token,basic"}},
+		flow.Tag{"auth", map[string]interface{}{"protocol": "anonymous", "with": "token"}})
+	s := startServerWith("127.0.0.1:0", nil, params, flow.Tag{"/ws", "<websocket>"})
+	uri := s.ready(t)
+
+	dial := func(query string, protocols ...string) (*websocket.Conn, error) {
+		cfg, _ := websocket.NewConfig("wss"+strings.TrimPrefix(uri, "https")+"/ws"+query, uri)
+		cfg.Protocol = protocols
+		cfg.TlsConfig = &tls.Config{InsecureSkipVerify: true}
+		return websocket.DialConfig(cfg)
+	}
+
+	if _, err := dial("", "whoami"); err == nil {
+		t.Error("protocol should need a token")
+	}
+	ws, err := dial("", "whoami", "httptest") //falls back to what it may use
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ws.Config().Protocol[0] != "httptest" {
+		t.Error("unexpected protocol", ws.Config().Protocol)
+	}
+	ws.Close()
+
+	ws, err = dial("?access_token=s3cr3t", "whoami")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	var id map[string]interface{}
+	ws.SetReadDeadline(time.Now().Add(wait))
+	if err := websocket.JSON.Receive(ws, &id); err != nil || id["name"] != "bot" || id["method"] != "token" {
+		t.Error("identity not passed on", id, err)
+	}
+
+	//a protocol whose circuit can't be told who connected still works, but says so (once)
+	for i := 0; i < 2; i++ {
+		ws, err := dial("?access_token=s3cr3t", "anonymous")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m interface{}
+		websocket.JSON.Send(ws, map[string]interface{}{"n": i})
+		ws.SetReadDeadline(time.Now().Add(wait))
+		if err := websocket.JSON.Receive(ws, &m); err != nil {
+			t.Error("not echoed", err)
+		}
+		ws.Close()
+	}
+	if m := s.errs.Next(t); !strings.Contains(m.(string), "anonymous") || !strings.Contains(m.(string), "takes no identity") {
+		t.Error("unexpected error", m)
+	}
+	if len(s.errs) != 0 {
+		t.Error("reported again", <-s.errs)
+	}
+}
+
+func TestAuthConfigErrors(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "http")
+	defer os.RemoveAll(dir)
+	cert := writeCert(t, dir)
+	caFile, _ := clientCert(t, dir, "x")
+
+	for _, c := range []struct {
+		params []flow.Tag
+		want   string
+	}{
+		{[]flow.Tag{{"auth", map[string]interface{}{"path": "/", "with": "basic"}}}, "no passwords file"},
+		{[]flow.Tag{{"auth", map[string]interface{}{"path": "/", "with": "magic"}}}, "unknown auth method"},
+		{[]flow.Tag{{"auth", map[string]interface{}{"with": "basic"}}}, "either a path or a protocol"},
+		{[]flow.Tag{{"auth", "/ basic"}}, "needs a path or protocol"},
+		{[]flow.Tag{{"auth", map[string]interface{}{"path": "/", "with": "basic", "identity": true}}}, "protocol rule"},
+		{[]flow.Tag{{"clientca", caFile}}, "clientca needs https"},
+		{append(cert, flow.Tag{"auth", map[string]interface{}{"path": "/", "with": "cert"}}), "no clientca"},
+		{[]flow.Tag{{"passwords", filepath.Join(dir, "missing")}}, "no such file"},
+		{[]flow.Tag{{"clientca", filepath.Join(dir, "key.pem")}}, "no certificates"},
+	} {
+		s := startServerWith("127.0.0.1:0", nil, c.params, flow.Tag{"/", http.NotFoundHandler()})
+		if m := s.errs.Next(t); !strings.Contains(m.(string), c.want) {
+			t.Errorf("expected %q, got %v", c.want, m)
+		}
+		s.stopped(t)
+	}
+
+	//a rule for a path nobody serves is most likely a typo, which would leave the real path open
+	params := append(authFiles(t, dir), flow.Tag{"auth", map[string]interface{}{"path": "/admn", "with": "basic"}})
+	s := startServerWith("127.0.0.1:0", nil, params, flow.Tag{"/admin", http.NotFoundHandler()})
+	if m := s.errs.Next(t); !strings.Contains(m.(string), "no such handler") {
+		t.Error("unexpected error", m)
+	}
+	s.stopped(t)
+}
+
+func TestLoadTokens(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "http")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "tokens")
+	ioutil.WriteFile(file, []byte("bot:s3cr3t\n"), 0600) //not hashed
+	if _, err := loadTokens(file); err == nil || !strings.Contains(err.Error(), ":1:") {
+		t.Error("expected an error, got", err)
+	}
+}
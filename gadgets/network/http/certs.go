@@ -0,0 +1,254 @@
+package network
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/jcw/flow"
+)
+
+//how often the certificate files are checked for changes, unless the certreload param says otherwise
+var DefaultCertReload = 10 * time.Second
+
+//how long a generated self-signed certificate is valid
+var selfSignedFor = 365 * 24 * time.Hour
+
+//certs holds the certificate a HTTPServer hands out, reloading it when its files change so a renewal needs no
+//restart (and drops no websockets)
+type certs struct {
+	certFile string
+	keyFile  string
+
+	sync.RWMutex
+	cert  *tls.Certificate
+	stamp string //sizes and mod times of the files last loaded (or tried)
+}
+
+//loadCerts loads the pair, failing if it can't
+func loadCerts(certFile, keyFile string) (*certs, error) {
+	c := &certs{certFile: certFile, keyFile: keyFile}
+	return c, c.reload()
+}
+
+//fileStamp tells whether the files have changed without reading them
+func (c *certs) fileStamp() string {
+	s := ""
+	for _, f := range []string{c.certFile, c.keyFile} {
+		if fi, err := os.Stat(f); err == nil {
+			s += fmt.Sprintf("%d/%d;", fi.Size(), fi.ModTime().UnixNano())
+		} else {
+			s += "missing;"
+		}
+	}
+	return s
+}
+
+func (c *certs) reload() error {
+	stamp := c.fileStamp()
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+
+	c.Lock()
+	defer c.Unlock()
+	c.stamp = stamp
+	if err != nil {
+		return err
+	}
+	c.cert = &cert
+	return nil
+}
+
+//GetCertificate is used by the tls.Config, so each new connection gets the current certificate
+func (c *certs) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.cert, nil
+}
+
+//tlsConfig gives a tls.Config serving these certificates
+func (c *certs) tlsConfig() *tls.Config {
+	return &tls.Config{GetCertificate: c.GetCertificate}
+}
+
+//watch checks the files every so often until stop is closed. A pair that doesn't load, e.g. when only one of
+//the files has been renewed so far, is reported and the old certificate stays in use until the next change.
+func (c *certs) watch(every time.Duration, stop chan struct{}, fail func(error)) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			c.RLock()
+			same := c.fileStamp() == c.stamp
+			c.RUnlock()
+			if same {
+				continue
+			}
+			if err := c.reload(); err != nil {
+				fail(fmt.Errorf("keeping the old certificate: %v", err))
+			} else {
+				glog.Infoln("reloaded certificate:", c.certFile)
+			}
+		}
+	}
+}
+
+//hostList takes the selfsigned param, either a string such as "localhost, 192.168.1.10" or a list of strings
+func hostList(m flow.Message) ([]string, error) {
+	var hosts []string
+	switch v := m.(type) {
+	case string:
+		hosts = strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ' ' })
+	case []interface{}:
+		for _, h := range v {
+			s, ok := h.(string)
+			if !ok || s == "" {
+				return nil, fmt.Errorf("selfsigned hosts must be strings, got:%v", h)
+			}
+			hosts = append(hosts, s)
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("selfsigned needs a list of hosts, got:%v", m)
+	}
+	return hosts, nil
+}
+
+//selfSignedFiles is where a self-signed certificate is kept when no certfile and certkey are given
+func selfSignedFiles() (string, string) {
+	dir := flow.Config["DATA_DIR"]
+	if dir == "" {
+		dir = "."
+	}
+	return filepath.Join(dir, "selfsigned-cert.pem"), filepath.Join(dir, "selfsigned-key.pem")
+}
+
+//selfSigned makes sure there is a certificate for hosts in certFile/keyFile. One is generated when there are no
+//files yet, or when the self-signed one there has expired, does not cover every host or is a CA. Files that don't load, or
+//hold a certificate someone else signed, are left alone.
+func selfSigned(certFile, keyFile string, hosts []string) error {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		return writeSelfSigned(certFile, keyFile, hosts)
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	leaf, err := parseLeaf(&cert)
+	if err != nil {
+		return err
+	}
+	if leaf.CheckSignature(leaf.SignatureAlgorithm, leaf.RawTBSCertificate, leaf.Signature) != nil {
+		return nil //not ours
+	}
+	//earlier ones were made a CA, which nobody should be trusting
+	fresh := !leaf.IsCA && time.Now().Add(24*time.Hour).Before(leaf.NotAfter)
+	for _, h := range hosts {
+		if leaf.VerifyHostname(h) != nil {
+			fresh = false
+		}
+	}
+	if fresh {
+		return nil
+	}
+	glog.Infoln("renewing self-signed certificate:", certFile)
+	return writeSelfSigned(certFile, keyFile, hosts)
+}
+
+func writeSelfSigned(certFile, keyFile string, hosts []string) error {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"flow-ext HTTPServer"}, CommonName: hosts[0]},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedFor),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true, //and not a CA: trusting it must not mean trusting whatever its key signs
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return err
+	}
+
+	if err := writeAtomic(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return err
+	}
+	if err := writeAtomic(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return err
+	}
+	glog.Infoln("generated self-signed certificate for", hosts, "in", certFile)
+	return nil
+}
+
+//writeAtomic replaces a file in one go, so nobody reads half of it
+func writeAtomic(name string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) //a no-op once renamed
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+//parseLeaf gives the certificate itself, the first of the chain
+func parseLeaf(cert *tls.Certificate) (*x509.Certificate, error) {
+	if cert == nil || len(cert.Certificate) == 0 {
+		return nil, fmt.Errorf("no certificate")
+	}
+	return x509.ParseCertificate(cert.Certificate[0])
+}
@@ -0,0 +1,164 @@
+package network
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jcw/flow"
+)
+
+func TestHostList(t *testing.T) {
+	if h, err := hostList("localhost, 192.168.1.10,housemon.local"); err != nil || len(h) != 3 || h[1] != "192.168.1.10" {
+		t.Error("unexpected hosts", h, err)
+	}
+	if h, err := hostList([]interface{}{"localhost", "::1"}); err != nil || len(h) != 2 {
+		t.Error("unexpected hosts", h, err)
+	}
+	for _, bad := range []flow.Message{"", " , ", []interface{}{1.0}, true} {
+		if _, err := hostList(bad); err == nil {
+			t.Error("expected an error for", bad)
+		}
+	}
+}
+
+func TestSelfSigned(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "http")
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "new", "cert.pem"), filepath.Join(dir, "new", "key.pem")
+
+	if err := selfSigned(certFile, keyFile, []string{"localhost", "127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := ioutil.ReadFile(certFile)
+	if fi, err := os.Stat(keyFile); err != nil || fi.Mode().Perm() != 0600 {
+		t.Error("key not private", err)
+	}
+
+	//kept while it covers the hosts
+	selfSigned(certFile, keyFile, []string{"127.0.0.1"})
+	if again, _ := ioutil.ReadFile(certFile); !bytes.Equal(first, again) {
+		t.Error("certificate regenerated without need")
+	}
+
+	selfSigned(certFile, keyFile, []string{"localhost", "housemon.local"})
+	c, err := loadCerts(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := c.GetCertificate(nil)
+	leaf, _ := parseLeaf(cert)
+	if leaf == nil || leaf.VerifyHostname("housemon.local") != nil {
+		t.Fatal("new host not covered")
+	}
+	if leaf.IsCA || leaf.KeyUsage&x509.KeyUsageCertSign != 0 || len(leaf.ExtKeyUsage) != 1 || leaf.ExtKeyUsage[0] != x509.ExtKeyUsageServerAuth {
+		t.Error("expected a server certificate that can't sign others", leaf.IsCA, leaf.KeyUsage, leaf.ExtKeyUsage)
+	}
+
+	//one made a CA (as they used to be) is replaced
+	priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(48 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, ca, ca, &priv.PublicKey, priv)
+	keyDer, _ := x509.MarshalECPrivateKey(priv)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err := selfSigned(certFile, keyFile, []string{"localhost"}); err != nil {
+		t.Fatal(err)
+	}
+	if c, err = loadCerts(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	cert, _ = c.GetCertificate(nil)
+	if leaf, _ = parseLeaf(cert); leaf == nil || leaf.IsCA {
+		t.Error("CA not replaced")
+	}
+
+	//someone else's files are not overwritten
+	ioutil.WriteFile(certFile, []byte("not a certificate"), 0644)
+	if err := selfSigned(certFile, keyFile, []string{"localhost"}); err == nil {
+		t.Error("expected an error")
+	}
+	if b, _ := ioutil.ReadFile(certFile); string(b) != "not a certificate" {
+		t.Error("file overwritten")
+	}
+}
+
+func TestSelfSignedParam(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "http")
+	defer os.RemoveAll(dir)
+	flow.Config["DATA_DIR"] = dir
+	defer delete(flow.Config, "DATA_DIR")
+
+	s := startServerWith("127.0.0.1:0", nil, []flow.Tag{{"selfsigned", "localhost,127.0.0.1"}})
+	uri := s.ready(t)
+	if !strings.HasPrefix(uri, "https://") {
+		t.Fatal("not serving https", uri)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "selfsigned-cert.pem")); err != nil {
+		t.Error("certificate not kept", err)
+	}
+	if r := get(t, uri+"/"); r.TLS == nil {
+		t.Error("not served over https")
+	}
+}
+
+func TestCertReload(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "http")
+	defer os.RemoveAll(dir)
+	params := append(writeCert(t, dir), flow.Tag{"certreload", "20ms"})
+	certFile, keyFile := params[0].Msg.(string), params[1].Msg.(string)
+
+	s := startServerWith("127.0.0.1:0", nil, params)
+	uri := s.ready(t)
+	host := strings.TrimPrefix(uri, "https://")
+	serial := func() string {
+		conn, err := tls.Dial("tcp", host, &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.String()
+	}
+	first := serial()
+
+	//a pair that doesn't match is reported, and the old certificate stays
+	old, _ := ioutil.ReadFile(keyFile)
+	writeSelfSigned(filepath.Join(dir, "other.pem"), keyFile, []string{"localhost"})
+	if m := s.errs.Next(t); !strings.Contains(m.(string), "keeping the old certificate") {
+		t.Error("unexpected error", m)
+	}
+	if serial() != first {
+		t.Error("certificate changed")
+	}
+	ioutil.WriteFile(keyFile, old, 0600)
+
+	writeSelfSigned(certFile, keyFile, []string{"localhost", "127.0.0.1"})
+	deadline := time.Now().Add(wait)
+	for serial() == first {
+		if time.Now().After(deadline) {
+			t.Fatal("certificate not reloaded")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -2,16 +2,18 @@ package network
 
 import (
 	_"bufio"
-	_ "crypto/tls"
+	"context"
+	"crypto/tls"
 	_"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/url"
-	"os"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	"code.google.com/p/go.net/websocket"
@@ -27,7 +29,8 @@ func init() {
 	fmt.Println("Extended HTTP(s) Server loaded")
 }
 
-var wsClients = map[string]*websocket.Conn{}
+//how long a shutdown waits for requests in flight, unless .Control says otherwise
+var DefaultDrain = 5 * time.Second
 
 // HTTPServer is a .Feed( which sets up an HTTP server.
 type HTTPServer struct {
@@ -35,16 +38,31 @@ type HTTPServer struct {
 	Handlers flow.Input
 	Param    flow.Input
 	Port     flow.Input
-	Out      flow.Output
+	Control  flow.Input  //"shutdown", or flow.Tag{"shutdown", "10s"} to give requests in flight longer
+	Out      flow.Output //request URLs, and flow.Tag{"<ready>", url} once the server is accepting
+	Error    flow.Output //errors binding the port, creating handlers or serving
 }
 
+//fail reports an error on .Error instead of taking the whole process down
+func (w *HTTPServer) fail(err error) {
+	glog.Errorln("HTTPServer:", err)
+	w.Error.Send(err.Error())
+}
+
+//flowHandler sends the URL of each request it lets through on .Out, it goes behind the auth rules so refused
+//requests are not sent
 type flowHandler struct {
 	h http.Handler
 	s *HTTPServer
 }
 
 func (fh *flowHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	fh.s.Out.Send(req.URL)
+	u := *req.URL
+	if q := u.Query(); q["access_token"] != nil {
+		q.Del("access_token") //a token is not for whatever reads .Out, or the logs
+		u.RawQuery = q.Encode()
+	}
+	fh.s.Out.Send(&u)
 	fh.h.ServeHTTP(w, req)
 }
 
@@ -57,6 +75,7 @@ type HttpEndpointInfo struct {
 
 }
 
+//NewHttpEndpointInfo gives an https endpoint when both pem and key are given, http when neither is
 func NewHttpEndpointInfo(addr, pem, key string) (*HttpEndpointInfo, error) {
 
 	info := &HttpEndpointInfo{}
@@ -72,6 +91,9 @@ func NewHttpEndpointInfo(addr, pem, key string) (*HttpEndpointInfo, error) {
 	info.pem = pem
 	info.key = key
 
+	if (pem != "") != (key != "") {
+		return nil, errors.New("https needs both certfile and certkey")
+	}
 	if (pem != "") && (key != "") {
 		info.uri.Scheme = "https"
 	}
@@ -80,6 +102,7 @@ func NewHttpEndpointInfo(addr, pem, key string) (*HttpEndpointInfo, error) {
 }
 
 // Set up the handlers, then start the server and start processing requests.
+// Run returns once the server has stopped, after a shutdown on .Control or an error serving.
 func (w *HTTPServer) Run() {
 	mux := http.NewServeMux() // don't use default to allow multiple instances
 
@@ -87,60 +110,351 @@ func (w *HTTPServer) Run() {
 
 	pem := ""
 	key := ""
+	redirect := "" //plain HTTP port that redirects to HTTPS
+	local := ""    //plain HTTP port on loopback, next to HTTPS
+	var hosts []string //generate a self-signed certificate for these
+	reload := DefaultCertReload
+	auth := newAuthenticator()
 
+	var err error
 	for param := range w.Param {
 
 		switch param.(type) {
 
 		case flow.Tag:
-			switch param.(flow.Tag).Tag {
-			case "certfile":
-				f := param.(flow.Tag).Msg.(string)
-				if _, err := os.Stat(f); err == nil {
-					glog.Infoln("Using Certfile:", f)
-					pem = f
+			p := param.(flow.Tag)
+			s, ok := p.Msg.(string)
+			switch p.Tag {
+			case "certfile", "certkey":
+				//a missing file is an error when loading it, not a quiet switch to plain HTTP
+				if !ok || s == "" {
+					err = fmt.Errorf("%s must be a file name, got:%v", p.Tag, p.Msg)
+				} else if p.Tag == "certfile" {
+					glog.Infoln("Using Certfile:", s)
+					pem = s
+				} else {
+					glog.Infoln("Using Keyfile:", s)
+					key = s
+				}
+			case "httpport", "localhttp":
+				if !ok || s == "" {
+					err = fmt.Errorf("%s must be a port such as :80, got:%v", p.Tag, p.Msg)
+				} else if p.Tag == "httpport" {
+					redirect = s
+				} else {
+					local = s
+				}
+			case "selfsigned":
+				var e error
+				if hosts, e = hostList(p.Msg); e != nil {
+					err = e
+				}
+			case "certreload":
+				d, e := time.ParseDuration(s)
+				if e != nil || d < 0 {
+					err = fmt.Errorf("certreload must be a duration such as 1m (0 to not watch), got:%v", p.Msg)
 				}
-			case "certkey":
-				f := param.(flow.Tag).Msg.(string)
-				if _, err := os.Stat(f); err == nil {
-					glog.Infoln("Using Keyfile:", f)
-					key = f
+				reload = d
+			default:
+				if _, e := auth.apply(p); e != nil {
+					err = e
 				}
 			}
 		}
 	}
 
-	info, _ := NewHttpEndpointInfo(port, pem, key)
+	if err == nil && hosts != nil {
+		if pem == "" && key == "" {
+			pem, key = selfSignedFiles()
+		}
+		err = selfSigned(pem, key, hosts)
+	}
 
+	var info *HttpEndpointInfo
+	if err == nil {
+		info, err = NewHttpEndpointInfo(port, pem, key)
+	}
+	if err == nil && info.uri.Scheme != "https" && (redirect != "" || local != "") {
+		err = errors.New("httpport and localhttp go next to https, they need certfile and certkey")
+	}
+	if err == nil {
+		err = auth.check(info.uri.Scheme == "https")
+	}
+	if err != nil {
+		w.fail(err)
+		return
+	}
+
+	sockets := newWebsockets(w.fail)
+	handled := map[string]bool{}
 	for m := range w.Handlers {
 		tag := m.(flow.Tag)
+		handled[tag.Tag] = true
 		switch v := tag.Msg.(type) {
 		case string:
-			h := createHandler(tag.Tag, v, info)
-			mux.Handle(tag.Tag, &flowHandler{h, w})
+			h, err := createHandler(tag.Tag, v, info, sockets, auth)
+			if err != nil {
+				w.fail(err)
+				continue
+			}
+			mux.Handle(tag.Tag, auth.wrap(tag.Tag, &flowHandler{h, w}, v == "<websocket>"))
 		case http.Handler:
-			mux.Handle(tag.Tag, &flowHandler{v, w})
+			mux.Handle(tag.Tag, auth.wrap(tag.Tag, &flowHandler{v, w}, false))
+		}
+	}
+	for path := range auth.paths {
+		if !handled[path] {
+			w.fail(fmt.Errorf("auth for %s, but there is no such handler", path)) //a typo would leave a path open
+			return
+		}
+	}
+
+	//load the certificate and bind here, so a bad certificate or a port in use is reported before we say we're ready
+	var tlsConfig *tls.Config
+	if info.uri.Scheme == "https" {
+		certs, err := loadCerts(info.pem, info.key)
+		if err != nil {
+			w.fail(err)
+			return
+		}
+		if reload > 0 {
+			stop := make(chan struct{})
+			defer close(stop)
+			go certs.watch(reload, stop, w.fail)
+		}
+		tlsConfig = certs.tlsConfig()
+		if auth.clientCA != nil {
+			//asked for but not required, the auth rules decide which paths need one
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			tlsConfig.ClientCAs = auth.clientCA
 		}
 	}
+	listeners, err := bindAll(info, tlsConfig, mux, redirect, local)
+	if err != nil {
+		w.fail(err)
+		return
+	}
+
+	served := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l *listener) {
+			defer flow.DontPanic()
+			served <- l.srv.Serve(l.l)
+		}(l)
+	}
+	for _, l := range listeners {
+		glog.Infoln("http started on", l.uri.String())
+		w.Out.Send(flow.Tag{"<ready>", l.uri.String()})
+	}
 
+	stopped := make(chan struct{})
 	go func() {
-		// will stay running until an error is returned or the app ends
-		defer flow.DontPanic()
-		var err error
-		if info.uri.Scheme == "https" {
-			err = http.ListenAndServeTLS(info.uri.Host, info.pem, info.key, mux)
-		} else {
-			err = http.ListenAndServe(info.uri.Host, mux)
+		defer close(stopped)
+		for m := range w.Control {
+			drain, err := shutdownRequest(m)
+			if err != nil {
+				w.fail(err)
+				continue
+			}
+			w.shutdown(listeners, sockets, drain)
+			return
 		}
-		glog.Fatal(err)
-		glog.Infoln("http started on", info.uri.Host)
+		<-make(chan struct{}) //no .Control, so we serve until the app ends
 	}()
-	// TODO: this is a hack to make sure the server is ready
-	// better would be to interlock the goroutine with the listener being ready
-	time.Sleep(50 * time.Millisecond)
+
+	for range listeners {
+		if err := <-served; err != http.ErrServerClosed {
+			//one listener failing takes the others down with it, rather than serving half a site
+			w.fail(err)
+			for _, l := range listeners {
+				l.srv.Close()
+			}
+			sockets.closeAll()
+			return
+		}
+	}
+	<-stopped
+}
+
+//listener is one of the ports a HTTPServer serves on
+type listener struct {
+	uri url.URL
+	l   net.Listener
+	srv *http.Server
 }
 
-func createHandler(tag, s string, info *HttpEndpointInfo) http.Handler {
+//bind listens on addr, a port of 0 picks a free one
+func bind(scheme, addr string, h http.Handler) (*listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	if host == "" {
+		host = "localhost"
+	}
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	return &listener{url.URL{Scheme: scheme, Host: net.JoinHostPort(host, port)}, l, &http.Server{Handler: h}}, nil
+}
+
+//bindAll binds the main port (HTTPS if there is a tlsConfig), then the redirecting and loopback HTTP ports if
+//asked for. Either all of them are bound or none are.
+func bindAll(info *HttpEndpointInfo, tlsConfig *tls.Config, mux http.Handler, redirect, local string) (listeners []*listener, err error) {
+	defer func() {
+		if err != nil {
+			for _, l := range listeners {
+				l.l.Close()
+			}
+			listeners = nil
+		}
+	}()
+
+	primary, err := bind(info.uri.Scheme, info.uri.Host, mux)
+	if err != nil {
+		return
+	}
+	listeners = append(listeners, primary)
+	info.uri.Host = primary.uri.Host
+	if tlsConfig != nil {
+		primary.l = tls.NewListener(primary.l, tlsConfig)
+	}
+
+	if redirect != "" {
+		l, err := bind("http", redirect, redirectTo(info.uri.Port()))
+		if err != nil {
+			return listeners, err
+		}
+		listeners = append(listeners, l)
+	}
+
+	if local != "" {
+		host, port, err := net.SplitHostPort(local)
+		if err != nil {
+			return listeners, err
+		}
+		if host == "" {
+			host = "127.0.0.1"
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return listeners, fmt.Errorf("localhttp only listens on loopback, not:%s", host)
+		}
+		l, err := bind("http", net.JoinHostPort(host, port), mux)
+		if err != nil {
+			return listeners, err
+		}
+		listeners = append(listeners, l)
+	}
+	return
+}
+
+//redirectTo sends requests on to the same host and path over HTTPS
+func redirectTo(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host //no port given
+		}
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		u := url.URL{Scheme: "https", Host: host, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+		http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+	})
+}
+
+//shutdownRequest checks a .Control message, giving how long to wait for requests in flight
+func shutdownRequest(m flow.Message) (time.Duration, error) {
+	switch v := m.(type) {
+	case string:
+		if v == "shutdown" {
+			return DefaultDrain, nil
+		}
+	case flow.Tag:
+		if v.Tag == "shutdown" {
+			s, _ := v.Msg.(string)
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return 0, fmt.Errorf("shutdown needs a duration such as 10s, got:%v", v.Msg)
+			}
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown control:%v", m)
+}
+
+//shutdown stops accepting, closes websockets with a close frame and gives requests in flight up to drain to finish
+func (w *HTTPServer) shutdown(listeners []*listener, sockets *websockets, drain time.Duration) {
+	glog.Infoln("http shutting down, waiting up to", drain)
+	ctx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+
+	sockets.closeAll() //hijacked connections are not Shutdown's business
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				w.fail(err)
+				srv.Close()
+			}
+		}(l.srv)
+	}
+	wg.Wait()
+}
+
+//websockets keeps track of a server's open websockets, so a shutdown can close them properly
+type websockets struct {
+	sync.Mutex
+	conns   map[*websocket.Conn]bool
+	closing bool
+	fail    func(error)
+	told    map[string]bool //protocols already reported as not taking an identity
+}
+
+func newWebsockets(fail func(error)) *websockets {
+	return &websockets{conns: map[*websocket.Conn]bool{}, fail: fail, told: map[string]bool{}}
+}
+
+//unidentified reports, once, that a protocol with an auth rule has a circuit which can't be told who connected
+func (s *websockets) unidentified(protocol string) {
+	s.Lock()
+	defer s.Unlock()
+	if !s.told[protocol] {
+		s.told[protocol] = true
+		s.fail(fmt.Errorf("auth for protocol %s, but its circuit takes no identity (needs an Identity input, "+
+			"or identity: true in the rule and a pin labelled Identity)", protocol))
+	}
+}
+
+//add notes a new websocket, false if the server is already shutting down
+func (s *websockets) add(ws *websocket.Conn) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.closing {
+		return false
+	}
+	s.conns[ws] = true
+	return true
+}
+
+func (s *websockets) remove(ws *websocket.Conn) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.conns, ws)
+}
+
+//closeAll sends each websocket a close frame
+func (s *websockets) closeAll() {
+	s.Lock()
+	defer s.Unlock()
+	s.closing = true
+	for ws := range s.conns {
+		ws.Close()
+	}
+}
+
+func createHandler(tag, s string, info *HttpEndpointInfo, sockets *websockets, auth *authenticator) (http.Handler, error) {
 	// TODO: hook gadget in as HTTP handler
 	// if _, ok := flow.Registry[s]; ok {
 	// 	return http.Handler(reqHandler)
@@ -154,38 +468,36 @@ func createHandler(tag, s string, info *HttpEndpointInfo) http.Handler {
 			wsproto = "wss://"
 		}
 		if wsConfig, err = websocket.NewConfig(wsproto+info.uri.Host+tag, info.uri.String()); err != nil {
-			glog.Fatal(err)
+			return nil, err
 		}
 
 		hsfunc := func(ws *websocket.Config, req *http.Request) error {
 
-			tag := ""
-			for _, v := range ws.Protocol { //check for first supported WebSocket- (circuit) protocol
-				if flow.Registry["WebSocket-"+v] != nil {
-					tag = v
-					break
-				}
+			//check for first supported WebSocket- (circuit) protocol the client may use
+			tag, err := auth.protocol(ws.Protocol, req)
+			if err != nil {
+				return err //refused with 403 Forbidden
 			}
 			ws.Protocol = []string{tag} //let client know we picked one
 
-			return nil //errors.New("Protocol Unsupported")
+			return nil
 		}
-		wsHandshaker := websocket.Server{Handler: wsHandler,
+		wsHandshaker := websocket.Server{Handler: func(ws *websocket.Conn) { sockets.handler(ws, auth) },
 			Config:    *wsConfig,
 			Handshake: hsfunc,
 		}
-		return wsHandshaker
+		return wsHandshaker, nil
 	}
 
 	if !strings.ContainsAny(s, "./") {
-		glog.Fatalln("cannot create handler for:", s)
+		return nil, errors.New("cannot create handler for: " + s)
 	}
 	h := http.FileServer(http.Dir(s))
 	if s != "/" {
 		h = http.StripPrefix(tag, h)
 	}
 	if tag != "/" {
-		return h
+		return h, nil
 	}
 	// special-cased to return main page unless the URL has an extension
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -193,20 +505,19 @@ func createHandler(tag, s string, info *HttpEndpointInfo) http.Handler {
 			r.URL.Path = "/"
 		}
 		h.ServeHTTP(w, r)
-	})
+	}), nil
 }
 
-//wsHandler now used ws.Config as protocol handshake now supported
-func wsHandler(ws *websocket.Conn) {
+//handler now used ws.Config as protocol handshake now supported
+func (s *websockets) handler(ws *websocket.Conn, auth *authenticator) {
 	defer flow.DontPanic()
 	defer ws.Close()
 
-	hdr := ws.Request().Header
-
-	// keep track of connected clients for reload broadcasting
-	id := hdr.Get("Sec-Websocket-Key")
-	wsClients[id] = ws
-	defer delete(wsClients, id)
+	// keep track of connected clients for shutdown
+	if !s.add(ws) {
+		return
+	}
+	defer s.remove(ws)
 
 	// the protocol name is used as tag to locate the proper circuit
 	//lightbulb: We use the protocol provided by ws, rather than header, as that contains server accepted value
@@ -220,7 +531,18 @@ func wsHandler(ws *websocket.Conn) {
 
 	g := flow.NewCircuit()
 	g.AddCircuitry("head", &wsHead{ws: ws})
-	g.Add("ws", "WebSocket-"+tag) //the client has negotiated this support
+	if f := flow.Registry["WebSocket-"+tag]; f == nil {
+		g.Add("ws", "WebSocket-"+tag) //reports it missing
+	} else {
+		c := f() //the client has negotiated this support
+		g.AddCircuitry("ws", c)
+		//circuitry that takes an identity gets told who is on the other end, if anyone authenticated
+		if id := auth.identity(tag, ws.Request()); id != nil && auth.takesIdentity(tag, c) {
+			g.Feed("ws.Identity", map[string]interface{}{"name": id.Name, "method": id.Method})
+		} else if id != nil && auth.protocols[tag] != nil {
+			s.unidentified(tag) //not fatal, the rule still keeps others out
+		}
+	}
 	g.AddCircuitry("tail", &wsTail{ws: ws})
 	g.Connect("head.Out", "ws.In", 0)
 	g.Connect("ws.Out", "tail.In", 0)
@@ -238,10 +560,12 @@ func (w *wsHead) Run() {
 	for {
 		var msg interface{}
 		err := websocket.JSON.Receive(w.ws, &msg)
-		if err == io.EOF {
+		if err != nil {
+			if err != io.EOF {
+				glog.Infoln("websocket closed:", err) //e.g. closed by a shutdown
+			}
 			break
 		}
-		flow.Check(err)
 		if s, ok := msg.(string); ok {
 			id := w.ws.Request().Header.Get("Sec-Websocket-Key")
 			fmt.Println("msg <"+id[:4]+">:", s)
@@ -259,9 +583,15 @@ type wsTail struct {
 }
 
 func (w *wsTail) Run() {
+	closed := false
 	for m := range w.In {
-		err := websocket.JSON.Send(w.ws, m)
-		flow.Check(err)
+		if closed {
+			continue //keep draining, so the circuit can wind down
+		}
+		if err := websocket.JSON.Send(w.ws, m); err != nil {
+			glog.Infoln("websocket closed:", err)
+			closed = true
+		}
 	}
 }
 
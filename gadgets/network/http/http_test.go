@@ -0,0 +1,334 @@
+package network
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.net/websocket"
+	"github.com/jcw/flow"
+	"github.com/TheDistractor/flow-ext/go-helpers/flowtest"
+)
+
+const wait = 2 * time.Second
+
+type testServer struct {
+	w       *HTTPServer
+	out     flowtest.Pin
+	errs    flowtest.Pin
+	control chan flow.Message
+	done    chan struct{}
+}
+
+//startServer runs an HTTPServer with the handlers given, control is left unconnected if nil
+func startServer(port string, control chan flow.Message, handlers ...flow.Tag) *testServer {
+	return startServerWith(port, control, nil, handlers...)
+}
+
+func startServerWith(port string, control chan flow.Message, params []flow.Tag, handlers ...flow.Tag) *testServer {
+	s := &testServer{w: &HTTPServer{}, out: make(flowtest.Pin, 100), errs: make(flowtest.Pin, 10), control: control, done: make(chan struct{})}
+	param, portIn, hs := make(chan flow.Message, 10), make(chan flow.Message, 1), make(chan flow.Message, 10)
+	for _, p := range params {
+		param <- p
+	}
+	close(param)
+	portIn <- port
+	close(portIn)
+	for _, h := range handlers {
+		hs <- h
+	}
+	close(hs)
+	if control == nil {
+		control = make(chan flow.Message)
+		close(control)
+	}
+	s.w.Param, s.w.Port, s.w.Handlers, s.w.Control = param, portIn, hs, control
+	s.w.Out, s.w.Error = s.out, s.errs
+
+	go func() {
+		s.w.Run()
+		close(s.done)
+	}()
+	return s
+}
+
+//ready gives the URL the server is reachable on
+func (s *testServer) ready(t *testing.T) string {
+	select {
+	case m := <-s.out:
+		r, ok := m.(flow.Tag)
+		if !ok || r.Tag != "<ready>" {
+			t.Fatal("expected ready, got", m)
+		}
+		return r.Msg.(string)
+	case m := <-s.errs:
+		t.Fatal("server failed:", m)
+	case <-time.After(wait):
+		t.Fatal("server not ready")
+	}
+	return ""
+}
+
+func (s *testServer) stopped(t *testing.T) {
+	select {
+	case <-s.done:
+	case <-time.After(wait):
+		t.Fatal("server did not stop")
+	}
+}
+
+func TestBindError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	s := startServer(l.Addr().String(), nil)
+	select {
+	case m := <-s.errs:
+		if !strings.Contains(m.(string), "in use") {
+			t.Error("unexpected error", m)
+		}
+	case <-time.After(wait):
+		t.Fatal("bind error not reported")
+	}
+	s.stopped(t)
+	if len(s.out) != 0 {
+		t.Error("should not be ready", <-s.out)
+	}
+}
+
+func TestBadHandler(t *testing.T) {
+	s := startServer("127.0.0.1:0", nil, flow.Tag{"/x", "nonsense"})
+	if m := <-s.errs; !strings.Contains(m.(string), "nonsense") {
+		t.Error("unexpected error", m)
+	}
+	s.ready(t) //the other handlers still get served
+}
+
+func TestShutdownDrains(t *testing.T) {
+	started, release := make(chan bool), make(chan bool)
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		<-release
+		io.WriteString(w, "done")
+	})
+	control := make(chan flow.Message, 1)
+	s := startServer("127.0.0.1:0", control, flow.Tag{"/slow", slow})
+	uri := s.ready(t)
+
+	body := make(chan string, 1)
+	go func() {
+		r, err := http.Get(uri + "/slow")
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer r.Body.Close()
+		b, _ := ioutil.ReadAll(r.Body)
+		body <- string(b)
+	}()
+	<-started
+
+	control <- flow.Tag{"shutdown", "1m"}
+	select {
+	case <-s.done:
+		t.Fatal("stopped with a request in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, err := http.Get(uri + "/slow"); err == nil {
+		t.Error("still accepting during shutdown")
+	}
+
+	close(release)
+	if b := <-body; b != "done" {
+		t.Error("request not finished:", b)
+	}
+	s.stopped(t)
+	if len(s.errs) != 0 {
+		t.Error("unexpected error", <-s.errs)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	release := make(chan bool)
+	defer close(release)
+	stuck := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-release })
+	control := make(chan flow.Message, 2)
+	s := startServer("127.0.0.1:0", control, flow.Tag{"/stuck", stuck})
+	uri := s.ready(t)
+	go http.Get(uri + "/stuck")
+	time.Sleep(100 * time.Millisecond)
+
+	control <- "reload" //not something we know
+	control <- flow.Tag{"shutdown", "100ms"}
+	if m := s.errs.Next(t); !strings.Contains(m.(string), "unknown control") {
+		t.Error("unexpected error", m)
+	}
+	if m := s.errs.Next(t); !strings.Contains(m.(string), "deadline") {
+		t.Error("expected the drain to time out, got", m)
+	}
+	s.stopped(t)
+}
+
+type echo struct {
+	flow.Gadget
+	In  flow.Input
+	Out flow.Output
+}
+
+func (w *echo) Run() {
+	for m := range w.In {
+		w.Out.Send(m)
+	}
+}
+
+func TestWebsocketClosedOnShutdown(t *testing.T) {
+	flow.Registry["WebSocket-httptest"] = func() flow.Circuitry { return new(echo) }
+	control := make(chan flow.Message, 1)
+	s := startServer("127.0.0.1:0", control, flow.Tag{"/ws", "<websocket>"})
+	uri := s.ready(t)
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(uri, "http")+"/ws", "httptest", uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if ws.Config().Protocol[0] != "httptest" {
+		t.Error("protocol not selected", ws.Config().Protocol)
+	}
+
+	var got map[string]interface{}
+	websocket.JSON.Send(ws, map[string]interface{}{"a": 1})
+	if err := websocket.JSON.Receive(ws, &got); err != nil || got["a"] != 1.0 {
+		t.Fatal("no echo", got, err)
+	}
+
+	control <- "shutdown"
+	ws.SetReadDeadline(time.Now().Add(wait))
+	if err := websocket.JSON.Receive(ws, &got); err != io.EOF {
+		t.Error("expected a close frame, got", err)
+	}
+	s.stopped(t)
+}
+
+func TestNoControl(t *testing.T) {
+	s := startServer("127.0.0.1:0", nil, flow.Tag{"/", http.NotFoundHandler()})
+	uri := s.ready(t)
+	time.Sleep(50 * time.Millisecond)
+	r, err := http.Get(uri + "/x")
+	if err != nil {
+		t.Fatal("an unconnected Control should not stop the server:", err)
+	}
+	r.Body.Close()
+	if u, ok := s.out.Next(t).(*url.URL); !ok || u.Path != "/x" {
+		t.Error("request not reported", u)
+	}
+}
+
+//writeCert makes a self-signed certificate for localhost, giving the certfile and certkey params
+func writeCert(t *testing.T, dir string) []flow.Tag {
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := writeSelfSigned(certFile, keyFile, []string{"localhost", "127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	return []flow.Tag{{"certfile", certFile}, {"certkey", keyFile}}
+}
+
+//insecure is a client that trusts any certificate and does not follow redirects
+var insecure = &http.Client{
+	Transport:     &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+func get(t *testing.T, uri string) *http.Response {
+	r, err := insecure.Get(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	return r
+}
+
+func TestCertErrors(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "http")
+	defer os.RemoveAll(dir)
+	cert := writeCert(t, dir)
+
+	for _, params := range [][]flow.Tag{
+		{{"certfile", filepath.Join(dir, "missing.pem")}, cert[1]}, //no quiet fallback to plain HTTP
+		{cert[0]}, //a certfile needs a certkey
+		{{"certfile", cert[1].Msg}, {"certkey", cert[0].Msg}},
+		{{"httpport", "127.0.0.1:0"}}, //nothing to redirect to
+	} {
+		s := startServerWith("127.0.0.1:0", nil, params)
+		select {
+		case m := <-s.errs:
+			t.Log(m)
+		case <-time.After(wait):
+			t.Error("no error for", params)
+		}
+		s.stopped(t)
+		if len(s.out) != 0 {
+			t.Error("should not be ready", <-s.out)
+		}
+	}
+}
+
+func TestRedirectAndLocal(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "http")
+	defer os.RemoveAll(dir)
+	params := append(writeCert(t, dir), flow.Tag{"httpport", "127.0.0.1:0"}, flow.Tag{"localhttp", ":0"})
+
+	s := startServerWith("127.0.0.1:0", nil, params, flow.Tag{"/", http.NotFoundHandler()})
+	secure, redirect, local := s.ready(t), s.ready(t), s.ready(t)
+	if !strings.HasPrefix(secure, "https://127.0.0.1:") || !strings.HasPrefix(redirect, "http://127.0.0.1:") ||
+		!strings.HasPrefix(local, "http://127.0.0.1:") {
+		t.Fatal("unexpected listeners", secure, redirect, local)
+	}
+
+	if r := get(t, secure+"/x"); r.StatusCode != 404 || r.TLS == nil {
+		t.Error("not served over https", r.Status)
+	}
+	r := get(t, redirect+"/x?y=1")
+	if r.StatusCode != http.StatusMovedPermanently || r.Header.Get("Location") != secure+"/x?y=1" {
+		t.Error("not redirected", r.Status, r.Header.Get("Location"))
+	}
+	if r := get(t, local+"/x"); r.StatusCode != 404 || r.TLS != nil {
+		t.Error("not served over plain http", r.Status)
+	}
+}
+
+func TestLocalOnlyOnLoopback(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "http")
+	defer os.RemoveAll(dir)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().String()
+	l.Close()
+
+	params := append(writeCert(t, dir), flow.Tag{"localhttp", "0.0.0.0:0"})
+	s := startServerWith(port, nil, params)
+	if m := s.errs.Next(t); !strings.Contains(m.(string), "loopback") {
+		t.Error("unexpected error", m)
+	}
+	s.stopped(t)
+
+	//the https port bound before the failure has been let go again
+	if l, err := net.Listen("tcp", port); err != nil {
+		t.Error(err)
+	} else {
+		l.Close()
+	}
+}
@@ -15,4 +15,7 @@ func init() {
 		glog.Infoln("Loading MQTTServerEx as MQTTServer into Registry...")
 	}
 	flow.Registry["MQTTServer"] = func() flow.Circuitry { return &mqttex.RemoteMQTTServer{} }
+	flow.Registry["MQTTBridge"] = func() flow.Circuitry { return &mqttex.MQTTBridge{} }
+	flow.Registry["MQTTTestBroker"] = func() flow.Circuitry { return &mqttex.MQTTTestBroker{} }
+	flow.Registry["StateStore"] = func() flow.Circuitry { return &mqttex.StateStore{} }
 }
@@ -0,0 +1,387 @@
+package mqtt
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/jcw/flow"
+	"github.com/TheDistractor/flow-ext/go-helpers/mqttwire"
+)
+
+//MQTTBridge connects two brokers, typically the inbuilt jeebus MQTTServer (Local) and a house-wide broker (Remote),
+//and forwards the topics given by its "topic" params between them. Rules take QoS 0 or 1 only, unlike mosquitto's
+//which also allow 2: the bridge's MQTT client has no QoS 2 handshake, so a rule asking for 2 is refused.
+//A pattern bridged both ways would loop. A 5.0 broker is asked not to send the bridge's own messages back (no local),
+//a 3.1.1 broker can't be, so what the bridge publishes on it is remembered for "echowindow" and the copy that comes
+//back is dropped. The catch is that a client publishing the very same topic and payload on a 3.1.1 broker within
+//that window, before the copy is back, may have its message taken for the echo and not forwarded.
+type MQTTBridge struct {
+	flow.Gadget
+	Param  flow.Input  //topic rules, clientid, retain and echowindow, see bridgeConfig.apply
+	Local  flow.Input  //the jeebus side (MQTT_PORT if unconnected), usually the inbuilt MQTTServer.PortOut
+	Remote flow.Input  //the house-wide broker, required, e.g. a URL or MQTTServerEx.PortOut for TLS and a login
+	Status flow.Output //connected/lost/error events as flow.Tag's
+}
+
+//the directions a topic rule can forward in
+const (
+	bridgeOut  = "out"  //local to remote
+	bridgeIn   = "in"   //remote to local
+	bridgeBoth = "both"
+)
+
+//bridgeRule is one "topic" param, in the style of a mosquitto bridge: pattern [direction [qos [local-prefix remote-prefix]]]
+type bridgeRule struct {
+	pattern       string
+	direction     string
+	qos           byte
+	local, remote string //prefixes, swapped for each other as a message crosses
+}
+
+func parseBridgeRule(s string) (bridgeRule, error) {
+	fields := strings.Fields(s)
+	r := bridgeRule{direction: bridgeOut}
+	switch len(fields) {
+	case 5:
+		r.local, r.remote = unquote(fields[3]), unquote(fields[4])
+		fallthrough
+	case 3:
+		qos, err := strconv.Atoi(fields[2])
+		if err != nil || qos < 0 || qos > 1 {
+			return r, fmt.Errorf("bridge qos must be 0 or 1:%s", s)
+		}
+		r.qos = byte(qos)
+		fallthrough
+	case 2:
+		r.direction = fields[1]
+		fallthrough
+	case 1:
+		r.pattern = fields[0]
+	default:
+		return r, fmt.Errorf("bridge topic should be: pattern [in|out|both [qos [local-prefix remote-prefix]]], got:%s", s)
+	}
+
+	if r.pattern == `""` { //only the prefix is bridged
+		r.pattern = ""
+		if r.local == "" || r.remote == "" {
+			return r, fmt.Errorf("an empty pattern needs both prefixes:%s", s)
+		}
+	}
+	switch r.direction {
+	case bridgeOut, bridgeIn, bridgeBoth:
+	default:
+		return r, fmt.Errorf("bridge direction must be in, out or both:%s", s)
+	}
+	if err := mqttwire.ValidFilter(r.local + r.pattern); err != nil {
+		return r, err
+	}
+	return r, mqttwire.ValidFilter(r.remote + r.pattern)
+}
+
+func unquote(s string) string {
+	if s == `""` {
+		return ""
+	}
+	return s
+}
+
+//forwards reports whether the rule carries messages away from a side
+func (r bridgeRule) forwards(fromLocal bool) bool {
+	if fromLocal {
+		return r.direction != bridgeIn
+	}
+	return r.direction != bridgeOut
+}
+
+//cross gives the filter on the side a message comes from, and maps its topic onto the other side
+func (r bridgeRule) cross(fromLocal bool) (from, to string) {
+	if fromLocal {
+		return r.local, r.remote
+	}
+	return r.remote, r.local
+}
+
+type bridgeConfig struct {
+	rules    []bridgeRule
+	clientID string
+	retain   bool //pass the retained flag on, which keeps retained topics in step on both brokers
+	echoes   time.Duration
+}
+
+func (c *bridgeConfig) apply(p flow.Tag) error {
+	switch p.Tag {
+	case "topic":
+		s, ok := p.Msg.(string)
+		if !ok {
+			return fmt.Errorf("bridge topic must be a string, got:%v", p.Msg)
+		}
+		r, err := parseBridgeRule(s)
+		if err != nil {
+			return err
+		}
+		c.rules = append(c.rules, r)
+	case "clientid":
+		s, ok := p.Msg.(string)
+		if !ok || s == "" {
+			return fmt.Errorf("clientid must be a string, got:%v", p.Msg)
+		}
+		c.clientID = s
+	case "retain":
+		on, ok := p.Msg.(bool)
+		if !ok {
+			return fmt.Errorf("retain must be true or false, got:%v", p.Msg)
+		}
+		c.retain = on
+	case "echowindow":
+		s, _ := p.Msg.(string)
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("echowindow must be a duration such as 10s, got:%v", p.Msg)
+		}
+		c.echoes = d
+	default:
+		return fmt.Errorf("unknown param:%s", p.Tag)
+	}
+	return nil
+}
+
+//subscriptions gives the filters to subscribe to on one side, a 5.0 broker is asked to keep the retained flag of live
+//messages (a 3.1.1 one can't, see retainedTopics) and to leave out what the bridge publishes (see echoes)
+func (c *bridgeConfig) subscriptions(local bool) []mqttwire.Subscription {
+	subs := []mqttwire.Subscription{}
+	for _, r := range c.rules {
+		if r.forwards(local) {
+			from, _ := r.cross(local)
+			subs = append(subs, mqttwire.Subscription{Filter: from + r.pattern, QoS: r.qos, RetainAsPublished: c.retain,
+				NoLocal: true})
+		}
+	}
+	return subs
+}
+
+//route finds the topic a message has on the other side and the QoS of the rule (it is subscribed with that QoS on
+//one side and published with it on the other), false if no rule forwards it
+func (c *bridgeConfig) route(local bool, topic string) (string, byte, bool) {
+	for _, r := range c.rules {
+		if !r.forwards(local) {
+			continue
+		}
+		from, to := r.cross(local)
+		if mqttwire.Match(from+r.pattern, topic) {
+			return to + strings.TrimPrefix(topic, from), r.qos, true
+		}
+	}
+	return "", 0, false
+}
+
+//bounces reports whether a message the bridge publishes as topic on a side comes back to it, i.e. a rule forwards
+//it from there too
+func (c *bridgeConfig) bounces(local bool, topic string) bool {
+	_, _, ok := c.route(local, topic)
+	return ok
+}
+
+//how long a forwarded message is remembered by default, so that the copy coming back to us is not sent on again
+var echoWindow = 10 * time.Second
+
+//echoes notes what the bridge has published on each 3.1.1 side. A pattern bridged both ways sees its own messages
+//come back from such a broker, and they would otherwise bounce between the two forever.
+type echoes struct {
+	sync.Mutex
+	m      map[string][]time.Time
+	swept  time.Time
+	window time.Duration
+}
+
+func echoKey(local bool, m *mqttwire.Publish) string {
+	return fmt.Sprintf("%v\x00%s\x00%s", local, m.Topic, m.Payload)
+}
+
+func (e *echoes) expect(local bool, m *mqttwire.Publish) {
+	e.Lock()
+	defer e.Unlock()
+	now := time.Now()
+	if now.Sub(e.swept) > e.window {
+		e.sweep(now)
+	}
+	key := echoKey(local, m)
+	e.m[key] = append(e.m[key], now.Add(e.window))
+}
+
+//sweep forgets the echoes that never came back (the broker dropped them, or the bridge reconnected meanwhile)
+func (e *echoes) sweep(now time.Time) {
+	for key, untils := range e.m {
+		for len(untils) > 0 && !now.Before(untils[0]) {
+			untils = untils[1:]
+		}
+		if len(untils) == 0 {
+			delete(e.m, key)
+		} else {
+			e.m[key] = untils
+		}
+	}
+	e.swept = now
+}
+
+//seen reports (and forgets) a message that is one of our own
+func (e *echoes) seen(local bool, m *mqttwire.Publish) bool {
+	e.Lock()
+	defer e.Unlock()
+	key := echoKey(local, m)
+	now := time.Now()
+	defer func() {
+		if len(e.m[key]) == 0 {
+			delete(e.m, key)
+		}
+	}()
+	for len(e.m[key]) > 0 {
+		until := e.m[key][0]
+		e.m[key] = e.m[key][1:]
+		if now.Before(until) {
+			return true
+		}
+	}
+	return false
+}
+
+//retainedTopics is the side record a 3.1.1 broker needs: it only sets the retained flag on what it sends when we
+//subscribe, never on live messages. The topics it showed us as retained stay so, and live updates to them are passed
+//on as retained, until one clears it with an empty payload. A topic that first gets retained while the bridge is
+//connected is picked up on the next reconnect (5.0 brokers keep the flag, so they need none of this).
+type retainedTopics map[string]bool
+
+//retain tells whether a message from the side the record is for should be passed on as retained
+func (r retainedTopics) retain(m *mqttwire.Publish) bool {
+	if !m.Retain && !r[m.Topic] {
+		return false
+	}
+	if len(m.Payload) == 0 {
+		delete(r, m.Topic)
+	} else {
+		r[m.Topic] = true
+	}
+	return true
+}
+
+// Start the bridge.
+func (w *MQTTBridge) Run() {
+	host, _ := os.Hostname()
+	cfg := &bridgeConfig{clientID: "flowext-bridge-" + host, retain: true, echoes: echoWindow}
+	var err error
+	for m := range w.Param {
+		if p, ok := m.(flow.Tag); ok && err == nil {
+			err = cfg.apply(p)
+		}
+	}
+	if err == nil && len(cfg.rules) == 0 {
+		err = fmt.Errorf("MQTTBridge needs at least one topic param")
+	}
+
+	var local, remote *Broker
+	if err == nil {
+		local, err = FindBroker(getInputOrConfigwithDefault(w.Local, "MQTT_PORT", ":1883"))
+	}
+	if err == nil {
+		port, _ := (<-w.Remote).(string)
+		remote, err = FindBroker(port)
+	}
+	if err != nil {
+		glog.Errorln("MQTTBridge:", err)
+		w.Status.Send(flow.Tag{"error", err.Error()})
+		return
+	}
+
+	retry := retryMin
+	for {
+		err := w.bridge(cfg, local, remote, func() { retry = retryMin })
+		glog.Errorln("MQTTBridge:", err)
+		w.Status.Send(flow.Tag{"lost", err.Error()})
+		<-time.After(retry)
+		if retry *= 2; retry > retryMax {
+			retry = retryMax
+		}
+	}
+}
+
+//bridge connects to both brokers and forwards until either goes away
+func (w *MQTTBridge) bridge(cfg *bridgeConfig, local, remote *Broker, connected func()) error {
+	lc, err := local.NewClient(cfg.clientID+"-local", handshakeTimeout, nil)
+	if err != nil {
+		return err
+	}
+	defer lc.Close()
+	rc, err := remote.NewClient(cfg.clientID+"-remote", handshakeTimeout, nil)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	ls := bridgeSide{lc, true, local.Version == mqttwire.Version5}
+	rs := bridgeSide{rc, false, remote.Version == mqttwire.Version5}
+	for _, side := range []bridgeSide{ls, rs} {
+		subs := cfg.subscriptions(side.local)
+		if len(subs) == 0 {
+			continue
+		}
+		granted, err := side.c.Subscribe(handshakeTimeout, subs...)
+		if err != nil {
+			return err
+		}
+		for i, g := range granted {
+			if g == 0x80 && i < len(subs) {
+				return fmt.Errorf("subscription refused:%s", subs[i].Filter)
+			}
+		}
+	}
+
+	connected()
+	w.Status.Send(flow.Tag{"connected", map[string]interface{}{"local": local.URL(), "remote": remote.URL()}})
+
+	e := &echoes{m: map[string][]time.Time{}, window: cfg.echoes}
+	errs := make(chan error, 2)
+	go func() { errs <- forward(cfg, e, ls, rs) }()
+	go func() { errs <- forward(cfg, e, rs, ls) }()
+	return <-errs
+}
+
+//bridgeSide is the client for one of the brokers
+type bridgeSide struct {
+	c     *mqttwire.Client
+	local bool
+	v5    bool //the broker keeps the retained flag of live messages and doesn't send the bridge its own
+}
+
+//forward passes the messages of one side on to the other
+func forward(cfg *bridgeConfig, e *echoes, from, to bridgeSide) error {
+	kept := retainedTopics{}
+	for m := range from.c.Messages() {
+		if !from.v5 && e.seen(from.local, m) {
+			continue
+		}
+		topic, qos, ok := cfg.route(from.local, m.Topic)
+		if !ok {
+			continue
+		}
+
+		retain := m.Retain
+		if !from.v5 {
+			retain = kept.retain(m)
+		}
+		out := &mqttwire.Publish{Topic: topic, Payload: m.Payload, QoS: qos, Retain: retain && cfg.retain}
+		if !to.v5 && cfg.bounces(to.local, topic) {
+			e.expect(to.local, out)
+		}
+		if err := to.c.Publish(out, handshakeTimeout); err != nil {
+			return err
+		}
+		if glog.V(3) {
+			glog.Infof("MQTTBridge: %s -> %s (qos %d)", m.Topic, topic, out.QoS)
+		}
+	}
+	return from.c.Err()
+}
@@ -1,6 +1,7 @@
 //Package mqtt implements a stub that can replace the inbuilt Jeebus MQTTServer to allow a remote (out of process)
 //MQTT Broker like RabbitMQ or Mosquitto to be used. This Gadget does NOT implement this remote broker, rather
-//it checks for the remote host/port is listening and passes its input (Port) parameter through and steps out the way.
+//it checks the remote broker really is an MQTT broker that accepts us (a CONNECT/CONNACK handshake), passes its
+//input (Port) parameter through and then keeps an eye on it with PINGREQs, reporting on Status.
 //
 //This can be useful if you want features that are not within the inbuilt MQTT Server, or you have additional external
 //processes that want to share the MQTT broker that your jeebus app is using.
@@ -12,10 +13,14 @@
 package mqtt
 
 import (
+	"bufio"
+	"errors"
 	"net"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/jcw/flow"
+	"github.com/TheDistractor/flow-ext/go-helpers/mqttwire"
 )
 
 
@@ -24,8 +29,44 @@ import (
 //this then allows us to overwrite the MQTTServer before its used
 type RemoteMQTTServer struct {
 	flow.Gadget
+	Param   flow.Input  //TLS, credentials and protocol settings, see Broker.Apply
 	Port    flow.Input
 	PortOut flow.Output
+	Status  flow.Output //connected/refused/lost/error events as flow.Tag's
+}
+
+//how long we give a broker to answer, and how long between attempts to reach it again
+var (
+	handshakeTimeout = 10 * time.Second
+	retryMin         = time.Second
+	retryMax         = 30 * time.Second
+)
+
+//watch pings the broker until it stops answering, goes away or tells us to go
+func watch(b *Broker, conn net.Conn, r *bufio.Reader) error {
+	interval := b.KeepAlive / 2
+
+	for {
+		<-time.After(interval)
+		if err := mqttwire.Ping(conn); err != nil {
+			return err
+		}
+
+		conn.SetReadDeadline(time.Now().Add(b.KeepAlive))
+		for {
+			p, err := mqttwire.ReadPacket(r)
+			if err != nil {
+				return err
+			}
+			if p.Type == mqttwire.PINGRESP {
+				break
+			}
+			if p.Type == mqttwire.DISCONNECT {
+				code := mqttwire.ParseDisconnect(p.Body)
+				return errors.New("broker disconnected us: " + mqttwire.Reason(b.Version, code))
+			}
+		}
+	}
 }
 
 // Start the MQTT server.
@@ -34,20 +75,82 @@ func (w *RemoteMQTTServer) Run() {
 		glog.Infoln("RemoteMQTTBroker Run begins...")
 	}
 
+	params := []flow.Tag{}
+	useURL := false //PortOut is a broker URL even for a plain broker
+	for m := range w.Param {
+		p := m.(flow.Tag)
+		if p.Tag == "url" {
+			useURL, _ = p.Msg.(bool)
+			continue
+		}
+		params = append(params, p)
+	}
+
 	port := getInputOrConfigwithDefault(w.Port, "MQTT_PORT", ":1883")
 
-	//TODO: Perhaps add a 'real' server check by making an MQTT Client connection.
-	conn, err := net.Dial("tcp", port)
-	if err != nil { //This gives a more specific error log, scoped to file
-		glog.Errorln("Error connecting to MQTT Server:", err)
+	b, err := NewBroker(port)
+	for _, p := range params {
+		if err != nil {
+			break
+		}
+		err = b.Apply(p)
+	}
+	if err == nil {
+		err = b.Validate()
+	}
+	if err != nil {
+		glog.Errorln("MQTTServerEx:", err)
+		w.Status.Send(flow.Tag{"error", err.Error()})
+		return
 	}
-	flow.Check(err) //And then let flow panic.
 
-	defer conn.Close()
+	//a plain broker stays host:port, which is what the core MQTT gadgets understand
+	name := b.Address
+	if useURL || b.TLS != nil || b.Username != "" {
+		name = b.URL()
+	}
+
+	w.supervise(b, name)
+}
 
-	Done := make(chan bool)
-	w.PortOut.Send(port)
-	<-Done //we dont really need this!
+//supervise connects to the broker, reports on it, and reconnects when it is lost.
+//PortOut is only sent once the broker has accepted us, so nothing downstream starts against a broker that isn't there.
+func (w *RemoteMQTTServer) supervise(b *Broker, name string) {
+	sentPort := false
+	retry := retryMin
+
+	for {
+		conn, r, ack, err := b.Connect(handshakeTimeout, nil)
+		if err != nil {
+			glog.Errorln("Error connecting to MQTT Server:", err)
+			if refused, ok := err.(*BrokerRefused); ok {
+				w.Status.Send(flow.Tag{"refused", map[string]interface{}{"code": int(refused.Code), "reason": refused.Reason}})
+			} else {
+				w.Status.Send(flow.Tag{"error", err.Error()})
+			}
+			<-time.After(retry)
+			if retry *= 2; retry > retryMax {
+				retry = retryMax
+			}
+			continue
+		}
+		retry = retryMin
+
+		w.Status.Send(flow.Tag{"connected", map[string]interface{}{
+			"port": name, "code": int(ack.Code), "reason": mqttwire.Reason(b.Version, ack.Code),
+			"sessionpresent": ack.SessionPresent,
+		}})
+		if !sentPort {
+			publishBroker(name, b)
+			w.PortOut.Send(name)
+			sentPort = true
+		}
+
+		err = watch(b, conn, r)
+		conn.Close()
+		glog.Errorln("Lost MQTT Server:", err)
+		w.Status.Send(flow.Tag{"lost", err.Error()})
+	}
 }
 
 //use the config/envvar setting unless overridden by flow param
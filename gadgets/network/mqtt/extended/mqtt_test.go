@@ -0,0 +1,135 @@
+package mqtt
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/TheDistractor/flow-ext/go-helpers/flowtest"
+	"github.com/TheDistractor/flow-ext/go-helpers/mqttwire"
+	"github.com/jcw/flow"
+)
+
+const wait = 2 * time.Second
+
+//fakeBroker accepts connections, answering CONNECT with code and pings until told to hang up
+func fakeBroker(t *testing.T, code byte, hangup chan bool) (string, chan *mqttwire.Connect) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveBroker(l, code, hangup)
+}
+
+func serveBroker(l net.Listener, code byte, hangup chan bool) (string, chan *mqttwire.Connect) {
+	connects := make(chan *mqttwire.Connect, 10)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				p, err := mqttwire.ReadPacket(r)
+				if err != nil {
+					return
+				}
+				c, _ := mqttwire.ParseConnect(p.Body)
+				connects <- c
+				mqttwire.WritePacket(conn, mqttwire.ConnAck{Code: code}.Packet(c.Version))
+				for {
+					select {
+					case <-hangup:
+						l.Close()
+						return
+					default:
+					}
+					p, err := mqttwire.ReadPacket(r)
+					if err != nil {
+						return
+					}
+					if p.Type == mqttwire.PINGREQ {
+						mqttwire.WritePacket(conn, mqttwire.Packet{Type: mqttwire.PINGRESP})
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), connects
+}
+
+func testBroker(addr string) *Broker {
+	return &Broker{Address: addr, Version: mqttwire.Version311, ClientID: "test", Username: "jcw", Password: "wrong", KeepAlive: 100 * time.Millisecond}
+}
+
+func TestBrokerRefused(t *testing.T) {
+	addr, connects := fakeBroker(t, 4, nil)
+
+	w := &RemoteMQTTServer{}
+	portOut, status := make(flowtest.Pin, 10), make(flowtest.Pin, 10)
+	w.PortOut, w.Status = portOut, status
+	go w.supervise(testBroker(addr), addr)
+
+	if c := <-connects; c.Username != "jcw" || c.Password != "wrong" || c.ClientID != "test" {
+		t.Error("unexpected CONNECT", c)
+	}
+
+	s := status.Next(t).(flow.Tag)
+	info, _ := s.Msg.(map[string]interface{})
+	if s.Tag != "refused" || info["code"] != 4 || info["reason"] != "bad user name or password" {
+		t.Error("unexpected status", s)
+	}
+	select {
+	case m := <-portOut:
+		t.Error("PortOut should wait for the broker to accept us, got", m)
+	default:
+	}
+}
+
+func TestBrokerLost(t *testing.T) {
+	hangup := make(chan bool)
+	addr, _ := fakeBroker(t, 0, hangup)
+
+	w := &RemoteMQTTServer{}
+	portOut, status := make(flowtest.Pin, 10), make(flowtest.Pin, 10)
+	w.PortOut, w.Status = portOut, status
+	go w.supervise(testBroker(addr), addr)
+
+	if s := status.Next(t).(flow.Tag); s.Tag != "connected" {
+		t.Fatal("expected connected, got", s)
+	}
+	if port := portOut.Next(t); port != addr {
+		t.Error("unexpected PortOut", port)
+	}
+
+	time.Sleep(250 * time.Millisecond) //a few pings
+	select {
+	case s := <-status:
+		t.Fatal("broker should still be healthy, got", s)
+	default:
+	}
+
+	close(hangup)
+	if s := status.Next(t).(flow.Tag); s.Tag != "lost" {
+		t.Error("expected lost, got", s)
+	}
+}
+
+func TestNotABroker(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer l.Close()
+	go func() {
+		conn, _ := l.Accept()
+		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+		conn.Close()
+	}()
+
+	_, _, _, err := testBroker(l.Addr().String()).Connect(time.Second, nil)
+	if err != mqttwire.ErrNotMQTT {
+		t.Error("expected not an MQTT broker, got", err)
+	}
+}
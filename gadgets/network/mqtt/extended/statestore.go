@@ -0,0 +1,226 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/jcw/flow"
+	"github.com/TheDistractor/flow-ext/go-helpers/mqttwire"
+)
+
+//StateStore keeps a gadget's state in a retained MQTT message, so the gadget picks up where it left off after a
+//restart. The gadget sends snapshots of its state to In, and reads the one message StateStore sends on Out
+//(flow.Tag{key, snapshot}, the snapshot nil if there was none) before it starts processing.
+type StateStore struct {
+	flow.Gadget
+	Param  flow.Input  //key, prefix, qos, every and timeout
+	Port   flow.Input  //the broker keeping the snapshots as retained messages (MQTT_PORT if unconnected)
+	In     flow.Input  //snapshots to save, nil clears the saved state
+	Out    flow.Output //the saved snapshot, sent once at startup
+	Status flow.Output //restored/error events as flow.Tag's
+}
+
+type storeConfig struct {
+	key     string //usually the name of the gadget instance
+	prefix  string
+	qos     byte
+	every   time.Duration //save at most this often, the latest snapshot wins
+	timeout time.Duration //how long the restore may hold up the gadget
+}
+
+func (c *storeConfig) apply(p flow.Tag) error {
+	switch p.Tag {
+	case "key", "prefix":
+		s, ok := p.Msg.(string)
+		if !ok || strings.ContainsAny(s, "+#") {
+			return fmt.Errorf("%s must be a string without wildcards, got:%v", p.Tag, p.Msg)
+		}
+		if p.Tag == "key" {
+			c.key = s
+		} else {
+			c.prefix = s
+		}
+	case "qos":
+		qos, ok := p.Msg.(float64)
+		if !ok || (qos != 0 && qos != 1) {
+			return fmt.Errorf("qos must be 0 or 1, got:%v", p.Msg)
+		}
+		c.qos = byte(qos)
+	case "every", "timeout":
+		s, _ := p.Msg.(string)
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return fmt.Errorf("%s must be a duration such as 2s, got:%v", p.Tag, p.Msg)
+		}
+		if p.Tag == "every" {
+			c.every = d
+		} else {
+			c.timeout = d
+		}
+	default:
+		return fmt.Errorf("unknown param:%s", p.Tag)
+	}
+	return nil
+}
+
+func (c *storeConfig) topic() string {
+	return c.prefix + c.key
+}
+
+// Start the store: restore, then save.
+func (w *StateStore) Run() {
+	cfg := &storeConfig{prefix: "flowext/state/", qos: 1, timeout: handshakeTimeout}
+	var err error
+	for m := range w.Param {
+		p, _ := m.(flow.Tag)
+		if e := cfg.apply(p); e != nil {
+			err = e
+		}
+	}
+	if err == nil && cfg.key == "" {
+		err = fmt.Errorf("StateStore needs a key param")
+	}
+
+	var b *Broker
+	if err == nil {
+		b, err = FindBroker(getInputOrConfigwithDefault(w.Port, "MQTT_PORT", ":1883"))
+	}
+	if err != nil {
+		glog.Errorln("StateStore:", err)
+		w.Status.Send(flow.Tag{"error", err.Error()})
+		w.Out.Send(flow.Tag{cfg.key, nil}) //don't keep the gadget waiting
+		return
+	}
+
+	c, state, err := restore(cfg, b)
+	if err != nil {
+		glog.Errorln("StateStore: could not restore", cfg.key, err)
+		w.Status.Send(flow.Tag{"error", err.Error()})
+	} else {
+		w.Status.Send(flow.Tag{"restored", map[string]interface{}{"key": cfg.key, "found": state != nil}})
+	}
+	w.Out.Send(flow.Tag{cfg.key, state})
+
+	w.save(cfg, b, c)
+}
+
+//restore reads the retained snapshot. To tell "no snapshot" from "not here yet" it also subscribes to a sync topic
+//and publishes to it: once that comes back, any retained message would have arrived before it.
+func restore(cfg *storeConfig, b *Broker) (*mqttwire.Client, interface{}, error) {
+	c, err := b.NewClient(nextClientID(b, "state"), cfg.timeout, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	syncTopic := cfg.topic() + "/sync"
+	token := []byte(fmt.Sprint(time.Now().UnixNano()))
+	if _, err := c.Subscribe(cfg.timeout, mqttwire.Subscription{Filter: cfg.topic(), QoS: 1},
+		mqttwire.Subscription{Filter: syncTopic, QoS: 1}); err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	if err := c.Publish(&mqttwire.Publish{Topic: syncTopic, Payload: token, QoS: 1}, cfg.timeout); err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+
+	var state interface{}
+	deadline := time.After(cfg.timeout)
+	for done := false; !done; {
+		select {
+		case m, ok := <-c.Messages():
+			if !ok {
+				return nil, nil, c.Err()
+			}
+			switch {
+			case m.Topic == cfg.topic() && m.Retain:
+				if err := json.Unmarshal(m.Payload, &state); err != nil {
+					glog.Errorln("StateStore: ignoring unreadable state of", cfg.key, err)
+					state = nil
+				}
+			case m.Topic == syncTopic && string(m.Payload) == string(token):
+				done = true
+			}
+		case <-deadline:
+			c.Close()
+			return nil, nil, fmt.Errorf("no answer from broker within %v", cfg.timeout)
+		}
+	}
+
+	if err := c.Unsubscribe(cfg.timeout, cfg.topic(), syncTopic); err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	return c, state, nil
+}
+
+//save publishes snapshots as they arrive (or every so often), reconnecting when needed
+func (w *StateStore) save(cfg *storeConfig, b *Broker, c *mqttwire.Client) {
+	defer func() {
+		if c != nil {
+			c.Close()
+		}
+	}()
+
+	publish := func(snapshot flow.Message) {
+		m := &mqttwire.Publish{Topic: cfg.topic(), QoS: cfg.qos, Retain: true}
+		if snapshot != nil {
+			data, err := json.Marshal(snapshot)
+			if err != nil {
+				glog.Errorln("StateStore:", err)
+				w.Status.Send(flow.Tag{"error", err.Error()})
+				return
+			}
+			m.Payload = data
+		}
+
+		var err error
+		for attempt := 0; attempt < 2; attempt++ {
+			if c == nil {
+				if c, err = b.NewClient(nextClientID(b, "state"), cfg.timeout, nil); err != nil {
+					continue
+				}
+			}
+			if err = c.Publish(m, cfg.timeout); err == nil {
+				return
+			}
+			c.Close()
+			c = nil
+		}
+		glog.Errorln("StateStore: could not save", cfg.key, err)
+		w.Status.Send(flow.Tag{"error", err.Error()})
+	}
+
+	var pending flow.Message
+	dirty := false
+	var tick <-chan time.Time
+
+	for {
+		select {
+		case m, ok := <-w.In:
+			if !ok {
+				if dirty {
+					publish(pending)
+				}
+				return
+			}
+			if cfg.every == 0 {
+				publish(m)
+				continue
+			}
+			pending, dirty = m, true
+			if tick == nil {
+				tick = time.After(cfg.every)
+			}
+		case <-tick:
+			tick = nil
+			if dirty {
+				publish(pending)
+				pending, dirty = nil, false
+			}
+		}
+	}
+}
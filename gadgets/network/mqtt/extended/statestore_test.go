@@ -0,0 +1,106 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TheDistractor/flow-ext/go-helpers/flowtest"
+	"github.com/TheDistractor/flow-ext/go-helpers/mqttbroker"
+	"github.com/jcw/flow"
+)
+
+//startStore runs a StateStore, giving its In and what it restored
+func startStore(t *testing.T, addr string, params ...flow.Tag) (chan flow.Message, flow.Tag, flowtest.Pin) {
+	w := &StateStore{}
+	param, port, in := make(chan flow.Message, 10), make(chan flow.Message, 1), make(chan flow.Message, 10)
+	out, status := make(flowtest.Pin, 1), make(flowtest.Pin, 10)
+	w.Param, w.Port, w.In, w.Out, w.Status = param, port, in, out, status
+	for _, p := range params {
+		param <- p
+	}
+	close(param)
+	port <- addr
+	close(port)
+	go w.Run()
+	return in, out.Next(t).(flow.Tag), status
+}
+
+func waitRetained(t *testing.T, s *mqttbroker.Server, topic, want string) {
+	deadline := time.Now().Add(wait)
+	for {
+		v, _ := s.Retained(topic)
+		if string(v) == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s is %q, want %q", topic, v, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStateStore(t *testing.T) {
+	s, err := mqttbroker.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	in, restored, status := startStore(t, s.Addr(), flow.Tag{"key", "oomon"})
+	if restored.Tag != "oomon" || restored.Msg != nil {
+		t.Error("nothing should be restored the first time, got", restored)
+	}
+	if st := status.Next(t).(flow.Tag); st.Tag != "restored" || st.Msg.(map[string]interface{})["found"] != false {
+		t.Error("unexpected status", st)
+	}
+
+	in <- map[string]interface{}{"Garage": 1}
+	in <- map[string]interface{}{"Garage": 0}
+	waitRetained(t, s, "flowext/state/oomon", `{"Garage":0}`)
+	close(in)
+
+	_, restored, _ = startStore(t, s.Addr(), flow.Tag{"key", "oomon"})
+	if m, ok := restored.Msg.(map[string]interface{}); !ok || m["Garage"] != 0.0 {
+		t.Error("unexpected state", restored)
+	}
+
+	//another key has its own state
+	_, restored, _ = startStore(t, s.Addr(), flow.Tag{"key", "other"}, flow.Tag{"prefix", "house/"})
+	if restored.Msg != nil {
+		t.Error("unexpected state", restored)
+	}
+}
+
+func TestStateStoreEvery(t *testing.T) {
+	s, _ := mqttbroker.Start("127.0.0.1:0")
+	defer s.Close()
+
+	in, _, _ := startStore(t, s.Addr(), flow.Tag{"key", "k"}, flow.Tag{"every", "200ms"})
+	in <- 1.0
+	in <- 2.0
+	in <- 3.0
+	time.Sleep(50 * time.Millisecond)
+	if _, ok := s.Retained("flowext/state/k"); ok {
+		t.Error("saved too soon")
+	}
+	waitRetained(t, s, "flowext/state/k", "3")
+
+	in <- nil //clears it
+	waitRetained(t, s, "flowext/state/k", "")
+}
+
+func TestStateStoreNoBroker(t *testing.T) {
+	start := time.Now()
+	_, restored, status := startStore(t, "127.0.0.1:1", flow.Tag{"key", "k"}, flow.Tag{"timeout", "100ms"})
+	if restored.Msg != nil || time.Since(start) > wait {
+		t.Error("the gadget should not be held up", restored)
+	}
+	if st := status.Next(t).(flow.Tag); st.Tag != "error" {
+		t.Error("expected an error, got", st)
+	}
+
+	_, restored, status = startStore(t, "127.0.0.1:1")
+	if st := status.Next(t).(flow.Tag); st.Tag != "error" || restored.Msg != nil {
+		t.Error("a key is needed, got", st)
+	}
+}
@@ -0,0 +1,407 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/jcw/flow"
+	"github.com/TheDistractor/flow-ext/go-helpers/mqttwire"
+)
+
+//clientNo keeps the client ids of the gadgets in one process apart
+var clientNo int32
+
+func nextClientID(b *Broker, kind string) string {
+	return fmt.Sprintf("%s-%s%d", b.ClientID, kind, atomic.AddInt32(&clientNo, 1))
+}
+
+//clientConfig holds the params MQTTSubEx and MQTTPubEx have in common
+type clientConfig struct {
+	qos      byte
+	clean    bool
+	clientID string
+	json     bool //encode/decode payloads as JSON
+}
+
+func newClientConfig() *clientConfig {
+	return &clientConfig{clean: true, json: true}
+}
+
+//apply takes one of the common params, ok is false for a param that is not one of them
+func (c *clientConfig) apply(p flow.Tag) (bool, error) {
+	switch p.Tag {
+	case "qos":
+		qos, ok := p.Msg.(float64)
+		if !ok || (qos != 0 && qos != 1) {
+			return true, fmt.Errorf("qos must be 0 or 1, got:%v", p.Msg)
+		}
+		c.qos = byte(qos)
+	case "clean":
+		on, ok := p.Msg.(bool)
+		if !ok {
+			return true, fmt.Errorf("clean must be true or false, got:%v", p.Msg)
+		}
+		c.clean = on
+	case "clientid":
+		s, ok := p.Msg.(string)
+		if !ok || s == "" {
+			return true, fmt.Errorf("clientid must be a string, got:%v", p.Msg)
+		}
+		c.clientID = s
+	case "json":
+		on, ok := p.Msg.(bool)
+		if !ok {
+			return true, fmt.Errorf("json must be true or false, got:%v", p.Msg)
+		}
+		c.json = on
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+//check is called once all params are in, a persistent session needs a clientid of its own
+func (c *clientConfig) check() error {
+	if !c.clean && c.clientID == "" {
+		return fmt.Errorf("a persistent session (clean false) needs a clientid")
+	}
+	return nil
+}
+
+//connect opens a client with these settings
+func (c *clientConfig) connect(b *Broker, kind string) (*mqttwire.Client, error) {
+	if !c.clean {
+		client, _, err := b.NewSession(c.clientID, handshakeTimeout, nil)
+		return client, err
+	}
+	id := c.clientID
+	if id == "" {
+		id = nextClientID(b, kind)
+	}
+	return b.NewClient(id, handshakeTimeout, nil)
+}
+
+//topic templates have {name} levels: MQTTPubEx fills them in from a message's fields,
+//MQTTSubEx subscribes to them as + and hands what they matched back as fields
+
+func templateVar(level string) (string, bool) {
+	if len(level) > 2 && level[0] == '{' && level[len(level)-1] == '}' {
+		return level[1 : len(level)-1], true
+	}
+	return "", false
+}
+
+//fillTopic expands a template from the fields of a map message
+func fillTopic(template string, msg interface{}) (string, error) {
+	if !strings.Contains(template, "{") {
+		return template, nil
+	}
+	fields, _ := msg.(map[string]interface{})
+
+	levels := strings.Split(template, "/")
+	for i, l := range levels {
+		name, ok := templateVar(l)
+		if !ok {
+			continue
+		}
+		v, ok := fields[name]
+		if !ok {
+			return "", fmt.Errorf("no %s field for topic:%s", name, template)
+		}
+		s := fmt.Sprint(v)
+		if s == "" || strings.ContainsAny(s, "/+#") {
+			return "", fmt.Errorf("%s field %q can not be a topic level", name, s)
+		}
+		levels[i] = s
+	}
+	return strings.Join(levels, "/"), nil
+}
+
+//subscription turns a template into a filter
+func subscription(template string) (string, error) {
+	levels := strings.Split(template, "/")
+	for i, l := range levels {
+		if _, ok := templateVar(l); ok {
+			levels[i] = "+"
+		}
+	}
+	filter := strings.Join(levels, "/")
+	if strings.ContainsAny(filter, "{}") {
+		return "", fmt.Errorf("a {name} must be a whole topic level:%s", template)
+	}
+	return filter, mqttwire.ValidFilter(filter)
+}
+
+//captures gives the levels of a topic matched by a template's {name}s
+func captures(template, topic string) map[string]string {
+	found := map[string]string{}
+	t := strings.Split(topic, "/")
+	for i, l := range strings.Split(template, "/") {
+		if name, ok := templateVar(l); ok && i < len(t) {
+			found[name] = t[i]
+		}
+	}
+	return found
+}
+
+//Subscribe to MQTT topics, with QoS and session control. Payloads are decoded from JSON where they can be
+//(as the core MQTTSub does) and sent on Out as flow.Tag{topic, payload}. The "qos" param takes 0 or 1, the
+//underlying client has no QoS 2 handshake.
+type MQTTSubEx struct {
+	flow.Gadget
+	Param  flow.Input  //qos, clean, clientid and json
+	Port   flow.Input  //the broker to subscribe on (MQTT_PORT if unconnected), subscribed to again after a reconnect
+	Topic  flow.Input  //topics, filters or templates such as sensor/{node}/temp
+	Out    flow.Output //flow.Tag{topic, payload}
+	Status flow.Output //connected/lost/error events as flow.Tag's
+}
+
+// Start subscribing.
+func (w *MQTTSubEx) Run() {
+	cfg := newClientConfig()
+	var err error
+	for m := range w.Param {
+		p, _ := m.(flow.Tag)
+		if ok, e := cfg.apply(p); !ok {
+			err = fmt.Errorf("unknown param:%s", p.Tag)
+		} else if e != nil {
+			err = e
+		}
+	}
+
+	if err == nil {
+		err = cfg.check()
+	}
+	var b *Broker
+	if err == nil {
+		b, err = FindBroker(getInputOrConfigwithDefault(w.Port, "MQTT_PORT", ":1883"))
+	}
+
+	templates := map[string]string{} //filter -> template
+	subs := []mqttwire.Subscription{}
+	for m := range w.Topic {
+		template, _ := m.(string)
+		filter, e := subscription(template)
+		if e != nil {
+			err = e
+			continue
+		}
+		templates[filter] = template
+		subs = append(subs, mqttwire.Subscription{Filter: filter, QoS: cfg.qos})
+	}
+	if err != nil {
+		glog.Errorln("MQTTSubEx:", err)
+		w.Status.Send(flow.Tag{"error", err.Error()})
+		return
+	}
+	if len(subs) == 0 {
+		return
+	}
+
+	retry := retryMin
+	for {
+		err := w.subscribe(cfg, b, subs, templates, func() { retry = retryMin })
+		glog.Errorln("MQTTSubEx:", err)
+		w.Status.Send(flow.Tag{"lost", err.Error()})
+		<-time.After(retry)
+		if retry *= 2; retry > retryMax {
+			retry = retryMax
+		}
+	}
+}
+
+func (w *MQTTSubEx) subscribe(cfg *clientConfig, b *Broker, subs []mqttwire.Subscription, templates map[string]string, connected func()) error {
+	c, err := cfg.connect(b, "sub")
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	granted, err := c.Subscribe(handshakeTimeout, subs...)
+	if err != nil {
+		return err
+	}
+	for i, g := range granted {
+		if g == 0x80 && i < len(subs) {
+			return fmt.Errorf("subscription refused:%s", subs[i].Filter)
+		}
+	}
+	connected()
+	w.Status.Send(flow.Tag{"connected", b.URL()})
+
+	for m := range c.Messages() {
+		if glog.V(2) {
+			glog.Infoln("mqtt-sub", m.Topic)
+		}
+		w.Out.Send(flow.Tag{m.Topic, cfg.decode(m, templates)})
+	}
+	return c.Err()
+}
+
+//decode gives the payload as JSON if it is (and json is on), adding the fields a template captured to an object
+func (c *clientConfig) decode(m *mqttwire.Publish, templates map[string]string) interface{} {
+	if !c.json {
+		return string(m.Payload)
+	}
+
+	var any interface{}
+	if err := json.Unmarshal(m.Payload, &any); err != nil {
+		return m.Payload
+	}
+	fields, ok := any.(map[string]interface{})
+	if !ok {
+		return any
+	}
+	for filter, template := range templates {
+		if filter == template || !mqttwire.Match(filter, m.Topic) {
+			continue
+		}
+		for name, v := range captures(template, m.Topic) {
+			if _, taken := fields[name]; !taken {
+				fields[name] = v
+			}
+		}
+	}
+	return fields
+}
+
+//Publish messages to MQTT topics with QoS and retain control. In takes flow.Tag{topic, msg}, the topic may be a
+//template filled in from msg's fields, and plain messages go to the "topic" param's template. The "qos" param
+//takes 0 or 1, the underlying client has no QoS 2 handshake.
+type MQTTPubEx struct {
+	flow.Gadget
+	Param  flow.Input  //qos, retain, clean, clientid, json and topic
+	Port   flow.Input  //the broker to publish to (MQTT_PORT if unconnected), connected to again if it goes away
+	In     flow.Input  //flow.Tag{topic, msg}, or just msg with a "topic" param
+	Status flow.Output //connected/lost/error events as flow.Tag's
+}
+
+//pubConfig adds what only MQTTPubEx has to clientConfig
+type pubConfig struct {
+	*clientConfig
+	retain   *bool  //nil does as the core MQTTPub: retained if the topic starts with /
+	template string //for messages without a tag
+}
+
+func (c *pubConfig) apply(p flow.Tag) error {
+	switch p.Tag {
+	case "retain":
+		on, ok := p.Msg.(bool)
+		if !ok {
+			return fmt.Errorf("retain must be true or false, got:%v", p.Msg)
+		}
+		c.retain = &on
+	case "topic":
+		s, ok := p.Msg.(string)
+		if !ok || s == "" {
+			return fmt.Errorf("topic must be a string, got:%v", p.Msg)
+		}
+		c.template = s
+	default:
+		ok, err := c.clientConfig.apply(p)
+		if !ok {
+			return fmt.Errorf("unknown param:%s", p.Tag)
+		}
+		return err
+	}
+	return nil
+}
+
+//message makes the PUBLISH for something arriving on In
+func (c *pubConfig) message(m flow.Message) (*mqttwire.Publish, error) {
+	template, msg := c.template, interface{}(m)
+	if tag, ok := m.(flow.Tag); ok {
+		template, msg = tag.Tag, tag.Msg
+	}
+	if template == "" {
+		return nil, fmt.Errorf("no topic for:%v", m)
+	}
+	topic, err := fillTopic(template, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	data, raw := msg.([]byte)
+	if s, ok := msg.(string); ok && !c.json {
+		data, raw = []byte(s), true
+	}
+	if !raw {
+		if data, err = json.Marshal(msg); err != nil {
+			return nil, err
+		}
+	}
+
+	retain := len(topic) > 0 && topic[0] == '/'
+	if c.retain != nil {
+		retain = *c.retain
+	}
+	return &mqttwire.Publish{Topic: topic, Payload: data, QoS: c.qos, Retain: retain}, nil
+}
+
+// Start publishing.
+func (w *MQTTPubEx) Run() {
+	cfg := &pubConfig{clientConfig: newClientConfig()}
+	var err error
+	for m := range w.Param {
+		p, _ := m.(flow.Tag)
+		if e := cfg.apply(p); e != nil {
+			err = e
+		}
+	}
+
+	if err == nil {
+		err = cfg.check()
+	}
+	var b *Broker
+	if err == nil {
+		b, err = FindBroker(getInputOrConfigwithDefault(w.Port, "MQTT_PORT", ":1883"))
+	}
+	if err != nil {
+		glog.Errorln("MQTTPubEx:", err)
+		w.Status.Send(flow.Tag{"error", err.Error()})
+		return
+	}
+
+	var c *mqttwire.Client
+	defer func() {
+		if c != nil {
+			c.Close()
+		}
+	}()
+
+	for m := range w.In {
+		p, err := cfg.message(m)
+		if err != nil {
+			glog.Errorln("MQTTPubEx:", err)
+			w.Status.Send(flow.Tag{"error", err.Error()})
+			continue
+		}
+		if glog.V(1) {
+			glog.Infoln("mqtt-pub", p.Topic, string(p.Payload))
+		}
+
+		//connect when needed, and have one more go on a fresh connection if the old one has gone
+		for attempt := 0; attempt < 2; attempt++ {
+			if c == nil {
+				if c, err = cfg.connect(b, "pub"); err != nil {
+					continue
+				}
+				w.Status.Send(flow.Tag{"connected", b.URL()})
+			}
+			if err = c.Publish(p, handshakeTimeout); err == nil {
+				break
+			}
+			c.Close()
+			c = nil
+			w.Status.Send(flow.Tag{"lost", err.Error()})
+		}
+		if err != nil {
+			glog.Errorln("MQTTPubEx: dropped message for", p.Topic, err)
+			w.Status.Send(flow.Tag{"error", err.Error()})
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TheDistractor/flow-ext/go-helpers/flowtest"
+	"github.com/TheDistractor/flow-ext/go-helpers/mqttbroker"
+	"github.com/jcw/flow"
+)
+
+func TestTopicTemplates(t *testing.T) {
+	topic, err := fillTopic("house/{room}/{kind}", map[string]interface{}{"room": "attic", "kind": "temp", "value": 21.5})
+	if err != nil || topic != "house/attic/temp" {
+		t.Error(topic, err)
+	}
+	if _, err := fillTopic("house/{room}", map[string]interface{}{"kind": "temp"}); err == nil {
+		t.Error("expected a missing field")
+	}
+	if _, err := fillTopic("house/{room}", map[string]interface{}{"room": "a/b"}); err == nil {
+		t.Error("a field can not add levels")
+	}
+
+	filter, err := subscription("house/{room}/temp")
+	if err != nil || filter != "house/+/temp" {
+		t.Error(filter, err)
+	}
+	if _, err := subscription("house/room-{n}"); err == nil {
+		t.Error("a {name} must be a whole level")
+	}
+	if got := captures("house/{room}/temp", "house/attic/temp"); got["room"] != "attic" || len(got) != 1 {
+		t.Error("unexpected captures", got)
+	}
+}
+
+func TestPubMessage(t *testing.T) {
+	cfg := &pubConfig{clientConfig: newClientConfig()}
+	for _, c := range []struct {
+		in      flow.Message
+		topic   string
+		payload string
+		retain  bool
+	}{
+		{flow.Tag{"sensor/attic", 21.5}, "sensor/attic", "21.5", false},
+		{flow.Tag{"/status", "up"}, "/status", `"up"`, true},
+		{flow.Tag{"raw", []byte("abc")}, "raw", "abc", false},
+		{flow.Tag{"node/{id}", map[string]interface{}{"id": 3.0}}, "node/3", `{"id":3}`, false},
+	} {
+		m, err := cfg.message(c.in)
+		if err != nil || m.Topic != c.topic || string(m.Payload) != c.payload || m.Retain != c.retain {
+			t.Errorf("%v: got %+v %v", c.in, m, err)
+		}
+	}
+
+	if _, err := cfg.message("no topic"); err == nil {
+		t.Error("a plain message needs a topic param")
+	}
+	cfg.apply(flow.Tag{"topic", "status/{node}"})
+	cfg.apply(flow.Tag{"retain", true})
+	cfg.apply(flow.Tag{"json", false})
+	m, err := cfg.message(map[string]interface{}{"node": "n1"})
+	if err != nil || m.Topic != "status/n1" || !m.Retain {
+		t.Error(m, err)
+	}
+	if m, _ := cfg.message(flow.Tag{"t", "plain"}); string(m.Payload) != "plain" {
+		t.Error("json off should send strings as they are", m)
+	}
+	if err := cfg.apply(flow.Tag{"qos", 2.0}); err == nil {
+		t.Error("QoS 2 is not supported")
+	}
+}
+
+func TestSubPub(t *testing.T) {
+	s, err := mqttbroker.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	sub := &MQTTSubEx{}
+	param, port, topic := make(chan flow.Message, 10), make(chan flow.Message, 1), make(chan flow.Message, 10)
+	out, subStatus := make(flowtest.Pin, 10), make(flowtest.Pin, 10)
+	sub.Param, sub.Port, sub.Topic, sub.Out, sub.Status = param, port, topic, out, subStatus
+	param <- flow.Tag{"qos", 1.0}
+	close(param)
+	port <- s.Addr()
+	close(port)
+	topic <- "sensor/{node}/reading"
+	topic <- "/status"
+	close(topic)
+	go sub.Run()
+	if st := subStatus.Next(t).(flow.Tag); st.Tag != "connected" {
+		t.Fatal("expected connected, got", st)
+	}
+
+	pub := &MQTTPubEx{}
+	param, port = make(chan flow.Message, 10), make(chan flow.Message, 1)
+	in, pubStatus := make(chan flow.Message, 10), make(flowtest.Pin, 10)
+	pub.Param, pub.Port, pub.In, pub.Status = param, port, in, pubStatus
+	param <- flow.Tag{"qos", 1.0}
+	param <- flow.Tag{"topic", "sensor/{node}/reading"}
+	close(param)
+	port <- s.Addr()
+	close(port)
+	go pub.Run()
+
+	in <- map[string]interface{}{"node": "rf12-5", "temp": 21.5}
+	in <- flow.Tag{"/status", "up"}
+	in <- flow.Tag{"sensor/n/reading", "not an object"}
+
+	got := out.Next(t).(flow.Tag)
+	fields, _ := got.Msg.(map[string]interface{})
+	if got.Tag != "sensor/rf12-5/reading" || fields["temp"] != 21.5 || fields["node"] != "rf12-5" {
+		t.Error("unexpected message", got)
+	}
+	if got := out.Next(t).(flow.Tag); got.Tag != "/status" || got.Msg != "up" {
+		t.Error("unexpected message", got)
+	}
+	if got := out.Next(t).(flow.Tag); got.Msg != "not an object" {
+		t.Error("unexpected message", got)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if v, ok := s.Retained("/status"); !ok || string(v) != `"up"` {
+		t.Error("a topic starting with / should be retained, as with the core MQTTPub")
+	}
+
+	//a lost broker connection is picked up again for the next message
+	s.Close()
+	s2, err := mqttbroker.Start(s.Addr())
+	if err != nil {
+		t.Skip("could not take over the port:", err)
+	}
+	defer s2.Close()
+	in <- flow.Tag{"/status", "again"}
+	deadline := time.Now().Add(wait)
+	for {
+		if v, _ := s2.Retained("/status"); string(v) == `"again"` {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("not published after reconnecting")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(in)
+}
+
+func TestPersistentSession(t *testing.T) {
+	sub := &MQTTSubEx{}
+	param, port, topic := make(chan flow.Message, 10), make(chan flow.Message, 1), make(chan flow.Message, 1)
+	status := make(flowtest.Pin, 10)
+	sub.Param, sub.Port, sub.Topic, sub.Status = param, port, topic, status
+	param <- flow.Tag{"clean", false}
+	close(param)
+	port <- "127.0.0.1:1"
+	close(port)
+	topic <- "x"
+	close(topic)
+	go sub.Run()
+
+	st := status.Next(t).(flow.Tag)
+	if st.Tag != "error" || st.Msg != "a persistent session (clean false) needs a clientid" {
+		t.Error("unexpected status", st)
+	}
+}
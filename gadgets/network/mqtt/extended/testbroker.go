@@ -0,0 +1,61 @@
+package mqtt
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/jcw/flow"
+	"github.com/TheDistractor/flow-ext/go-helpers/mqttbroker"
+)
+
+//MQTTTestBroker runs an in-memory MQTT 3.1.1 broker (see go-helpers/mqttbroker) on loopback or a unix socket,
+//for circuits that need MQTT without a real broker. It lives as long as the process.
+type MQTTTestBroker struct {
+	flow.Gadget
+	Param   flow.Input  //"user" tags of name:password, when given clients must log in
+	Port    flow.Input  //127.0.0.1:0 (any free port) by default, or unix:///path
+	PortOut flow.Output //where to connect, host:port or unix:///path
+	Status  flow.Output //"error" if it could not listen
+}
+
+// Start the broker.
+func (w *MQTTTestBroker) Run() {
+	s := mqttbroker.New()
+	var err error
+	for m := range w.Param {
+		p, _ := m.(flow.Tag)
+		if p.Tag != "user" {
+			err = fmt.Errorf("unknown param:%s", p.Tag)
+			continue
+		}
+		user, _ := p.Msg.(string)
+		parts := strings.SplitN(user, ":", 2)
+		if len(parts) != 2 {
+			err = fmt.Errorf("user must be name:password")
+			continue
+		}
+		if s.Users == nil {
+			s.Users = map[string]string{}
+		}
+		s.Users[parts[0]] = parts[1]
+	}
+
+	addr := "127.0.0.1:0"
+	if m := <-w.Port; m != nil {
+		addr = m.(string)
+	}
+	if err == nil {
+		err = s.Listen(addr)
+	}
+	if err != nil {
+		glog.Errorln("MQTTTestBroker:", err)
+		w.Status.Send(flow.Tag{"error", err.Error()})
+		return
+	}
+
+	if glog.V(2) {
+		glog.Infoln("MQTTTestBroker listening on", s.Addr())
+	}
+	w.PortOut.Send(s.Addr())
+}
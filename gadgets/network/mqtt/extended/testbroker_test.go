@@ -0,0 +1,98 @@
+package mqtt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TheDistractor/flow-ext/go-helpers/flowtest"
+	"github.com/TheDistractor/flow-ext/go-helpers/mqttwire"
+	"github.com/jcw/flow"
+)
+
+//startTestBroker gives the address of a new broker, or the error it reported
+func startTestBroker(t *testing.T, port string, params ...flow.Tag) (string, flow.Message) {
+	w := &MQTTTestBroker{}
+	param, portIn := make(chan flow.Message, 10), make(chan flow.Message, 1)
+	portOut, status := make(flowtest.Pin, 1), make(flowtest.Pin, 1)
+	w.Param, w.Port, w.PortOut, w.Status = param, portIn, portOut, status
+	for _, p := range params {
+		param <- p
+	}
+	close(param)
+	if port != "" {
+		portIn <- port
+	}
+	close(portIn)
+	w.Run()
+
+	select {
+	case m := <-portOut:
+		return m.(string), nil
+	case m := <-status:
+		return "", m
+	}
+}
+
+func TestTestBroker(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "mqtt")
+	defer os.RemoveAll(dir)
+	addr, failed := startTestBroker(t, "unix://"+filepath.Join(dir, "mqtt.sock"))
+	if failed != nil {
+		t.Fatal(failed)
+	}
+	if addr != "unix://"+filepath.Join(dir, "mqtt.sock") {
+		t.Fatal("unexpected PortOut", addr)
+	}
+
+	b, err := FindBroker(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := b.NewClient("test", time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Subscribe(time.Second, mqttwire.Subscription{Filter: "a/+", QoS: 1})
+	c.Publish(&mqttwire.Publish{Topic: "a/b", Payload: []byte("c"), QoS: 1}, time.Second)
+	select {
+	case m := <-c.Messages():
+		if m.Topic != "a/b" || string(m.Payload) != "c" {
+			t.Error("unexpected message", m)
+		}
+	case <-time.After(wait):
+		t.Fatal("nothing received")
+	}
+}
+
+func TestServerAgainstTestBroker(t *testing.T) {
+	addr, _ := startTestBroker(t, "", flow.Tag{"user", "jcw:secret"})
+
+	w := &RemoteMQTTServer{}
+	portOut, status := make(flowtest.Pin, 10), make(flowtest.Pin, 10)
+	w.PortOut, w.Status = portOut, status
+	go w.supervise(testBroker(addr), addr) //the wrong password
+
+	if s := status.Next(t).(flow.Tag); s.Tag != "refused" {
+		t.Error("expected refused, got", s)
+	}
+
+	b := testBroker(addr)
+	b.Password = "secret"
+	w = &RemoteMQTTServer{}
+	portOut, status = make(flowtest.Pin, 10), make(flowtest.Pin, 10)
+	w.PortOut, w.Status = portOut, status
+	go w.supervise(b, addr)
+	if s := status.Next(t).(flow.Tag); s.Tag != "connected" {
+		t.Error("expected connected, got", s)
+	}
+}
+
+func TestTestBrokerLoopbackOnly(t *testing.T) {
+	if _, failed := startTestBroker(t, "0.0.0.0:0"); failed == nil {
+		t.Error("expected an error for a public address")
+	}
+}
@@ -1,7 +1,6 @@
 package mqtt
 
 import (
-	"net"
 
 	"github.com/golang/glog"
 	"github.com/jcw/flow"
@@ -15,4 +14,7 @@ func init() {
 		glog.Infoln("Loading MQTTServerEx as MQTTServerEx into Registry...")
 	}
 	flow.Registry["MQTTServerEx"] = func() flow.Circuitry { return &mqttex.RemoteMQTTServer{} }
+	flow.Registry["MQTTBridge"] = func() flow.Circuitry { return &mqttex.MQTTBridge{} }
+	flow.Registry["MQTTTestBroker"] = func() flow.Circuitry { return &mqttex.MQTTTestBroker{} }
+	flow.Registry["StateStore"] = func() flow.Circuitry { return &mqttex.StateStore{} }
 }
@@ -0,0 +1,33 @@
+//Package flowtest helps test gadgets outside a circuit, by standing in for the pins their outputs are wired to.
+package flowtest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jcw/flow"
+)
+
+//how long Next waits for a message
+var Wait = 2 * time.Second
+
+//Pin collects whatever the gadget sends on an output, make it with room for all the messages a test expects
+//(Send blocks once it is full)
+type Pin chan flow.Message
+
+//Send is called by the gadget, as on a flow.Output
+func (p Pin) Send(v flow.Message) { p <- v }
+
+//Disconnect is called by the gadget, as on a flow.Output, and does nothing
+func (p Pin) Disconnect() {}
+
+//Next gives the next message sent, and fails the test if none comes within Wait
+func (p Pin) Next(t testing.TB) flow.Message {
+	select {
+	case m := <-p:
+		return m
+	case <-time.After(Wait):
+		t.Fatal("nothing received")
+	}
+	return nil
+}
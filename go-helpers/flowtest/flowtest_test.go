@@ -0,0 +1,21 @@
+package flowtest
+
+import (
+	"testing"
+
+	"github.com/jcw/flow"
+)
+
+func TestPin(t *testing.T) {
+	p := make(Pin, 2)
+	var out flow.Output = p
+	out.Send("a")
+	out.Send(flow.Tag{"b", 1})
+	out.Disconnect()
+	if m := p.Next(t); m != "a" {
+		t.Error("unexpected message", m)
+	}
+	if m := p.Next(t).(flow.Tag); m.Tag != "b" {
+		t.Error("unexpected message", m)
+	}
+}
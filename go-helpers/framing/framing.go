@@ -0,0 +1,440 @@
+//Package framing splits a byte stream (typically a serial port) into frames. Text lines are just one kind of frame,
+//binary devices may use fixed length frames, length prefixes, SLIP, COBS, a delimiter byte or simply a gap in
+//transmission to mark the end of a frame.
+package framing
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+//Framing modes
+const (
+	ModeLine      = "line"      //text lines, split on Terminator (default newline, with any \r removed)
+	ModeFixed     = "fixed"     //frames of exactly Length bytes
+	ModeLength    = "length"    //a 1, 2 or 4 byte length Prefix followed by that many bytes
+	ModeSLIP      = "slip"      //RFC 1055 SLIP
+	ModeCOBS      = "cobs"      //Consistent Overhead Byte Stuffing, zero byte delimited
+	ModeDelimiter = "delimiter" //frames end with the Delimiter byte
+	ModeIdle      = "idle"      //frames end when nothing arrives for Gap
+)
+
+//DefaultMaxFrame is the largest frame we accept unless told otherwise (bufio.Scanner's own limit is only 64KB)
+const DefaultMaxFrame = 1 << 20
+
+//Config describes how a stream is split into frames
+type Config struct {
+	Mode       string
+	Terminator []byte           //ModeLine, nil means newline
+	Length     int              //ModeFixed
+	Prefix     int              //ModeLength, size of the length prefix in bytes
+	Order      binary.ByteOrder //ModeLength, byte order of the length prefix
+	Delimiter  byte             //ModeDelimiter
+	Gap        time.Duration    //ModeIdle
+	MaxFrame   int              //frames larger than this are an error (ModeIdle emits what it has instead)
+}
+
+//NewConfig provides the default line framing, as used by the core SerialPort
+func NewConfig() Config {
+	return Config{Mode: ModeLine, Prefix: 1, Order: binary.BigEndian, MaxFrame: DefaultMaxFrame}
+}
+
+//ParseConfig creates a Config from a .Param value. This is either just the mode name or a hash such as:
+//
+//	{ mode: "length", prefix: 2, order: "little", max: 4096 }
+//	{ mode: "line", terminator: "\r\n" }
+//	{ mode: "delimiter", delimiter: 126 }
+//	{ mode: "fixed", length: 8 }
+//	{ mode: "idle", gap: 50 }      (gap in ms)
+func ParseConfig(v interface{}) (Config, error) {
+
+	cfg := NewConfig()
+
+	var hash map[string]interface{}
+	switch m := v.(type) {
+	case string:
+		hash = map[string]interface{}{"mode": m}
+	case map[string]interface{}:
+		hash = m
+	default:
+		return cfg, fmt.Errorf("framing must be a mode or a hash, got:%v", v)
+	}
+
+	for k, v := range hash {
+		var err error
+		switch k {
+		case "mode":
+			cfg.Mode, err = asString(k, v)
+		case "terminator":
+			var s string
+			s, err = asString(k, v)
+			cfg.Terminator = []byte(s)
+		case "order":
+			var s string
+			if s, err = asString(k, v); err == nil {
+				switch s {
+				case "big":
+					cfg.Order = binary.BigEndian
+				case "little":
+					cfg.Order = binary.LittleEndian
+				default:
+					err = fmt.Errorf("order must be big or little, got:%s", s)
+				}
+			}
+		case "length", "prefix", "delimiter", "gap", "max":
+			var n int
+			if n, err = asInt(k, v); err == nil {
+				switch k {
+				case "length":
+					cfg.Length = n
+				case "prefix":
+					cfg.Prefix = n
+				case "delimiter":
+					if n < 0 || n > 255 {
+						err = fmt.Errorf("delimiter must be a byte, got:%d", n)
+					}
+					cfg.Delimiter = byte(n)
+				case "gap":
+					cfg.Gap = time.Duration(n) * time.Millisecond
+				case "max":
+					cfg.MaxFrame = n
+				}
+			}
+		default:
+			err = fmt.Errorf("unknown framing option:%s", k)
+		}
+		if err != nil {
+			return cfg, err
+		}
+	}
+
+	return cfg, cfg.Validate()
+}
+
+func asString(k string, v interface{}) (string, error) {
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	return "", fmt.Errorf("%s must be a string, got:%v", k, v)
+}
+
+func asInt(k string, v interface{}) (int, error) {
+	switch n := v.(type) {
+	case float64:
+		return int(n), nil
+	case int:
+		return n, nil
+	}
+	return 0, fmt.Errorf("%s must be a number, got:%v", k, v)
+}
+
+//Validate checks the Config has what its mode needs
+func (c Config) Validate() error {
+	if c.MaxFrame <= 0 {
+		return errors.New("max frame size must be positive")
+	}
+	switch c.Mode {
+	case ModeLine, ModeSLIP, ModeCOBS, ModeDelimiter:
+	case ModeFixed:
+		if c.Length <= 0 || c.Length > c.MaxFrame {
+			return fmt.Errorf("fixed framing needs a length between 1 and %d", c.MaxFrame)
+		}
+	case ModeLength:
+		if c.Prefix != 1 && c.Prefix != 2 && c.Prefix != 4 {
+			return fmt.Errorf("length prefix must be 1, 2 or 4 bytes, got:%d", c.Prefix)
+		}
+		if c.Order == nil {
+			return errors.New("length framing needs a byte order")
+		}
+	case ModeIdle:
+		if c.Gap <= 0 {
+			return errors.New("idle framing needs a gap")
+		}
+	default:
+		return fmt.Errorf("unknown framing mode:%s", c.Mode)
+	}
+	return nil
+}
+
+//Binary is true for modes whose frames should be passed on as []byte rather than text
+func (c Config) Binary() bool {
+	return c.Mode != ModeLine
+}
+
+//Message converts a frame into what we send on: a string for text lines, otherwise a copy of the bytes
+func (c Config) Message(frame []byte) interface{} {
+	if !c.Binary() {
+		return string(frame)
+	}
+	b := make([]byte, len(frame))
+	copy(b, frame)
+	return b
+}
+
+//Reader provides frames one at a time, in the style of bufio.Scanner
+type Reader interface {
+	Scan() bool
+	Bytes() []byte
+	Err() error
+}
+
+//NewReader creates a Reader that splits r as described by cfg
+func NewReader(r io.Reader, cfg Config) Reader {
+	if cfg.Mode == ModeIdle {
+		return newIdleReader(r, cfg.Gap, cfg.MaxFrame)
+	}
+
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 4096), cfg.MaxFrame+8) //room for a length prefix or escapes on top of the frame
+	s.Split(cfg.SplitFunc())
+	return s
+}
+
+//SplitFunc provides the bufio.SplitFunc for the (non idle) framing mode
+func (c Config) SplitFunc() bufio.SplitFunc {
+	switch c.Mode {
+	case ModeFixed:
+		return c.splitFixed
+	case ModeLength:
+		return c.splitLength
+	case ModeSLIP:
+		return splitDelimited(slipEnd, decodeSLIP)
+	case ModeCOBS:
+		return splitDelimited(0, decodeCOBS)
+	case ModeDelimiter:
+		return splitDelimited(c.Delimiter, nil)
+	}
+
+	if len(c.Terminator) == 0 {
+		return bufio.ScanLines
+	}
+	return c.splitTerminator
+}
+
+func (c Config) splitTerminator(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.Index(data, c.Terminator); i >= 0 {
+		return i + len(c.Terminator), data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+func (c Config) splitFixed(data []byte, atEOF bool) (int, []byte, error) {
+	if len(data) >= c.Length {
+		return c.Length, data[:c.Length], nil
+	}
+	return 0, nil, nil //a short frame at EOF is dropped
+}
+
+func (c Config) splitLength(data []byte, atEOF bool) (int, []byte, error) {
+	if len(data) < c.Prefix {
+		return 0, nil, nil
+	}
+
+	var n int
+	switch c.Prefix {
+	case 1:
+		n = int(data[0])
+	case 2:
+		n = int(c.Order.Uint16(data))
+	case 4:
+		n = int(c.Order.Uint32(data))
+	}
+
+	if n > c.MaxFrame || n < 0 {
+		return 0, nil, fmt.Errorf("frame length %d exceeds maximum %d", n, c.MaxFrame)
+	}
+	if len(data) < c.Prefix+n {
+		return 0, nil, nil
+	}
+	return c.Prefix + n, data[c.Prefix : c.Prefix+n], nil
+}
+
+//splitDelimited splits on a delimiter byte, decoding each frame if required. Empty frames are skipped, as SLIP
+//and COBS senders commonly lead with a delimiter to flush out line noise.
+func splitDelimited(delim byte, decode func([]byte) ([]byte, error)) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		advance := 0
+		for {
+			i := bytes.IndexByte(data[advance:], delim)
+			if i < 0 {
+				return advance, nil, nil //a partial frame at EOF is dropped
+			}
+			frame := data[advance : advance+i]
+			advance += i + 1
+			if len(frame) == 0 {
+				continue
+			}
+			if decode != nil {
+				decoded, err := decode(frame)
+				if err != nil {
+					continue //corrupt frames are dropped, we resync on the next delimiter
+				}
+				frame = decoded
+			}
+			return advance, frame, nil
+		}
+	}
+}
+
+//SLIP special characters
+const (
+	slipEnd    = 0xC0
+	slipEsc    = 0xDB
+	slipEscEnd = 0xDC
+	slipEscEsc = 0xDD
+)
+
+func decodeSLIP(frame []byte) ([]byte, error) {
+	out := make([]byte, 0, len(frame))
+	for i := 0; i < len(frame); i++ {
+		b := frame[i]
+		if b == slipEsc {
+			if i++; i >= len(frame) {
+				return nil, errors.New("slip: escape at end of frame")
+			}
+			switch frame[i] {
+			case slipEscEnd:
+				b = slipEnd
+			case slipEscEsc:
+				b = slipEsc
+			default:
+				return nil, errors.New("slip: invalid escape")
+			}
+		}
+		out = append(out, b)
+	}
+	return out, nil
+}
+
+//EncodeSLIP wraps a frame for sending to a SLIP device
+func EncodeSLIP(frame []byte) []byte {
+	out := []byte{slipEnd}
+	for _, b := range frame {
+		switch b {
+		case slipEnd:
+			out = append(out, slipEsc, slipEscEnd)
+		case slipEsc:
+			out = append(out, slipEsc, slipEscEsc)
+		default:
+			out = append(out, b)
+		}
+	}
+	return append(out, slipEnd)
+}
+
+func decodeCOBS(frame []byte) ([]byte, error) {
+	out := make([]byte, 0, len(frame))
+	for i := 0; i < len(frame); {
+		code := int(frame[i])
+		if code == 0 {
+			return nil, errors.New("cobs: unexpected zero")
+		}
+		i++
+		for j := 1; j < code; j++ {
+			if i >= len(frame) {
+				return nil, errors.New("cobs: truncated frame")
+			}
+			out = append(out, frame[i])
+			i++
+		}
+		if code < 0xFF && i < len(frame) {
+			out = append(out, 0)
+		}
+	}
+	return out, nil
+}
+
+//EncodeCOBS stuffs a frame for sending to a COBS device, including the trailing zero delimiter
+func EncodeCOBS(frame []byte) []byte {
+	out := []byte{0}
+	code := 0 //index of the current code byte
+	for _, b := range frame {
+		if b == 0 {
+			out[code] = byte(len(out) - code)
+			code = len(out)
+			out = append(out, 0)
+			continue
+		}
+		out = append(out, b)
+		if len(out)-code == 0xFF {
+			out[code] = 0xFF
+			code = len(out)
+			out = append(out, 0)
+		}
+	}
+	out[code] = byte(len(out) - code)
+	return append(out, 0)
+}
+
+//idleReader ends a frame when nothing has been received for gap
+type idleReader struct {
+	chunks chan []byte
+	gap    time.Duration
+	max    int
+	frame  []byte
+	err    error
+}
+
+func newIdleReader(r io.Reader, gap time.Duration, max int) *idleReader {
+	ir := &idleReader{chunks: make(chan []byte, 16), gap: gap, max: max}
+	go func() {
+		defer close(ir.chunks)
+		buf := make([]byte, 4096)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				chunk := make([]byte, n)
+				copy(chunk, buf[:n])
+				ir.chunks <- chunk
+			}
+			if err != nil {
+				if err != io.EOF {
+					ir.err = err
+				}
+				return
+			}
+		}
+	}()
+	return ir
+}
+
+func (r *idleReader) Scan() bool {
+	r.frame = r.frame[:0]
+
+	//wait as long as it takes for a frame to start
+	chunk, ok := <-r.chunks
+	if !ok {
+		return false
+	}
+	r.frame = append(r.frame, chunk...)
+
+	for len(r.frame) < r.max {
+		select {
+		case chunk, ok := <-r.chunks:
+			if !ok {
+				return true
+			}
+			r.frame = append(r.frame, chunk...)
+		case <-time.After(r.gap):
+			return true
+		}
+	}
+	return true
+}
+
+func (r *idleReader) Bytes() []byte {
+	return r.frame
+}
+
+//Err is only valid once Scan has returned false
+func (r *idleReader) Err() error {
+	return r.err
+}
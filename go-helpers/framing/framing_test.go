@@ -0,0 +1,137 @@
+package framing
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func frames(t *testing.T, cfg Config, input []byte) []string {
+	r := NewReader(bytes.NewReader(input), cfg)
+	out := []string{}
+	for r.Scan() {
+		out = append(out, fmt.Sprintf("%q", r.Bytes()))
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func parse(t *testing.T, v interface{}) Config {
+	cfg, err := ParseConfig(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func expect(t *testing.T, got []string, want ...string) {
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestLineDefault(t *testing.T) {
+	expect(t, frames(t, NewConfig(), []byte("OK 1\r\nOK 2\npartial")), `"OK 1"`, `"OK 2"`, `"partial"`)
+}
+
+func TestLineLong(t *testing.T) {
+	long := strings.Repeat("x", 100000)
+	got := frames(t, NewConfig(), []byte(long+"\nshort\n"))
+	if len(got) != 2 || len(got[0]) != len(long)+2 {
+		t.Error("expected a line longer than 64KB to be read")
+	}
+}
+
+func TestLineTerminator(t *testing.T) {
+	cfg := parse(t, map[string]interface{}{"mode": "line", "terminator": "\r\n"})
+	expect(t, frames(t, cfg, []byte("a\nb\r\nc\r\n")), `"a\nb"`, `"c"`)
+}
+
+func TestFixed(t *testing.T) {
+	cfg := parse(t, map[string]interface{}{"mode": "fixed", "length": float64(3)})
+	expect(t, frames(t, cfg, []byte("abcdefgh")), `"abc"`, `"def"`)
+}
+
+func TestLengthPrefix(t *testing.T) {
+	cfg := parse(t, map[string]interface{}{"mode": "length", "prefix": float64(2), "order": "little"})
+	expect(t, frames(t, cfg, []byte{2, 0, 'h', 'i', 0, 0, 1, 0, '!'}), `"hi"`, `""`, `"!"`)
+
+	cfg.MaxFrame = 1
+	r := NewReader(bytes.NewReader([]byte{2, 0, 'h', 'i'}), cfg)
+	if r.Scan() || r.Err() == nil {
+		t.Error("expected an oversized frame to be an error")
+	}
+}
+
+func TestDelimiter(t *testing.T) {
+	cfg := parse(t, map[string]interface{}{"mode": "delimiter", "delimiter": float64('~')})
+	expect(t, frames(t, cfg, []byte("~ab~~cd~ef")), `"ab"`, `"cd"`)
+}
+
+func TestSLIP(t *testing.T) {
+	msg := []byte{1, slipEnd, 2, slipEsc, 3}
+	input := append(EncodeSLIP(msg), EncodeSLIP([]byte("ok"))...)
+	expect(t, frames(t, parse(t, "slip"), input), fmt.Sprintf("%q", msg), `"ok"`)
+}
+
+func TestCOBS(t *testing.T) {
+	long := bytes.Repeat([]byte{7}, 300)
+	msgs := [][]byte{{0}, {1, 0, 2, 0}, {0x11, 0x22, 0x33}, long}
+	input := []byte{}
+	want := []string{}
+	for _, m := range msgs {
+		input = append(input, EncodeCOBS(m)...)
+		want = append(want, fmt.Sprintf("%q", m))
+	}
+	expect(t, frames(t, parse(t, "cobs"), input), want...)
+}
+
+func TestIdle(t *testing.T) {
+	pr, pw := io.Pipe()
+	cfg := parse(t, map[string]interface{}{"mode": "idle", "gap": float64(30)})
+	r := NewReader(pr, cfg)
+
+	go func() {
+		pw.Write([]byte("/ISK5"))
+		pw.Write([]byte("\r\n1-0:1.8.1"))
+		time.Sleep(100 * time.Millisecond)
+		pw.Write([]byte("!ABCD"))
+		pw.Close()
+	}()
+
+	got := []string{}
+	for r.Scan() {
+		got = append(got, string(r.Bytes()))
+	}
+	expect(t, got, "/ISK5\r\n1-0:1.8.1", "!ABCD")
+}
+
+func TestParseConfigInvalid(t *testing.T) {
+	for _, v := range []interface{}{
+		"morse",
+		map[string]interface{}{"mode": "fixed"},
+		map[string]interface{}{"mode": "length", "prefix": float64(3)},
+		map[string]interface{}{"mode": "idle"},
+		map[string]interface{}{"mode": "delimiter", "delimiter": float64(300)},
+		map[string]interface{}{"mode": "line", "colour": "blue"},
+		float64(1),
+	} {
+		if _, err := ParseConfig(v); err == nil {
+			t.Errorf("expected %v to be invalid", v)
+		}
+	}
+}
+
+func TestMessage(t *testing.T) {
+	if _, ok := NewConfig().Message([]byte("OK")).(string); !ok {
+		t.Error("line frames should be strings")
+	}
+	if _, ok := parse(t, "slip").Message([]byte("OK")).([]byte); !ok {
+		t.Error("binary frames should be []byte")
+	}
+}
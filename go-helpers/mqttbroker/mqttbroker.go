@@ -0,0 +1,402 @@
+//Package mqttbroker is a small in-memory MQTT 3.1.1 broker for tests and circuits that need MQTT without a real one.
+//It does QoS 0 and 1, retained messages, wildcards and last wills, listens only on loopback or a unix socket,
+//and keeps nothing once a client has gone: every session is a clean one and QoS 1 messages are not resent.
+//5.0 clients are let in too, with properties ignored and retain as published and no local the only subscription
+//options.
+package mqttbroker
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TheDistractor/flow-ext/go-helpers/mqttwire"
+)
+
+//how long a new connection has to send its CONNECT
+var connectTimeout = 10 * time.Second
+
+//how many packets may wait for a slow client before it is dropped
+var outboxSize = 1000
+
+//Server is a running broker
+type Server struct {
+	Users map[string]string //if set before Listen, clients must log in as one of these (name -> password)
+
+	sync.Mutex
+	listener net.Listener
+	addr     string
+	sessions map[string]*session
+	retained map[string]*mqttwire.Publish
+	clientNo int
+}
+
+//New creates a broker, Listen starts it
+func New() *Server {
+	return &Server{sessions: map[string]*session{}, retained: map[string]*mqttwire.Publish{}}
+}
+
+//Start is New and Listen in one
+func Start(addr string) (*Server, error) {
+	s := New()
+	return s, s.Listen(addr)
+}
+
+//Listen starts serving on a loopback address such as 127.0.0.1:0 (any free port) or :1883 (taken as 127.0.0.1),
+//or on a unix socket given as unix:///path
+func (s *Server) Listen(addr string) error {
+	var l net.Listener
+	var err error
+
+	if strings.HasPrefix(addr, "unix:") {
+		path := strings.TrimPrefix(strings.TrimPrefix(addr, "unix:"), "//")
+		if l, err = net.Listen("unix", path); err != nil {
+			return err
+		}
+		s.addr = "unix://" + path
+	} else {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return err
+		}
+		if host == "" {
+			host = "127.0.0.1"
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return fmt.Errorf("test broker only listens on loopback or a unix socket, not:%s", host)
+		}
+		if l, err = net.Listen("tcp", net.JoinHostPort(host, port)); err != nil {
+			return err
+		}
+		s.addr = l.Addr().String()
+	}
+
+	s.listener = l
+	go s.serve(l)
+	return nil
+}
+
+//Addr is where clients connect, host:port or unix:///path
+func (s *Server) Addr() string {
+	return s.addr
+}
+
+//Close stops listening and drops every client, without publishing their wills
+func (s *Server) Close() error {
+	s.Lock()
+	sessions := s.sessions
+	s.sessions = map[string]*session{}
+	s.Unlock()
+
+	for _, c := range sessions {
+		c.lock.Lock()
+		c.will = nil
+		c.lock.Unlock()
+		c.close()
+	}
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+//Retained gives the retained message of a topic
+func (s *Server) Retained(topic string) ([]byte, bool) {
+	s.Lock()
+	defer s.Unlock()
+	m, ok := s.retained[topic]
+	if !ok {
+		return nil, false
+	}
+	return m.Payload, true
+}
+
+//Publish hands a message to the subscribers as if a client had sent it
+func (s *Server) Publish(m *mqttwire.Publish) {
+	s.publish(nil, m)
+}
+
+//publish hands on a message sent by a client (nil for the server itself), which doesn't get it back where it
+//subscribed with no local
+func (s *Server) publish(from *session, m *mqttwire.Publish) {
+	s.Lock()
+	defer s.Unlock()
+
+	if m.Retain {
+		if len(m.Payload) == 0 {
+			delete(s.retained, m.Topic)
+		} else {
+			kept := *m
+			s.retained[m.Topic] = &kept
+		}
+	}
+
+	for _, c := range s.sessions {
+		//one copy per client, at the highest QoS of its matching subscriptions
+		qos, retain, found := byte(0), false, false
+		for filter, sub := range c.subs {
+			if mqttwire.Match(filter, m.Topic) && !(sub.NoLocal && c == from) {
+				found = true
+				if sub.QoS > qos {
+					qos = sub.QoS
+				}
+				retain = retain || sub.RetainAsPublished && m.Retain
+			}
+		}
+		if found {
+			c.deliver(m, qos, retain)
+		}
+	}
+}
+
+func (s *Server) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+//session is a connected client, its subs are guarded by the Server lock
+type session struct {
+	id      string
+	conn    net.Conn
+	version byte
+	subs    map[string]mqttwire.Subscription
+	out     chan mqttwire.Packet
+	gone    chan struct{}
+	once    sync.Once
+
+	lock   sync.Mutex
+	nextID uint16
+	will   *mqttwire.Will
+}
+
+func (c *session) close() {
+	c.once.Do(func() {
+		close(c.gone)
+		c.conn.Close()
+	})
+}
+
+//send queues a packet for the client, one that cannot keep up is dropped
+func (c *session) send(p mqttwire.Packet) {
+	select {
+	case c.out <- p:
+	case <-c.gone:
+	default:
+		c.close()
+	}
+}
+
+func (c *session) deliver(m *mqttwire.Publish, qos byte, retain bool) {
+	out := &mqttwire.Publish{Topic: m.Topic, Payload: m.Payload, QoS: qos, Retain: retain}
+	if m.QoS < qos {
+		out.QoS = m.QoS
+	}
+	if out.QoS > 0 {
+		c.lock.Lock()
+		if c.nextID++; c.nextID == 0 {
+			c.nextID = 1
+		}
+		out.PacketID = c.nextID
+		c.lock.Unlock()
+	}
+	c.send(out.Packet(c.version))
+}
+
+func (c *session) write() {
+	for {
+		select {
+		case p := <-c.out:
+			if mqttwire.WritePacket(c.conn, p) != nil {
+				c.close()
+				return
+			}
+		case <-c.gone:
+			return
+		}
+	}
+}
+
+//login checks a CONNECT, giving the CONNACK code for its version
+func (s *Server) login(c *mqttwire.Connect) byte {
+	if c.Version != mqttwire.Version311 && c.Version != mqttwire.Version5 {
+		return 1
+	}
+	v5 := c.Version == mqttwire.Version5
+	if c.ClientID == "" && !c.CleanSession {
+		if v5 {
+			return 0x85
+		}
+		return 2
+	}
+	if s.Users != nil {
+		if pw, ok := s.Users[c.Username]; !ok || pw != c.Password {
+			if v5 {
+				return 0x86
+			}
+			return 4
+		}
+	}
+	return 0
+}
+
+func (s *Server) handle(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(connectTimeout))
+	p, err := mqttwire.ReadPacket(r)
+	if err != nil || p.Type != mqttwire.CONNECT {
+		conn.Close()
+		return
+	}
+	connect, err := mqttwire.ParseConnect(p.Body)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if code := s.login(connect); code != 0 {
+		version := connect.Version
+		if code == 1 {
+			version = mqttwire.Version311 //the only answer a client of any version understands
+		}
+		mqttwire.WritePacket(conn, mqttwire.ConnAck{Code: code}.Packet(version))
+		conn.Close()
+		return
+	}
+
+	c := &session{
+		id:      connect.ClientID,
+		conn:    conn,
+		version: connect.Version,
+		subs:    map[string]mqttwire.Subscription{},
+		out:     make(chan mqttwire.Packet, outboxSize),
+		gone:    make(chan struct{}),
+		will:    connect.Will,
+	}
+	s.Lock()
+	if c.id == "" {
+		s.clientNo++
+		c.id = fmt.Sprintf("mqttbroker-%d", s.clientNo)
+	}
+	if old := s.sessions[c.id]; old != nil { //taken over, the old one goes (with its will)
+		old.close()
+	}
+	s.sessions[c.id] = c
+	s.Unlock()
+
+	c.send(mqttwire.ConnAck{}.Packet(c.version))
+	go c.write()
+
+	err = s.read(c, r, time.Duration(connect.KeepAlive)*time.Second)
+	s.end(c, err == nil)
+}
+
+//read handles the client's packets, it returns nil when the client said goodbye with a DISCONNECT
+func (s *Server) read(c *session, r *bufio.Reader, keepAlive time.Duration) error {
+	for {
+		if keepAlive > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(keepAlive + keepAlive/2))
+		} else {
+			c.conn.SetReadDeadline(time.Time{})
+		}
+		p, err := mqttwire.ReadPacket(r)
+		if err != nil {
+			return err
+		}
+
+		switch p.Type {
+		case mqttwire.PUBLISH:
+			m, err := mqttwire.ParsePublish(c.version, p)
+			if err != nil {
+				return err
+			}
+			if m.QoS == 2 {
+				return errors.New("QoS 2 is not supported")
+			}
+			if strings.ContainsAny(m.Topic, "+#") || m.Topic == "" {
+				return fmt.Errorf("invalid topic name:%q", m.Topic)
+			}
+			if m.QoS == 1 {
+				c.send(mqttwire.Ack(mqttwire.PUBACK, m.PacketID))
+			}
+			s.publish(c, m)
+		case mqttwire.SUBSCRIBE:
+			sub, err := mqttwire.ParseSubscribe(c.version, p.Body)
+			if err != nil {
+				return err
+			}
+			s.subscribe(c, sub)
+		case mqttwire.UNSUBSCRIBE:
+			unsub, err := mqttwire.ParseUnsubscribe(c.version, p.Body)
+			if err != nil {
+				return err
+			}
+			s.Lock()
+			for _, f := range unsub.Filters {
+				delete(c.subs, f)
+			}
+			s.Unlock()
+			c.send(mqttwire.UnsubAck(c.version, unsub.PacketID, len(unsub.Filters)))
+		case mqttwire.PINGREQ:
+			c.send(mqttwire.Packet{Type: mqttwire.PINGRESP})
+		case mqttwire.PUBACK: //nothing is resent, so there is nothing to forget
+		case mqttwire.DISCONNECT:
+			return nil
+		default:
+			return fmt.Errorf("unexpected packet type %d", p.Type)
+		}
+	}
+}
+
+func (s *Server) subscribe(c *session, sub *mqttwire.Subscribe) {
+	s.Lock()
+	defer s.Unlock()
+
+	codes := make([]byte, len(sub.Topics))
+	for i, t := range sub.Topics {
+		if mqttwire.ValidFilter(t.Filter) != nil {
+			codes[i] = 0x80
+			continue
+		}
+		codes[i] = t.QoS
+		if codes[i] > 1 {
+			codes[i] = 1
+		}
+		c.subs[t.Filter] = mqttwire.Subscription{Filter: t.Filter, QoS: codes[i], RetainAsPublished: t.RetainAsPublished,
+			NoLocal: t.NoLocal}
+	}
+	c.send(mqttwire.SubAck(c.version, sub.PacketID, codes))
+
+	for _, m := range s.retained {
+		for i, t := range sub.Topics {
+			if codes[i] != 0x80 && mqttwire.Match(t.Filter, m.Topic) {
+				c.deliver(m, codes[i], true)
+				break
+			}
+		}
+	}
+}
+
+//end forgets a client, publishing its will unless it said goodbye
+func (s *Server) end(c *session, goodbye bool) {
+	s.Lock()
+	if s.sessions[c.id] == c {
+		delete(s.sessions, c.id)
+	}
+	s.Unlock()
+	c.close()
+
+	c.lock.Lock()
+	will := c.will
+	c.lock.Unlock()
+	if will != nil && !goodbye {
+		s.Publish(&mqttwire.Publish{Topic: will.Topic, Payload: will.Payload, QoS: will.QoS, Retain: will.Retain})
+	}
+}
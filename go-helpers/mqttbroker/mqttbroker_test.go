@@ -0,0 +1,263 @@
+package mqttbroker
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TheDistractor/flow-ext/go-helpers/mqttwire"
+)
+
+const wait = 2 * time.Second
+
+func dial(t *testing.T, s *Server, c *mqttwire.Connect) (*mqttwire.Client, mqttwire.ConnAck) {
+	network, addr := "tcp", s.Addr()
+	if strings.HasPrefix(addr, "unix://") {
+		network, addr = "unix", strings.TrimPrefix(addr, "unix://")
+	}
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Version == 0 {
+		c.Version = mqttwire.Version311
+	}
+	r := bufio.NewReader(conn)
+	ack, err := mqttwire.Handshake(conn, r, c, wait)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ack.Accepted() {
+		conn.Close()
+		return nil, ack
+	}
+	return mqttwire.NewClient(conn, r, c.Version, time.Duration(c.KeepAlive)*time.Second), ack
+}
+
+func client(t *testing.T, s *Server, id string) *mqttwire.Client {
+	c, _ := dial(t, s, &mqttwire.Connect{ClientID: id, CleanSession: true})
+	return c
+}
+
+func next(t *testing.T, c *mqttwire.Client) *mqttwire.Publish {
+	select {
+	case m := <-c.Messages():
+		return m
+	case <-time.After(wait):
+		t.Fatal("nothing received")
+	}
+	return nil
+}
+
+func none(t *testing.T, c *mqttwire.Client) {
+	select {
+	case m := <-c.Messages():
+		t.Error("unexpected message", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	s, err := Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	sub, pub := client(t, s, "sub"), client(t, s, "pub")
+	granted, err := sub.Subscribe(wait, mqttwire.Subscription{Filter: "sensor/+/temp", QoS: 1},
+		mqttwire.Subscription{Filter: "status/#", QoS: 2}, mqttwire.Subscription{Filter: "bad/#/filter"})
+	if err != nil || string(granted) != "\x01\x01\x80" {
+		t.Fatalf("got % x %v", granted, err)
+	}
+
+	pub.Publish(&mqttwire.Publish{Topic: "sensor/room/temp", Payload: []byte("21"), QoS: 1}, wait)
+	if m := next(t, sub); m.Topic != "sensor/room/temp" || string(m.Payload) != "21" || m.QoS != 1 || m.Retain {
+		t.Error("unexpected message", m)
+	}
+
+	pub.Publish(&mqttwire.Publish{Topic: "status", Payload: []byte("up")}, wait) //QoS 0 stays 0
+	if m := next(t, sub); m.Topic != "status" || m.QoS != 0 {
+		t.Error("unexpected message", m)
+	}
+
+	pub.Publish(&mqttwire.Publish{Topic: "sensor/room/hum", Payload: []byte("60")}, wait)
+	none(t, sub)
+
+	sub.Unsubscribe(wait, "status/#")
+	pub.Publish(&mqttwire.Publish{Topic: "status", Payload: []byte("down")}, wait)
+	none(t, sub)
+}
+
+func TestRetained(t *testing.T) {
+	s, _ := Start("127.0.0.1:0")
+	defer s.Close()
+
+	pub := client(t, s, "pub")
+	pub.Publish(&mqttwire.Publish{Topic: "sensor/cellar", Payload: []byte("12"), Retain: true, QoS: 1}, wait)
+	pub.Publish(&mqttwire.Publish{Topic: "sensor/attic", Payload: []byte("31"), Retain: true, QoS: 1}, wait)
+	pub.Publish(&mqttwire.Publish{Topic: "sensor/attic", Retain: true, QoS: 1}, wait) //cleared
+
+	if v, ok := s.Retained("sensor/cellar"); !ok || string(v) != "12" {
+		t.Error("not retained", v)
+	}
+
+	sub := client(t, s, "sub")
+	sub.Subscribe(wait, mqttwire.Subscription{Filter: "sensor/#"})
+	if m := next(t, sub); m.Topic != "sensor/cellar" || !m.Retain {
+		t.Error("unexpected message", m)
+	}
+	none(t, sub)
+
+	pub.Publish(&mqttwire.Publish{Topic: "sensor/cellar", Payload: []byte("13"), Retain: true}, wait)
+	if m := next(t, sub); string(m.Payload) != "13" || m.Retain {
+		t.Error("a live message is not sent as retained", m)
+	}
+}
+
+func TestRetainAsPublished(t *testing.T) {
+	s, _ := Start("127.0.0.1:0")
+	defer s.Close()
+
+	pub := client(t, s, "pub")
+	sub, _ := dial(t, s, &mqttwire.Connect{Version: mqttwire.Version5, ClientID: "sub", CleanSession: true})
+	sub.Subscribe(wait, mqttwire.Subscription{Filter: "sensor/#", QoS: 1, RetainAsPublished: true})
+	plain, _ := dial(t, s, &mqttwire.Connect{Version: mqttwire.Version5, ClientID: "plain", CleanSession: true})
+	plain.Subscribe(wait, mqttwire.Subscription{Filter: "sensor/#", QoS: 1})
+
+	pub.Publish(&mqttwire.Publish{Topic: "sensor/cellar", Payload: []byte("13"), Retain: true}, wait)
+	if m := next(t, sub); string(m.Payload) != "13" || !m.Retain {
+		t.Error("the retained flag should be kept", m)
+	}
+	if m := next(t, plain); m.Retain {
+		t.Error("the retained flag should be cleared", m)
+	}
+	pub.Publish(&mqttwire.Publish{Topic: "sensor/cellar", Payload: []byte("14")}, wait)
+	if m := next(t, sub); m.Retain {
+		t.Error("not published as retained", m)
+	}
+	if err := sub.Unsubscribe(wait, "sensor/#"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNoLocal(t *testing.T) {
+	s, _ := Start("127.0.0.1:0")
+	defer s.Close()
+
+	own, _ := dial(t, s, &mqttwire.Connect{Version: mqttwire.Version5, ClientID: "own", CleanSession: true})
+	own.Subscribe(wait, mqttwire.Subscription{Filter: "sensor/#", QoS: 1, NoLocal: true})
+	other := client(t, s, "other")
+	other.Subscribe(wait, mqttwire.Subscription{Filter: "sensor/#", QoS: 1})
+
+	own.Publish(&mqttwire.Publish{Topic: "sensor/cellar", Payload: []byte("13"), QoS: 1}, wait)
+	if m := next(t, other); string(m.Payload) != "13" {
+		t.Error("unexpected message", m)
+	}
+	other.Publish(&mqttwire.Publish{Topic: "sensor/attic", Payload: []byte("31"), QoS: 1}, wait)
+	if m := next(t, own); m.Topic != "sensor/attic" {
+		t.Error("got its own message back", m)
+	}
+	if m := next(t, other); m.Topic != "sensor/attic" {
+		t.Error("a subscription without no local gets its own messages", m)
+	}
+	none(t, own)
+}
+
+func TestWill(t *testing.T) {
+	s, _ := Start("127.0.0.1:0")
+	defer s.Close()
+
+	sub := client(t, s, "sub")
+	sub.Subscribe(wait, mqttwire.Subscription{Filter: "node/#"})
+
+	will := &mqttwire.Will{Topic: "node/status", Payload: []byte("offline"), Retain: true}
+	gone, _ := dial(t, s, &mqttwire.Connect{ClientID: "node", CleanSession: true, Will: will})
+	polite, _ := dial(t, s, &mqttwire.Connect{ClientID: "polite", CleanSession: true,
+		Will: &mqttwire.Will{Topic: "node/polite", Payload: []byte("offline")}})
+
+	polite.Close() //a DISCONNECT, so no will
+	gone.Publish(&mqttwire.Publish{Topic: "node/x", Payload: []byte("!")}, wait)
+	next(t, sub)
+
+	//dropping the connection without a DISCONNECT is what a crash looks like
+	s.Lock()
+	s.sessions["node"].conn.Close()
+	s.Unlock()
+
+	if m := next(t, sub); m.Topic != "node/status" || string(m.Payload) != "offline" {
+		t.Error("expected the will, got", m)
+	}
+	if v, _ := s.Retained("node/status"); string(v) != "offline" {
+		t.Error("will not retained")
+	}
+}
+
+func TestLogin(t *testing.T) {
+	s := New()
+	s.Users = map[string]string{"jcw": "secret"}
+	if err := s.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, ack := dial(t, s, &mqttwire.Connect{ClientID: "a", Username: "jcw", Password: "wrong", CleanSession: true}); ack.Code != 4 {
+		t.Error("expected bad user name or password, got", ack)
+	}
+	if _, ack := dial(t, s, &mqttwire.Connect{Version: 3, ClientID: "a", CleanSession: true}); ack.Code != 1 {
+		t.Error("expected unacceptable protocol version, got", ack)
+	}
+	if _, ack := dial(t, s, &mqttwire.Connect{Version: mqttwire.Version5, ClientID: "a", CleanSession: true}); ack.Code != 0x86 {
+		t.Error("expected a 5.0 bad user name or password, got", ack)
+	}
+	c, ack := dial(t, s, &mqttwire.Connect{Username: "jcw", Password: "secret", CleanSession: true})
+	if c == nil {
+		t.Fatal("refused", ack)
+	}
+	c.Close()
+}
+
+func TestTakeOver(t *testing.T) {
+	s, _ := Start("127.0.0.1:0")
+	defer s.Close()
+
+	first := client(t, s, "same")
+	second := client(t, s, "same")
+	select {
+	case <-first.Done():
+	case <-time.After(wait):
+		t.Error("the first connection should be dropped")
+	}
+	if _, err := second.Subscribe(wait, mqttwire.Subscription{Filter: "x"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUnixAndLoopback(t *testing.T) {
+	if _, err := Start("192.0.2.1:1883"); err == nil {
+		t.Error("should only listen on loopback")
+	}
+
+	dir, _ := ioutil.TempDir("", "mqttbroker")
+	defer os.RemoveAll(dir)
+	s, err := Start("unix://" + filepath.Join(dir, "mqtt.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.Addr() != "unix://"+filepath.Join(dir, "mqtt.sock") {
+		t.Error("unexpected address", s.Addr())
+	}
+
+	c := client(t, s, "unix")
+	c.Subscribe(wait, mqttwire.Subscription{Filter: "#"})
+	s.Publish(&mqttwire.Publish{Topic: "hello", Payload: []byte("world")})
+	if m := next(t, c); m.Topic != "hello" {
+		t.Error("unexpected message", m)
+	}
+}
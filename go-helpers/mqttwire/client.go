@@ -0,0 +1,227 @@
+package mqttwire
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+//ErrClosed is returned for calls on a Client whose connection has gone
+var ErrClosed = errors.New("mqtt connection closed")
+
+//Client is a minimal QoS 0/1 MQTT client on a connection that has already done its Handshake.
+//It keeps the connection alive with PINGREQs and hands incoming PUBLISHes to Messages.
+type Client struct {
+	conn      net.Conn
+	version   byte
+	keepAlive time.Duration
+
+	wlock sync.Mutex //one packet at a time on the wire
+
+	sync.Mutex
+	nextID  uint16
+	pending map[uint16]chan Packet //PUBACK and SUBACK waiters
+	err     error
+
+	msgs chan *Publish
+	done chan struct{}
+}
+
+//NewClient takes over a connection after Handshake, r must be the reader used for the handshake
+func NewClient(conn net.Conn, r *bufio.Reader, version byte, keepAlive time.Duration) *Client {
+	c := &Client{
+		conn:      conn,
+		version:   version,
+		keepAlive: keepAlive,
+		pending:   map[uint16]chan Packet{},
+		msgs:      make(chan *Publish, 256),
+		done:      make(chan struct{}),
+	}
+	go c.read(r)
+	if keepAlive > 0 {
+		go c.ping()
+	}
+	return c
+}
+
+//Messages delivers what the broker publishes to us, it is closed when the connection goes
+func (c *Client) Messages() <-chan *Publish {
+	return c.msgs
+}
+
+//Done is closed when the connection goes, Err then says why
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+//Err gives the reason the connection went, nil while it is up
+func (c *Client) Err() error {
+	c.Lock()
+	defer c.Unlock()
+	return c.err
+}
+
+func (c *Client) fail(err error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	c.conn.Close()
+	close(c.done)
+}
+
+func (c *Client) write(p Packet) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	if err := WritePacket(c.conn, p); err != nil {
+		c.fail(err)
+		return err
+	}
+	return nil
+}
+
+func (c *Client) read(r *bufio.Reader) {
+	defer close(c.msgs)
+	for {
+		if c.keepAlive > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(c.keepAlive + c.keepAlive/2))
+		}
+		p, err := ReadPacket(r)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+
+		switch p.Type {
+		case PUBLISH:
+			m, err := ParsePublish(c.version, p)
+			if err != nil {
+				c.fail(err)
+				return
+			}
+			if m.QoS == 2 { //we never subscribe with 2, so a broker should not send it
+				c.fail(errors.New("QoS 2 PUBLISH is not supported"))
+				return
+			}
+			select {
+			case c.msgs <- m:
+			case <-c.done:
+				return
+			}
+			if m.QoS == 1 {
+				c.write(Ack(PUBACK, m.PacketID))
+			}
+		case PUBACK, SUBACK, UNSUBACK:
+			c.Lock()
+			ch := c.pending[PacketID(p.Body)]
+			delete(c.pending, PacketID(p.Body))
+			c.Unlock()
+			if ch != nil {
+				ch <- p
+			}
+		case PINGRESP:
+		case DISCONNECT:
+			c.fail(fmt.Errorf("broker disconnected us: %s", Reason(c.version, ParseDisconnect(p.Body))))
+			return
+		default:
+			c.fail(fmt.Errorf("unexpected packet type %d", p.Type))
+			return
+		}
+	}
+}
+
+func (c *Client) ping() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-time.After(c.keepAlive / 2):
+			if c.write(Packet{Type: PINGREQ}) != nil {
+				return
+			}
+		}
+	}
+}
+
+//request sends a packet with a fresh id and waits up to timeout for its answer
+func (c *Client) request(timeout time.Duration, p func(id uint16) Packet) (Packet, error) {
+	c.Lock()
+	if c.err != nil {
+		c.Unlock()
+		return Packet{}, ErrClosed
+	}
+	c.nextID++
+	if c.nextID == 0 {
+		c.nextID = 1
+	}
+	id := c.nextID
+	ch := make(chan Packet, 1)
+	c.pending[id] = ch
+	c.Unlock()
+
+	if err := c.write(p(id)); err != nil {
+		return Packet{}, err
+	}
+	select {
+	case a := <-ch:
+		return a, nil
+	case <-c.done:
+		return Packet{}, ErrClosed
+	case <-time.After(timeout):
+		c.Lock()
+		delete(c.pending, id)
+		c.Unlock()
+		return Packet{}, fmt.Errorf("no answer from broker within %v", timeout)
+	}
+}
+
+//Publish sends a message, for QoS 1 it waits up to timeout for the PUBACK
+func (c *Client) Publish(m *Publish, timeout time.Duration) error {
+	switch m.QoS {
+	case 0:
+		if c.Err() != nil {
+			return ErrClosed
+		}
+		return c.write(m.Packet(c.version))
+	case 1:
+		_, err := c.request(timeout, func(id uint16) Packet {
+			m.PacketID = id
+			return m.Packet(c.version)
+		})
+		return err
+	}
+	return fmt.Errorf("QoS %d is not supported", m.QoS)
+}
+
+//Subscribe asks for messages matching the topic filters, giving the QoS granted for each (0x80 is a refusal)
+func (c *Client) Subscribe(timeout time.Duration, topics ...Subscription) ([]byte, error) {
+	a, err := c.request(timeout, func(id uint16) Packet {
+		return (&Subscribe{id, topics}).Packet(c.version)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ParseSubAck(c.version, a.Body)
+}
+
+//Unsubscribe drops topic filters given to Subscribe
+func (c *Client) Unsubscribe(timeout time.Duration, filters ...string) error {
+	_, err := c.request(timeout, func(id uint16) Packet {
+		return (&Unsubscribe{id, filters}).Packet(c.version)
+	})
+	return err
+}
+
+//Close says goodbye to the broker and drops the connection
+func (c *Client) Close() error {
+	if c.Err() == nil {
+		c.write(Packet{Type: DISCONNECT})
+	}
+	c.fail(ErrClosed)
+	return nil
+}
@@ -0,0 +1,106 @@
+package mqttwire
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+//serve plays a broker on the other end of a pipe: it grants subscriptions, acks QoS 1 and
+//sends every PUBLISH straight back
+func serve(t *testing.T, conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		p, err := ReadPacket(r)
+		if err != nil {
+			return
+		}
+		switch p.Type {
+		case SUBSCRIBE:
+			s, _ := ParseSubscribe(Version311, p.Body)
+			codes := []byte{}
+			for _, topic := range s.Topics {
+				codes = append(codes, topic.QoS)
+			}
+			WritePacket(conn, SubAck(Version311, s.PacketID, codes))
+		case PUBLISH:
+			m, _ := ParsePublish(Version311, p)
+			if m.QoS == 1 {
+				WritePacket(conn, Ack(PUBACK, m.PacketID))
+			}
+			m.PacketID = 99
+			WritePacket(conn, m.Packet(Version311))
+		case PUBACK:
+			if PacketID(p.Body) != 99 {
+				t.Error("unexpected PUBACK", p)
+			}
+		case PINGREQ:
+			WritePacket(conn, Packet{Type: PINGRESP})
+		case DISCONNECT:
+			conn.Close()
+			return
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	a, b := net.Pipe()
+	go serve(t, b)
+	c := NewClient(a, bufio.NewReader(a), Version311, 200*time.Millisecond)
+
+	granted, err := c.Subscribe(time.Second, Subscription{Filter: "sensor/#", QoS: 1})
+	if err != nil || len(granted) != 1 || granted[0] != 1 {
+		t.Fatal(granted, err)
+	}
+
+	for _, qos := range []byte{0, 1} {
+		if err := c.Publish(&Publish{Topic: "sensor/temp", Payload: []byte("21"), QoS: qos}, time.Second); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case m := <-c.Messages():
+			if m.Topic != "sensor/temp" || string(m.Payload) != "21" || m.QoS != qos {
+				t.Error("unexpected message", m)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("message did not come back")
+		}
+	}
+
+	time.Sleep(500 * time.Millisecond) //kept alive by pings
+	if c.Err() != nil {
+		t.Fatal("connection dropped:", c.Err())
+	}
+
+	c.Close()
+	if _, ok := <-c.Messages(); ok {
+		t.Error("Messages should close with the connection")
+	}
+	if err := c.Publish(&Publish{Topic: "late"}, time.Second); err != ErrClosed {
+		t.Error("expected a closed client, got", err)
+	}
+}
+
+func TestClientSilentBroker(t *testing.T) {
+	a, b := net.Pipe()
+	go func() { //reads, but never answers
+		r := bufio.NewReader(b)
+		for {
+			if _, err := ReadPacket(r); err != nil {
+				return
+			}
+		}
+	}()
+	defer b.Close()
+
+	c := NewClient(a, bufio.NewReader(a), Version311, 100*time.Millisecond)
+	if err := c.Publish(&Publish{Topic: "t", QoS: 1}, 50*time.Millisecond); err == nil {
+		t.Error("expected a PUBACK timeout")
+	}
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatal("a broker that does not answer pings should be dropped")
+	}
+}
@@ -0,0 +1,399 @@
+//Package mqttwire reads and writes MQTT control packets (3.1.1 and the parts of 5.0 we need), enough for the
+//network gadgets to talk to a broker themselves rather than trusting that anything listening on 1883 is one.
+package mqttwire
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+//Protocol levels, as sent in CONNECT
+const (
+	Version311 = 4
+	Version5   = 5
+)
+
+//Control packet types
+const (
+	CONNECT     = 1
+	CONNACK     = 2
+	PUBLISH     = 3
+	PUBACK      = 4
+	PUBREC      = 5
+	PUBREL      = 6
+	PUBCOMP     = 7
+	SUBSCRIBE   = 8
+	SUBACK      = 9
+	UNSUBSCRIBE = 10
+	UNSUBACK    = 11
+	PINGREQ     = 12
+	PINGRESP    = 13
+	DISCONNECT  = 14
+)
+
+//MaxPacket bounds the packets we accept, MQTT allows up to 256MB which is no use to us
+var MaxPacket = 1 << 20
+
+//ErrNotMQTT is returned when whatever answered clearly does not speak MQTT (an HTTP server on 1883, say)
+var ErrNotMQTT = errors.New("not an MQTT broker")
+
+//ParseVersion accepts "3.1.1", "5", "5.0" or the protocol level itself
+func ParseVersion(v interface{}) (byte, error) {
+	switch v {
+	case "3.1.1", "4", 4.0, Version311:
+		return Version311, nil
+	case "5", "5.0", 5.0, Version5:
+		return Version5, nil
+	}
+	return 0, fmt.Errorf("unsupported MQTT version:%v", v)
+}
+
+//Packet is a raw control packet
+type Packet struct {
+	Type  byte
+	Flags byte
+	Body  []byte
+}
+
+//WritePacket sends a packet with its fixed header
+func WritePacket(w io.Writer, p Packet) error {
+	hdr := []byte{p.Type<<4 | p.Flags&0x0F}
+	hdr = appendVarint(hdr, len(p.Body))
+	_, err := w.Write(append(hdr, p.Body...))
+	return err
+}
+
+//ReadPacket reads the next packet, r should be buffered
+func ReadPacket(r io.ByteReader) (Packet, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return Packet{}, err
+	}
+	n, err := readVarint(r)
+	if err != nil {
+		return Packet{}, err
+	}
+	if n > MaxPacket {
+		return Packet{}, fmt.Errorf("packet of %d bytes is too large", n)
+	}
+	body := make([]byte, n)
+	for i := range body {
+		if body[i], err = r.ReadByte(); err != nil {
+			return Packet{}, err
+		}
+	}
+	return Packet{first >> 4, first & 0x0F, body}, nil
+}
+
+func appendVarint(b []byte, n int) []byte {
+	for {
+		c := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			c |= 0x80
+		}
+		b = append(b, c)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+func readVarint(r io.ByteReader) (int, error) {
+	n, mul := 0, 1
+	for i := 0; i < 4; i++ {
+		c, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		n += int(c&0x7F) * mul
+		if c&0x80 == 0 {
+			return n, nil
+		}
+		mul *= 128
+	}
+	return 0, errors.New("malformed remaining length")
+}
+
+func appendString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+//reader walks through a packet body
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.b) {
+		r.err = errors.New("packet too short")
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *reader) byte() byte {
+	if v := r.bytes(1); v != nil {
+		return v[0]
+	}
+	return 0
+}
+
+func (r *reader) uint16() uint16 {
+	if v := r.bytes(2); v != nil {
+		return binary.BigEndian.Uint16(v)
+	}
+	return 0
+}
+
+func (r *reader) string() string {
+	return string(r.bytes(int(r.uint16())))
+}
+
+func (r *reader) varint() int {
+	if r.err != nil {
+		return 0
+	}
+	br := &byteSlice{r.b}
+	n, err := readVarint(br)
+	r.b = br.b
+	if err != nil {
+		r.err = err
+	}
+	return n
+}
+
+//skipProperties passes over a 5.0 property block, we send none and do not need any we are sent
+func (r *reader) skipProperties() {
+	r.bytes(r.varint())
+}
+
+type byteSlice struct{ b []byte }
+
+func (s *byteSlice) ReadByte() (byte, error) {
+	if len(s.b) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	c := s.b[0]
+	s.b = s.b[1:]
+	return c, nil
+}
+
+//Will is the message a broker publishes for a client that goes away without a DISCONNECT
+type Will struct {
+	Topic   string
+	Payload []byte
+	QoS     byte
+	Retain  bool
+}
+
+//Connect is a CONNECT packet
+type Connect struct {
+	Version      byte
+	ClientID     string
+	Username     string
+	Password     string
+	CleanSession bool
+	KeepAlive    uint16 //seconds
+	Will         *Will
+}
+
+//Packet encodes the CONNECT
+func (c *Connect) Packet() Packet {
+	flags := byte(0)
+	if c.CleanSession {
+		flags |= 0x02
+	}
+	if c.Will != nil {
+		flags |= 0x04 | c.Will.QoS<<3
+		if c.Will.Retain {
+			flags |= 0x20
+		}
+	}
+	if c.Password != "" {
+		flags |= 0x40
+	}
+	if c.Username != "" {
+		flags |= 0x80
+	}
+
+	b := appendString(nil, "MQTT")
+	b = append(b, c.Version, flags, byte(c.KeepAlive>>8), byte(c.KeepAlive))
+	if c.Version == Version5 {
+		b = append(b, 0) //no properties
+	}
+	b = appendString(b, c.ClientID)
+	if c.Will != nil {
+		if c.Version == Version5 {
+			b = append(b, 0)
+		}
+		b = appendString(b, c.Will.Topic)
+		b = appendString(b, string(c.Will.Payload))
+	}
+	if c.Username != "" {
+		b = appendString(b, c.Username)
+	}
+	if c.Password != "" {
+		b = appendString(b, c.Password)
+	}
+	return Packet{Type: CONNECT, Body: b}
+}
+
+//ParseConnect decodes a CONNECT body
+func ParseConnect(body []byte) (*Connect, error) {
+	r := &reader{b: body}
+	if name := r.string(); r.err == nil && name != "MQTT" {
+		return nil, fmt.Errorf("unknown protocol name:%q", name)
+	}
+	c := &Connect{Version: r.byte()}
+	flags := r.byte()
+	c.KeepAlive = r.uint16()
+	if c.Version == Version5 {
+		r.skipProperties()
+	}
+	c.CleanSession = flags&0x02 != 0
+	c.ClientID = r.string()
+	if flags&0x04 != 0 {
+		if c.Version == Version5 {
+			r.skipProperties()
+		}
+		c.Will = &Will{Topic: r.string(), QoS: flags >> 3 & 0x03, Retain: flags&0x20 != 0}
+		c.Will.Payload = r.bytes(int(r.uint16()))
+	}
+	if flags&0x80 != 0 {
+		c.Username = r.string()
+	}
+	if flags&0x40 != 0 {
+		c.Password = r.string()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return c, nil
+}
+
+//ConnAck is a CONNACK packet, Code is the 3.1.1 return code or 5.0 reason code
+type ConnAck struct {
+	SessionPresent bool
+	Code           byte
+}
+
+//Packet encodes the CONNACK for a protocol version
+func (a ConnAck) Packet(version byte) Packet {
+	b := []byte{0, a.Code}
+	if a.SessionPresent {
+		b[0] = 1
+	}
+	if version == Version5 {
+		b = append(b, 0)
+	}
+	return Packet{Type: CONNACK, Body: b}
+}
+
+//ParseConnAck decodes a CONNACK body
+func ParseConnAck(body []byte) (ConnAck, error) {
+	if len(body) < 2 {
+		return ConnAck{}, errors.New("CONNACK too short")
+	}
+	return ConnAck{SessionPresent: body[0]&1 != 0, Code: body[1]}, nil
+}
+
+//Accepted reports whether the broker let us in
+func (a ConnAck) Accepted() bool {
+	return a.Code == 0
+}
+
+var reasons311 = map[byte]string{
+	0: "accepted",
+	1: "unacceptable protocol version",
+	2: "identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+var reasons5 = map[byte]string{
+	0x00: "success",
+	0x80: "unspecified error",
+	0x81: "malformed packet",
+	0x82: "protocol error",
+	0x83: "implementation specific error",
+	0x84: "unsupported protocol version",
+	0x85: "client identifier not valid",
+	0x86: "bad user name or password",
+	0x87: "not authorized",
+	0x88: "server unavailable",
+	0x89: "server busy",
+	0x8A: "banned",
+	0x8B: "server shutting down",
+	0x8C: "bad authentication method",
+	0x8D: "keep alive timeout",
+	0x8E: "session taken over",
+	0x95: "packet too large",
+	0x97: "quota exceeded",
+	0x9C: "use another server",
+	0x9D: "server moved",
+	0x9F: "connection rate exceeded",
+}
+
+//Reason describes a CONNACK code (or 5.0 DISCONNECT reason)
+func Reason(version, code byte) string {
+	table := reasons311
+	if version == Version5 {
+		table = reasons5
+	}
+	if s, ok := table[code]; ok {
+		return s
+	}
+	return fmt.Sprintf("unknown reason 0x%02X", code)
+}
+
+//Handshake sends CONNECT and waits up to timeout for the CONNACK. A refusal is not an error, check Accepted.
+//A 5.0 broker that does not do 5.0 may answer with a 3.1.1 CONNACK (code 1), which is passed back as it is.
+func Handshake(conn net.Conn, r *bufio.Reader, c *Connect, timeout time.Duration) (ConnAck, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if err := WritePacket(conn, c.Packet()); err != nil {
+		return ConnAck{}, err
+	}
+
+	first, err := r.Peek(1)
+	if err != nil {
+		return ConnAck{}, err
+	}
+	if first[0] != CONNACK<<4 {
+		return ConnAck{}, ErrNotMQTT
+	}
+
+	p, err := ReadPacket(r)
+	if err != nil {
+		return ConnAck{}, err
+	}
+	return ParseConnAck(p.Body)
+}
+
+//Ping sends a PINGREQ, the PINGRESP arrives like any other packet
+func Ping(w io.Writer) error {
+	return WritePacket(w, Packet{Type: PINGREQ})
+}
+
+//ParseDisconnect gives the reason code of a 5.0 DISCONNECT (a 3.1.1 one has none, which is success)
+func ParseDisconnect(body []byte) byte {
+	if len(body) == 0 {
+		return 0
+	}
+	return body[0]
+}
@@ -0,0 +1,113 @@
+package mqttwire
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestVarint(t *testing.T) {
+	for _, n := range []int{0, 127, 128, 16383, 16384, 2097151, 2097152, 268435455} {
+		b := appendVarint(nil, n)
+		got, err := readVarint(bytes.NewReader(b))
+		if err != nil || got != n {
+			t.Errorf("%d: got %d %v from % x", n, got, err, b)
+		}
+	}
+	if _, err := readVarint(bytes.NewReader([]byte{0xFF, 0xFF, 0xFF, 0xFF, 0x01})); err == nil {
+		t.Error("expected a malformed length")
+	}
+}
+
+func TestConnectRoundTrip(t *testing.T) {
+	for _, v := range []byte{Version311, Version5} {
+		c := &Connect{
+			Version: v, ClientID: "housemon", Username: "jcw", Password: "secret", CleanSession: true, KeepAlive: 30,
+			Will: &Will{Topic: "housemon/status", Payload: []byte("offline"), QoS: 1, Retain: true},
+		}
+
+		var buf bytes.Buffer
+		WritePacket(&buf, c.Packet())
+		p, err := ReadPacket(bufio.NewReader(&buf))
+		if err != nil || p.Type != CONNECT {
+			t.Fatal(p, err)
+		}
+
+		got, err := ParseConnect(p.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Version != v || got.ClientID != "housemon" || got.Username != "jcw" || got.Password != "secret" ||
+			!got.CleanSession || got.KeepAlive != 30 || got.Will == nil || got.Will.Topic != "housemon/status" ||
+			string(got.Will.Payload) != "offline" || got.Will.QoS != 1 || !got.Will.Retain {
+			t.Errorf("version %d: got %+v %+v", v, got, got.Will)
+		}
+	}
+
+	if _, err := ParseConnect([]byte{0, 4, 'M', 'Q'}); err == nil {
+		t.Error("expected a short packet to fail")
+	}
+}
+
+func TestReasons(t *testing.T) {
+	if Reason(Version311, 4) != "bad user name or password" || Reason(Version5, 0x86) != "bad user name or password" {
+		t.Error("unexpected reasons")
+	}
+	if Reason(Version311, 0x86) != "unknown reason 0x86" {
+		t.Error("3.1.1 does not know 5.0 codes")
+	}
+	for _, v := range []interface{}{"3.1.1", "5.0", 5.0} {
+		if _, err := ParseVersion(v); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := ParseVersion("3.1"); err == nil {
+		t.Error("3.1 is not supported")
+	}
+}
+
+//broker answers a CONNECT with whatever reply says
+func broker(t *testing.T, reply []byte) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := ReadPacket(bufio.NewReader(conn)); err != nil {
+			return
+		}
+		conn.Write(reply)
+		time.Sleep(100 * time.Millisecond)
+	}()
+	return l.Addr().String()
+}
+
+func TestHandshake(t *testing.T) {
+	for _, c := range []struct {
+		reply []byte
+		code  byte
+		err   error
+	}{
+		{[]byte{CONNACK << 4, 2, 0, 0}, 0, nil},
+		{[]byte{CONNACK << 4, 3, 0, 0x86, 0}, 0x86, nil},
+		{[]byte("HTTP/1.1 400 Bad Request\r\n\r\n"), 0, ErrNotMQTT},
+	} {
+		conn, err := net.Dial("tcp", broker(t, c.reply))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ack, err := Handshake(conn, bufio.NewReader(conn), &Connect{Version: Version5, ClientID: "t"}, time.Second)
+		conn.Close()
+		if err != c.err || ack.Code != c.code {
+			t.Errorf("%q: got %v %v", c.reply, ack, err)
+		}
+	}
+}
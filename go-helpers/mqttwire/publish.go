@@ -0,0 +1,248 @@
+package mqttwire
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+//Publish is a PUBLISH packet, PacketID is only used for QoS 1 and 2
+type Publish struct {
+	Topic    string
+	Payload  []byte
+	QoS      byte
+	Retain   bool
+	Dup      bool
+	PacketID uint16
+}
+
+//Packet encodes the PUBLISH for a protocol version
+func (m *Publish) Packet(version byte) Packet {
+	flags := m.QoS << 1
+	if m.Retain {
+		flags |= 0x01
+	}
+	if m.Dup {
+		flags |= 0x08
+	}
+
+	b := appendString(nil, m.Topic)
+	if m.QoS > 0 {
+		b = append(b, byte(m.PacketID>>8), byte(m.PacketID))
+	}
+	if version == Version5 {
+		b = append(b, 0) //no properties
+	}
+	return Packet{Type: PUBLISH, Flags: flags, Body: append(b, m.Payload...)}
+}
+
+//ParsePublish decodes a PUBLISH packet
+func ParsePublish(version byte, p Packet) (*Publish, error) {
+	r := &reader{b: p.Body}
+	m := &Publish{
+		Topic:  r.string(),
+		QoS:    p.Flags >> 1 & 0x03,
+		Retain: p.Flags&0x01 != 0,
+		Dup:    p.Flags&0x08 != 0,
+	}
+	if m.QoS == 3 {
+		return nil, errors.New("PUBLISH with QoS 3")
+	}
+	if m.QoS > 0 {
+		m.PacketID = r.uint16()
+	}
+	if version == Version5 {
+		r.skipProperties()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	m.Payload = append([]byte{}, r.b...)
+	return m, nil
+}
+
+//Ack is one of the packets that only carry a packet id: PUBACK, PUBREC, PUBREL, PUBCOMP and UNSUBACK (3.1.1)
+func Ack(kind byte, id uint16) Packet {
+	flags := byte(0)
+	if kind == PUBREL {
+		flags = 0x02
+	}
+	return Packet{Type: kind, Flags: flags, Body: []byte{byte(id >> 8), byte(id)}}
+}
+
+//PacketID gives the packet id at the start of an ack, SUBACK or (UN)SUBSCRIBE body
+func PacketID(body []byte) uint16 {
+	if len(body) < 2 {
+		return 0
+	}
+	return uint16(body[0])<<8 | uint16(body[1])
+}
+
+//Subscription is one topic filter of a SUBSCRIBE, with the maximum QoS wanted
+type Subscription struct {
+	Filter            string
+	QoS               byte
+	RetainAsPublished bool //5.0 only: keep the retained flag on live messages, 3.1.1 brokers always clear it
+	NoLocal           bool //5.0 only: don't send back what this client publishes itself, 3.1.1 brokers always do
+}
+
+//in the 5.0 subscription options
+const (
+	noLocal           = 0x04
+	retainAsPublished = 0x08
+)
+
+//Subscribe is a SUBSCRIBE packet
+type Subscribe struct {
+	PacketID uint16
+	Topics   []Subscription
+}
+
+//Packet encodes the SUBSCRIBE for a protocol version
+func (s *Subscribe) Packet(version byte) Packet {
+	b := []byte{byte(s.PacketID >> 8), byte(s.PacketID)}
+	if version == Version5 {
+		b = append(b, 0)
+	}
+	for _, t := range s.Topics {
+		b = appendString(b, t.Filter)
+		opts := t.QoS
+		if t.RetainAsPublished && version == Version5 {
+			opts |= retainAsPublished
+		}
+		if t.NoLocal && version == Version5 {
+			opts |= noLocal
+		}
+		b = append(b, opts)
+	}
+	return Packet{Type: SUBSCRIBE, Flags: 0x02, Body: b}
+}
+
+//ParseSubscribe decodes a SUBSCRIBE body
+func ParseSubscribe(version byte, body []byte) (*Subscribe, error) {
+	r := &reader{b: body}
+	s := &Subscribe{PacketID: r.uint16()}
+	if version == Version5 {
+		r.skipProperties()
+	}
+	for r.err == nil && len(r.b) > 0 {
+		filter, opts := r.string(), r.byte()
+		s.Topics = append(s.Topics, Subscription{Filter: filter, QoS: opts & 0x03,
+			RetainAsPublished: version == Version5 && opts&retainAsPublished != 0,
+			NoLocal:           version == Version5 && opts&noLocal != 0})
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(s.Topics) == 0 {
+		return nil, errors.New("SUBSCRIBE without topics")
+	}
+	return s, nil
+}
+
+//SubAck encodes the SUBACK for a SUBSCRIBE, codes holds the granted QoS (or 0x80 for a failure) per topic
+func SubAck(version byte, id uint16, codes []byte) Packet {
+	b := []byte{byte(id >> 8), byte(id)}
+	if version == Version5 {
+		b = append(b, 0)
+	}
+	return Packet{Type: SUBACK, Body: append(b, codes...)}
+}
+
+//ParseSubAck gives the codes of a SUBACK body
+func ParseSubAck(version byte, body []byte) ([]byte, error) {
+	r := &reader{b: body}
+	r.uint16()
+	if version == Version5 {
+		r.skipProperties()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return append([]byte{}, r.b...), nil
+}
+
+//UnsubAck encodes the UNSUBACK for an UNSUBSCRIBE of n filters, 5.0 has a (success) reason code for each
+func UnsubAck(version byte, id uint16, n int) Packet {
+	if version != Version5 {
+		return Ack(UNSUBACK, id)
+	}
+	b := []byte{byte(id >> 8), byte(id), 0}
+	return Packet{Type: UNSUBACK, Body: append(b, make([]byte, n)...)}
+}
+
+//Unsubscribe is an UNSUBSCRIBE packet
+type Unsubscribe struct {
+	PacketID uint16
+	Filters  []string
+}
+
+//Packet encodes the UNSUBSCRIBE for a protocol version
+func (u *Unsubscribe) Packet(version byte) Packet {
+	b := []byte{byte(u.PacketID >> 8), byte(u.PacketID)}
+	if version == Version5 {
+		b = append(b, 0)
+	}
+	for _, f := range u.Filters {
+		b = appendString(b, f)
+	}
+	return Packet{Type: UNSUBSCRIBE, Flags: 0x02, Body: b}
+}
+
+//ParseUnsubscribe decodes an UNSUBSCRIBE body
+func ParseUnsubscribe(version byte, body []byte) (*Unsubscribe, error) {
+	r := &reader{b: body}
+	u := &Unsubscribe{PacketID: r.uint16()}
+	if version == Version5 {
+		r.skipProperties()
+	}
+	for r.err == nil && len(r.b) > 0 {
+		u.Filters = append(u.Filters, r.string())
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(u.Filters) == 0 {
+		return nil, errors.New("UNSUBSCRIBE without topics")
+	}
+	return u, nil
+}
+
+//ValidFilter checks a topic filter, # may only be the last level and wildcards must fill a whole level
+func ValidFilter(filter string) error {
+	if filter == "" {
+		return errors.New("empty topic filter")
+	}
+	levels := strings.Split(filter, "/")
+	for i, l := range levels {
+		if strings.ContainsAny(l, "+#") && len(l) > 1 {
+			return fmt.Errorf("wildcard must fill a level:%s", filter)
+		}
+		if l == "#" && i != len(levels)-1 {
+			return fmt.Errorf("# must be the last level:%s", filter)
+		}
+	}
+	return nil
+}
+
+//Match reports whether a topic name matches a filter with + and # wildcards.
+//As the spec asks, wildcards at the first level do not match $SYS and other $ topics.
+func Match(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+
+	f, t := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, l := range f {
+		if l == "#" {
+			return true
+		}
+		if i >= len(t) {
+			return false
+		}
+		if l != "+" && l != t[i] {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
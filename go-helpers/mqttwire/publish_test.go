@@ -0,0 +1,89 @@
+package mqttwire
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+func TestPublishRoundTrip(t *testing.T) {
+	for _, v := range []byte{Version311, Version5} {
+		for _, m := range []*Publish{
+			{Topic: "sensor/room/temp", Payload: []byte("21.5"), Retain: true},
+			{Topic: "sensor/room/temp", Payload: []byte{}, QoS: 1, PacketID: 7, Dup: true},
+		} {
+			var buf bytes.Buffer
+			WritePacket(&buf, m.Packet(v))
+			p, err := ReadPacket(bufio.NewReader(&buf))
+			if err != nil || p.Type != PUBLISH {
+				t.Fatal(p, err)
+			}
+			got, err := ParsePublish(v, p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Topic != m.Topic || string(got.Payload) != string(m.Payload) || got.QoS != m.QoS ||
+				got.Retain != m.Retain || got.Dup != m.Dup || got.PacketID != m.PacketID {
+				t.Errorf("version %d: got %+v, want %+v", v, got, m)
+			}
+		}
+	}
+}
+
+func TestSubscribeRoundTrip(t *testing.T) {
+	for _, v := range []byte{Version311, Version5} {
+		s := &Subscribe{42, []Subscription{{Filter: "sensor/#", QoS: 1, RetainAsPublished: v == Version5}, {Filter: "+/status", NoLocal: v == Version5}}}
+		got, err := ParseSubscribe(v, s.Packet(v).Body)
+		if err != nil || got.PacketID != 42 || len(got.Topics) != 2 || got.Topics[0] != s.Topics[0] || got.Topics[1] != s.Topics[1] {
+			t.Errorf("version %d: got %+v %v", v, got, err)
+		}
+
+		a := SubAck(v, 42, []byte{1, 0x80})
+		codes, err := ParseSubAck(v, a.Body)
+		if err != nil || PacketID(a.Body) != 42 || !bytes.Equal(codes, []byte{1, 0x80}) {
+			t.Errorf("version %d: got %v %v", v, codes, err)
+		}
+	}
+	//the 3.1.1 options byte has no room for retain as published or no local
+	s := &Subscribe{42, []Subscription{{Filter: "sensor/#", QoS: 1, RetainAsPublished: true, NoLocal: true}}}
+	if got, _ := ParseSubscribe(Version311, s.Packet(Version311).Body); got.Topics[0].RetainAsPublished {
+		t.Error("retain as published sent to a 3.1.1 broker")
+	} else if got.Topics[0].NoLocal {
+		t.Error("no local sent to a 3.1.1 broker")
+	}
+	if a := UnsubAck(Version5, 42, 2); len(a.Body) != 5 || PacketID(a.Body) != 42 {
+		t.Error("unexpected UNSUBACK", a)
+	}
+	if _, err := ParseSubscribe(Version311, []byte{0, 1}); err == nil {
+		t.Error("a SUBSCRIBE needs topics")
+	}
+}
+
+func TestMatch(t *testing.T) {
+	for _, c := range []struct {
+		filter, topic string
+		match         bool
+	}{
+		{"sensor/#", "sensor/room/temp", true},
+		{"sensor/#", "sensor", true},
+		{"sensor/+/temp", "sensor/room/temp", true},
+		{"sensor/+/temp", "sensor/room/hum", false},
+		{"sensor/+", "sensor/room/temp", false},
+		{"+/+", "/finance", true},
+		{"#", "anything/at/all", true},
+		{"#", "$SYS/uptime", false},
+		{"+/uptime", "$SYS/uptime", false},
+		{"$SYS/#", "$SYS/uptime", true},
+		{"sensor/room", "sensor/room/temp", false},
+	} {
+		if Match(c.filter, c.topic) != c.match {
+			t.Errorf("%s %s: expected %v", c.filter, c.topic, c.match)
+		}
+	}
+
+	for _, bad := range []string{"", "sensor/#/temp", "sensor/te+", "sensor#"} {
+		if ValidFilter(bad) == nil {
+			t.Error("expected", bad, "to be invalid")
+		}
+	}
+}
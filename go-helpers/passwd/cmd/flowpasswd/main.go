@@ -0,0 +1,44 @@
+//flowpasswd writes a line for a passwords file (see the passwd package), reading the password from stdin:
+//
+//	flowpasswd jcw >> passwords
+//
+//htpasswd can't be used, its hashes are not ones passwd.Check knows.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/TheDistractor/flow-ext/go-helpers/passwd"
+)
+
+func main() {
+	flag.IntVar(&passwd.Iterations, "i", passwd.Iterations, "PBKDF2 iterations")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: flowpasswd [-i iterations] name >> passwords")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 || flag.Arg(0) == "" || strings.ContainsAny(flag.Arg(0), ":\n") {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	fmt.Fprint(os.Stderr, "password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		fmt.Fprintln(os.Stderr, "flowpasswd: no password given", err)
+		os.Exit(1)
+	}
+
+	hash, err := passwd.Hash(password)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "flowpasswd:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s:%s\n", flag.Arg(0), hash)
+}
@@ -0,0 +1,115 @@
+//Package passwd hashes and checks passwords as kept in password files: one name:hash per line, blank lines and
+//lines starting with # are skipped. Hashes are salted PBKDF2-SHA256, written as pbkdf2-sha256$iterations$salt$key
+//with salt and key in unpadded base64. The flowpasswd command writes such lines.
+package passwd
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+//how many rounds Hash uses, Check takes whatever the hash says
+var Iterations = 20000
+
+const scheme = "pbkdf2-sha256"
+
+var b64 = base64.RawStdEncoding
+
+//Hash gives the hash to put in a password file for a password
+func Hash(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2([]byte(password), salt, Iterations, sha256.Size)
+	return fmt.Sprintf("%s$%d$%s$%s", scheme, Iterations, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+//parse splits a hash into its parts
+func parse(hash string) (iter int, salt, key []byte, err error) {
+	if strings.HasPrefix(hash, "$2") || strings.HasPrefix(hash, "$apr1$") {
+		return 0, nil, nil, errors.New("htpasswd hashes are not supported, use flowpasswd (go-helpers/passwd/cmd/flowpasswd)")
+	}
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != scheme {
+		return 0, nil, nil, errors.New("not a " + scheme + " hash")
+	}
+	if iter, err = strconv.Atoi(parts[1]); err != nil || iter < 1 {
+		return 0, nil, nil, errors.New("bad iteration count")
+	}
+	if salt, err = b64.DecodeString(parts[2]); err != nil {
+		return 0, nil, nil, err
+	}
+	if key, err = b64.DecodeString(parts[3]); err != nil || len(key) == 0 {
+		return 0, nil, nil, errors.New("bad key")
+	}
+	return iter, salt, key, nil
+}
+
+//Check tells whether a password matches a hash
+func Check(hash, password string) bool {
+	iter, salt, key, err := parse(hash)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(key, pbkdf2([]byte(password), salt, iter, len(key))) == 1
+}
+
+//Load reads a password file, giving name -> hash
+func Load(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := map[string]string{}
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 1 {
+			return nil, fmt.Errorf("%s:%d: expected name:hash", file, n)
+		}
+		if _, _, _, err := parse(line[i+1:]); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, n, err)
+		}
+		users[line[:i]] = line[i+1:]
+	}
+	return users, s.Err()
+}
+
+//pbkdf2 is PBKDF2 (RFC 8018) with HMAC-SHA256
+func pbkdf2(password, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write([]byte{byte(block >> 24), byte(block >> 16), byte(block >> 8), byte(block)})
+		u := prf.Sum(nil)
+		t := append([]byte{}, u...)
+		for i := 1; i < iter; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
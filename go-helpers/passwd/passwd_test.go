@@ -0,0 +1,66 @@
+package passwd
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPBKDF2(t *testing.T) {
+	//vectors for PBKDF2-HMAC-SHA256 as published alongside RFC 7914
+	for _, v := range []struct {
+		p, s string
+		c    int
+		want string
+	}{
+		{"password", "salt", 1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{"password", "salt", 2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{"password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+	} {
+		if got := hex.EncodeToString(pbkdf2([]byte(v.p), []byte(v.s), v.c, 32)); got != v.want {
+			t.Errorf("%d rounds: got %s", v.c, got)
+		}
+	}
+}
+
+func TestHashCheck(t *testing.T) {
+	h, err := Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(h, "pbkdf2-sha256$") {
+		t.Error("unexpected hash", h)
+	}
+	if !Check(h, "secret") || Check(h, "Secret") || Check("secret", "secret") {
+		t.Error("check failed")
+	}
+	if h2, _ := Hash("secret"); h2 == h {
+		t.Error("hash not salted")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "passwd")
+	defer os.RemoveAll(dir)
+	h, _ := Hash("secret")
+
+	file := filepath.Join(dir, "passwords")
+	ioutil.WriteFile(file, []byte("# users\n\njcw:"+h+"\n"), 0600)
+	users, err := Load(file)
+	if err != nil || !Check(users["jcw"], "secret") {
+		t.Error("not loaded", users, err)
+	}
+
+	ioutil.WriteFile(file, []byte("jcw:secret\n"), 0600)
+	if _, err := Load(file); err == nil || !strings.Contains(err.Error(), ":1:") {
+		t.Error("expected an error for a plain password, got", err)
+	}
+
+	ioutil.WriteFile(file, []byte("jcw:$2y$05$c4WoMPo3SXsafkva.HHa6uXQZWr7oboPiC2bT/r7q1BB8I2s0BRqC\n"), 0600)
+	if _, err := Load(file); err == nil || !strings.Contains(err.Error(), "flowpasswd") {
+		t.Error("expected htpasswd to be refused, got", err)
+	}
+}
@@ -0,0 +1,187 @@
+// +build linux
+
+//Package ptytest fakes a serial device with a Linux pseudo-terminal pair, so serial gadgets can be tested without hardware.
+//The gadget opens Path (the slave side) as it would a real port, the test plays the device on the master side.
+package ptytest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+//Line is a line written by the gadget, with the time it was read on the master side
+type Line struct {
+	Text string
+	At   time.Time
+}
+
+//Step is one exchange of a device Script: wait for the gadget to send Expect (if any),
+//pause for Delay, then answer with Reply.
+type Step struct {
+	Expect string
+	Delay  time.Duration
+	Reply  []string
+}
+
+//Device is the master side of a pty pair
+type Device struct {
+	Path   string //slave device, give this to the gadget's .Port
+	master *os.File
+	slave  *os.File //held open so the master does not see EIO while the gadget has the port closed
+	r      *bufio.Reader
+}
+
+//Open creates a pty pair in raw mode
+func Open() (*Device, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var n uint32
+	unlock := int32(0)
+	if err := ioctl(master, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err != nil {
+		master.Close()
+		return nil, err
+	}
+	if err := ioctl(master, syscall.TIOCGPTN, unsafe.Pointer(&n)); err != nil {
+		master.Close()
+		return nil, err
+	}
+	path := fmt.Sprintf("/dev/pts/%d", n)
+
+	slave, err := os.OpenFile(path, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, err
+	}
+	if err := makeRaw(slave); err != nil {
+		slave.Close()
+		master.Close()
+		return nil, err
+	}
+
+	return &Device{Path: path, master: master, slave: slave, r: bufio.NewReader(master)}, nil
+}
+
+func ioctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	conn, err := f.SyscallConn() //avoids Fd(), which would take the file out of the poller and lose deadlines
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	if err := conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg))
+	}); err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+//makeRaw is cfmakeraw(3), no echo, no line editing and no newline translation
+func makeRaw(f *os.File) error {
+	var t syscall.Termios
+	if err := ioctl(f, syscall.TCGETS, unsafe.Pointer(&t)); err != nil {
+		return err
+	}
+	t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	t.Oflag &^= syscall.OPOST
+	t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	t.Cflag &^= syscall.CSIZE | syscall.PARENB
+	t.Cflag |= syscall.CS8
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+	return ioctl(f, syscall.TCSETS, unsafe.Pointer(&t))
+}
+
+//Write sends raw bytes to the gadget
+func (d *Device) Write(p []byte) (int, error) {
+	return d.master.Write(p)
+}
+
+//Send sends each string to the gadget as a newline terminated line
+func (d *Device) Send(lines ...string) error {
+	for _, l := range lines {
+		if _, err := d.master.Write([]byte(l + "\n")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//ReadLine waits up to timeout for the next line from the gadget
+func (d *Device) ReadLine(timeout time.Duration) (Line, error) {
+	d.master.SetReadDeadline(time.Now().Add(timeout))
+	text, err := d.r.ReadString('\n')
+	if err != nil {
+		return Line{}, err
+	}
+	return Line{strings.TrimRight(text, "\r\n"), time.Now()}, nil
+}
+
+//ReadFull waits up to timeout for exactly n bytes from the gadget
+func (d *Device) ReadFull(n int, timeout time.Duration) ([]byte, error) {
+	d.master.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, n)
+	got := 0
+	for got < n {
+		c, err := d.r.Read(buf[got:])
+		got += c
+		if err != nil {
+			return buf[:got], err
+		}
+	}
+	return buf, nil
+}
+
+//Expect reads lines until one equals want, failing if it does not arrive within timeout
+func (d *Device) Expect(want string, timeout time.Duration) (Line, error) {
+	deadline := time.Now().Add(timeout)
+	seen := []string{}
+	for {
+		l, err := d.ReadLine(deadline.Sub(time.Now()))
+		if err != nil {
+			return l, fmt.Errorf("expected %q, got %q: %v", want, seen, err)
+		}
+		if l.Text == want {
+			return l, nil
+		}
+		seen = append(seen, l.Text)
+	}
+}
+
+//Script plays the device side of a conversation, each Expect must arrive within timeout
+func (d *Device) Script(steps []Step, timeout time.Duration) error {
+	for i, s := range steps {
+		if s.Expect != "" {
+			if _, err := d.Expect(s.Expect, timeout); err != nil {
+				return fmt.Errorf("step %d: %v", i, err)
+			}
+		}
+		time.Sleep(s.Delay)
+		if err := d.Send(s.Reply...); err != nil {
+			return fmt.Errorf("step %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+//Close hangs up, the gadget sees its port go away just like an unplugged device
+func (d *Device) Close() error {
+	if d.master == nil {
+		return errors.New("ptytest: already closed")
+	}
+	d.slave.Close()
+	err := d.master.Close()
+	d.master = nil
+	return err
+}
@@ -0,0 +1,39 @@
+// +build linux
+
+package ptytest
+
+import (
+	"bufio"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLoopback(t *testing.T) {
+	d, err := Open()
+	if err != nil {
+		t.Skip("no pty available:", err)
+	}
+	defer d.Close()
+
+	port, err := os.OpenFile(d.Path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer port.Close()
+
+	go d.Script([]Step{{Expect: "v", Reply: []string{"[RF12demo.12] A i1 g5 @ 868 MHz"}}}, time.Second)
+
+	port.Write([]byte("v\n"))
+	line, err := bufio.NewReader(port).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "[RF12demo.12] A i1 g5 @ 868 MHz\n" {
+		t.Errorf("got %q", line)
+	}
+
+	if _, err := d.ReadLine(50 * time.Millisecond); err == nil {
+		t.Error("expected a timeout with nothing written")
+	}
+}
@@ -0,0 +1,56 @@
+//Package termios applies the serial line settings the serial libraries we use do not offer, such as mark/space
+//parity, hardware or software flow control and read timeouts. Settings are applied to the device path after the port
+//is opened.
+package termios
+
+import (
+	"fmt"
+	"time"
+)
+
+//Parity modes
+const (
+	ParityNone  = "none"
+	ParityOdd   = "odd"
+	ParityEven  = "even"
+	ParityMark  = "mark"
+	ParitySpace = "space"
+)
+
+//LineSettings describes the line discipline for a serial device.
+type LineSettings struct {
+	Parity      string        //one of the Parity modes, "" is the same as none
+	RTSCTS      bool          //hardware flow control
+	XONXOFF     bool          //software flow control
+	ReadTimeout time.Duration //a read returns empty if nothing arrives for this long (VTIME), 0 waits forever
+}
+
+//MaxReadTimeout is the longest ReadTimeout, VTIME counts tenths of a second in a byte
+const MaxReadTimeout = 255 * time.Second / 10
+
+//IsDefault is true if the settings leave the port as the serial library opened it (8N1, no flow control)
+func (ls LineSettings) IsDefault() bool {
+	return (ls.Parity == "" || ls.Parity == ParityNone) && !ls.RTSCTS && !ls.XONXOFF && ls.ReadTimeout == 0
+}
+
+//vtime gives ReadTimeout in tenths of a second, rounded up
+func (ls LineSettings) vtime() uint8 {
+	return uint8((ls.ReadTimeout + time.Second/10 - 1) / (time.Second / 10))
+}
+
+//ValidParity checks p is one of the Parity modes
+func ValidParity(p string) error {
+	switch p {
+	case ParityNone, ParityOdd, ParityEven, ParityMark, ParitySpace:
+		return nil
+	}
+	return fmt.Errorf("unknown parity:%s", p)
+}
+
+//ValidReadTimeout checks d is one VTIME can express
+func ValidReadTimeout(d time.Duration) error {
+	if d < 0 || d > MaxReadTimeout {
+		return fmt.Errorf("read timeout must be between 0 and %v, got:%v", MaxReadTimeout, d)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+// +build darwin
+
+package termios
+
+import (
+	"errors"
+	"syscall"
+	"unsafe"
+)
+
+const crtscts = 0x30000 //hardware flow control (CCTS_OFLOW|CRTS_IFLOW), not exported by syscall
+
+//Check tells whether Apply can set ls, mark/space parity is not available on OSX
+func Check(ls LineSettings) error {
+	if ls.Parity == ParityMark || ls.Parity == ParitySpace {
+		return errors.New("mark/space parity is not supported on darwin")
+	}
+	return nil
+}
+
+//Apply sets parity, flow control and the read timeout on the serial device at path
+func Apply(path string, ls LineSettings) error {
+
+	if err := Check(ls); err != nil {
+		return err
+	}
+
+	fd, err := syscall.Open(path, syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	var t syscall.Termios
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TIOCGETA, uintptr(unsafe.Pointer(&t))); errno != 0 {
+		return errno
+	}
+
+	t.Cflag &^= syscall.PARENB | syscall.PARODD | crtscts
+	t.Iflag &^= syscall.INPCK | syscall.IXON | syscall.IXOFF | syscall.IXANY
+
+	switch ls.Parity {
+	case ParityOdd:
+		t.Cflag |= syscall.PARENB | syscall.PARODD
+	case ParityEven:
+		t.Cflag |= syscall.PARENB
+	}
+	if t.Cflag&syscall.PARENB != 0 {
+		t.Iflag |= syscall.INPCK
+	}
+
+	if ls.RTSCTS {
+		t.Cflag |= crtscts
+	}
+	if ls.XONXOFF {
+		t.Iflag |= syscall.IXON | syscall.IXOFF
+	}
+
+	//reads give up after VTIME even if nothing has arrived
+	if ls.ReadTimeout > 0 {
+		t.Cc[syscall.VMIN] = 0
+		t.Cc[syscall.VTIME] = ls.vtime()
+	}
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TIOCSETA, uintptr(unsafe.Pointer(&t))); errno != 0 {
+		return errno
+	}
+
+	return nil
+}
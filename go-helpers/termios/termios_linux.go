@@ -0,0 +1,70 @@
+// +build linux
+
+package termios
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+//not exported by syscall
+const (
+	cmspar  = 0x40000000 //mark/space parity
+	crtscts = 0x80000000 //hardware flow control
+)
+
+//Check tells whether Apply can set ls, on linux it always can
+func Check(ls LineSettings) error {
+	return nil
+}
+
+//Apply sets parity, flow control and the read timeout on the serial device at path
+func Apply(path string, ls LineSettings) error {
+
+	fd, err := syscall.Open(path, syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	var t syscall.Termios
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TCGETS, uintptr(unsafe.Pointer(&t))); errno != 0 {
+		return errno
+	}
+
+	t.Cflag &^= syscall.PARENB | syscall.PARODD | cmspar | crtscts
+	t.Iflag &^= syscall.INPCK | syscall.IXON | syscall.IXOFF | syscall.IXANY
+
+	switch ls.Parity {
+	case ParityOdd:
+		t.Cflag |= syscall.PARENB | syscall.PARODD
+	case ParityEven:
+		t.Cflag |= syscall.PARENB
+	case ParityMark:
+		t.Cflag |= syscall.PARENB | syscall.PARODD | cmspar
+	case ParitySpace:
+		t.Cflag |= syscall.PARENB | cmspar
+	}
+	if t.Cflag&syscall.PARENB != 0 {
+		t.Iflag |= syscall.INPCK
+	}
+
+	if ls.RTSCTS {
+		t.Cflag |= crtscts
+	}
+	if ls.XONXOFF {
+		t.Iflag |= syscall.IXON | syscall.IXOFF
+	}
+
+	//reads give up after VTIME even if nothing has arrived
+	if ls.ReadTimeout > 0 {
+		t.Cc[syscall.VMIN] = 0
+		t.Cc[syscall.VTIME] = ls.vtime()
+	}
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TCSETS, uintptr(unsafe.Pointer(&t))); errno != 0 {
+		return errno
+	}
+
+	return nil
+}
@@ -0,0 +1,54 @@
+// +build linux
+
+package termios
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/TheDistractor/flow-ext/go-helpers/ptytest"
+)
+
+func TestReadTimeout(t *testing.T) {
+	dev, err := ptytest.Open()
+	if err != nil {
+		t.Skip("no pty available:", err)
+	}
+	defer dev.Close()
+
+	if err := Apply(dev.Path, LineSettings{ReadTimeout: 250 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+
+	//a blocking read, as the serial libraries do, comes back empty once VTIME is up
+	fd, err := syscall.Open(dev.Path, syscall.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+
+	done := make(chan int, 1)
+	start := time.Now()
+	go func() {
+		n, _ := syscall.Read(fd, make([]byte, 16))
+		done <- n
+	}()
+	select {
+	case n := <-done:
+		if n != 0 || time.Since(start) < 200*time.Millisecond {
+			t.Errorf("expected an empty read after 0.3s, got %d bytes after %v", n, time.Since(start))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read did not time out")
+	}
+}
+
+func TestValidReadTimeout(t *testing.T) {
+	if ValidReadTimeout(MaxReadTimeout) != nil || ValidReadTimeout(MaxReadTimeout+time.Millisecond) == nil {
+		t.Error("wrong limit")
+	}
+	if v := (LineSettings{ReadTimeout: 250 * time.Millisecond}).vtime(); v != 3 {
+		t.Error("expected 3 tenths, got", v)
+	}
+}
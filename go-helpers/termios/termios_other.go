@@ -0,0 +1,22 @@
+// +build !linux,!darwin
+
+package termios
+
+import (
+	"errors"
+	"runtime"
+)
+
+//Check refuses anything but the default settings: applying them by device path only works on linux and darwin (on
+//windows the port can't be opened a second time, and the serial libraries don't offer SetCommState)
+func Check(ls LineSettings) error {
+	if ls.IsDefault() {
+		return nil
+	}
+	return errors.New("parity, flow control and read timeout settings are not supported for local ports on " + runtime.GOOS)
+}
+
+//Apply is only supported on linux and darwin, anything other than the default settings is an error
+func Apply(path string, ls LineSettings) error {
+	return Check(ls)
+}